@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/marcopeereboom/toy6502/loader"
+)
 
 const (
 	Negative   byte = 1 << 7 // N
@@ -470,13 +474,13 @@ var (
 		// 0x55
 		{
 			mnemonic: "EOR",
-			mode:     zeroPage,
+			mode:     zeroPageX,
 			noBytes:  2,
 			noCycles: 4,
 		},
 		// 0x56
 		{
-			mnemonic: "EOR",
+			mnemonic: "LSR",
 			mode:     zeroPageX,
 			noBytes:  2,
 			noCycles: 6,
@@ -1355,6 +1359,9 @@ type CPU struct {
 	y      byte   // Y index register
 	cycles uint64
 
+	irq bool // IRQ line asserted, level triggered
+	nmi bool // NMI pending, edge triggered
+
 	// 0000-00FF  - RAM for Zero-Page & Indirect-Memory Addressing
 	// 0100-01FF  - RAM for Stack Space & Absolute Addressing
 	// 0200-3FFF  - RAM for programmer use
@@ -1367,6 +1374,58 @@ type CPU struct {
 	// FFFE       - Vector address for IRQ & BRK (low byte)
 	// FFFF       - Vector address for IRQ & BRK (high byte)
 	memory []byte // memory
+
+	symbols *Symbols // names addresses, optional
+
+	observers []Observer
+	writers   []MemoryObserver
+}
+
+// Observer is notified around every instruction executed by a CPU.
+type Observer interface {
+	Before(c *CPU) // called before the instruction at pc executes
+	After(c *CPU)  // called once the instruction executed
+}
+
+// MemoryObserver is an Observer that is told about every memory write done
+// by an instruction or interrupt, including stack pushes.
+type MemoryObserver interface {
+	MemoryWrite(c *CPU, address uint16, old, value byte)
+}
+
+// InterruptObserver is an Observer that is told about interrupts before they
+// are taken, i.e. before pc and the status register are pushed.
+type InterruptObserver interface {
+	Interrupt(c *CPU, vector uint16)
+}
+
+// Attach adds an observer to the CPU.  Observers that implement
+// MemoryObserver are told about memory writes as well.
+func (c *CPU) Attach(o Observer) {
+	c.observers = append(c.observers, o)
+	if w, ok := o.(MemoryObserver); ok {
+		c.writers = append(c.writers, w)
+	}
+}
+
+// Detach removes an observer from the CPU.
+func (c *CPU) Detach(o Observer) {
+	for i := range c.observers {
+		if c.observers[i] == o {
+			c.observers = append(c.observers[:i], c.observers[i+1:]...)
+			break
+		}
+	}
+	w, ok := o.(MemoryObserver)
+	if !ok {
+		return
+	}
+	for i := range c.writers {
+		if c.writers[i] == w {
+			c.writers = append(c.writers[:i], c.writers[i+1:]...)
+			return
+		}
+	}
 }
 
 func New() *CPU {
@@ -1379,6 +1438,39 @@ func New() *CPU {
 	return &c
 }
 
+// load loads the image at path in the format of its extension.  Raw images
+// are copied into memory at address.
+func (c *CPU) load(path string, address uint16) error {
+	return c.LoadFile(path, loader.FormatOf(path), address, StartNone)
+}
+
+// resetVector returns the address stored in the RESET vector.
+func (c *CPU) resetVector() uint16 {
+	return uint16(c.memory[0xfffc]) | uint16(c.memory[0xfffd])<<8
+}
+
+// write stores value at address.  All instructions write memory through
+// write so that memory observers see every change.
+func (c *CPU) write(address uint16, value byte) {
+	for _, w := range c.writers {
+		w.MemoryWrite(c, address, c.memory[address], value)
+	}
+	c.memory[address] = value
+}
+
+// modify applies the read-modify-write operation op to address.
+func (c *CPU) modify(address uint16, op func(*byte)) {
+	v := c.memory[address]
+	op(&v)
+	c.write(address, v)
+}
+
+// push writes value to the stack.
+func (c *CPU) push(value byte) {
+	c.write(0x0100+uint16(c.sp), value)
+	c.sp--
+}
+
 func (c *CPU) evalZ(src byte) {
 	if src == 0x00 {
 		c.sr |= Zero
@@ -1410,7 +1502,7 @@ func (c *CPU) lda(src byte) {
 }
 
 func (c *CPU) sta(addr uint16) {
-	c.memory[addr] = c.a
+	c.write(addr, c.a)
 }
 
 func (c *CPU) ldy(src byte) {
@@ -1420,7 +1512,7 @@ func (c *CPU) ldy(src byte) {
 }
 
 func (c *CPU) sty(addr uint16) {
-	c.memory[addr] = c.y
+	c.write(addr, c.y)
 }
 
 func (c *CPU) ldx(src byte) {
@@ -1430,7 +1522,7 @@ func (c *CPU) ldx(src byte) {
 }
 
 func (c *CPU) stx(addr uint16) {
-	c.memory[addr] = c.x
+	c.write(addr, c.x)
 }
 
 func (c *CPU) txa() {
@@ -1625,30 +1717,26 @@ func (c *CPU) adcDecimal(i byte, j byte, carryIn byte) {
 }
 
 func (c *CPU) sbcDecimal(i byte, j byte, carryIn byte) {
-	var carryB byte = 0
+	borrow := 1 - int(carryIn)
+	carryB := 0
 
-	if carryIn == 0 {
-		carryIn = 1
-	} else {
-		carryIn = 0
-	}
-
-	low := (i & 0x0f) - (j & 0x0f) - carryIn
-	if (low & 0x10) != 0 {
+	// signed nibbles so that invalid BCD operands borrow like the NMOS
+	// part does
+	low := int(i&0x0f) - int(j&0x0f) - borrow
+	if low < 0 {
 		low -= 6
-	}
-	if (low & 0x10) != 0 {
 		carryB = 1
 	}
 
-	high := (i >> 4) - (j >> 4) - carryB
-	if (high & 0x10) != 0 {
+	high := int(i>>4) - int(j>>4) - carryB
+	if high < 0 {
 		high -= 6
 	}
 
-	r := (low & 0x0f) | (high << 4)
+	r := byte(low&0x0f) | byte(high<<4)
 
-	if high&0xff < 15 {
+	// carry is the one of the binary subtraction
+	if int(i)-int(j)-borrow >= 0 {
 		c.sr |= Carry
 	} else {
 		c.sr &^= Carry
@@ -1744,8 +1832,7 @@ func (c *CPU) ror(src *byte) {
 }
 
 func (c *CPU) pha() {
-	c.memory[0x0100+uint16(c.sp)] = c.a
-	c.sp--
+	c.push(c.a)
 }
 
 func (c *CPU) pla() {
@@ -1756,8 +1843,7 @@ func (c *CPU) pla() {
 }
 
 func (c *CPU) php() {
-	c.memory[0x0100+uint16(c.sp)] = c.sr | Unused | Break
-	c.sp--
+	c.push(c.sr | Unused | Break)
 }
 
 func (c *CPU) plp() {
@@ -1867,10 +1953,8 @@ func (c *CPU) bmi(src byte) bool {
 
 func (c *CPU) jsr(addr uint16) {
 	c.pc += uint16(opcodes[0x20].noBytes) - 1
-	c.memory[0x0100+uint16(c.sp)] = byte(c.pc >> 8)
-	c.sp--
-	c.memory[0x0100+uint16(c.sp)] = byte(c.pc)
-	c.sp--
+	c.push(byte(c.pc >> 8))
+	c.push(byte(c.pc))
 	c.pc = addr
 }
 
@@ -1884,16 +1968,13 @@ func (c *CPU) brk() {
 	// note that brk has a quirk that it skips 1 byte past pc
 	pc := c.pc + uint16(opcodes[0x00].noBytes) + 1
 	// high byte
-	c.memory[0x0100+uint16(c.sp)] = byte(pc >> 8)
-	c.sp--
+	c.push(byte(pc >> 8))
 
 	// low byte
-	c.memory[0x0100+uint16(c.sp)] = byte(pc)
-	c.sp--
+	c.push(byte(pc))
 
 	// status register
-	c.memory[0x0100+uint16(c.sp)] = c.sr
-	c.sp--
+	c.push(c.sr)
 
 	c.sr |= Interrupts
 
@@ -1980,7 +2061,52 @@ func (c *CPU) indexedIndirectY(addr uint16, offs byte) uint16 {
 		uint16(offs)
 }
 
+// IRQ sets the state of the IRQ line.  The interrupt is taken before the next
+// instruction for as long as the line is asserted and interrupts are enabled.
+func (c *CPU) IRQ(asserted bool) {
+	c.irq = asserted
+}
+
+// NMI signals a non maskable interrupt.  It is taken before the next
+// instruction.
+func (c *CPU) NMI() {
+	c.nmi = true
+}
+
+// interrupt pushes pc and the status register and jumps through vector.
+func (c *CPU) interrupt(vector uint16) {
+	for _, o := range c.observers {
+		if i, ok := o.(InterruptObserver); ok {
+			i.Interrupt(c, vector)
+		}
+	}
+	c.push(byte(c.pc >> 8))
+	c.push(byte(c.pc))
+	c.push((c.sr | Unused) &^ Break)
+	c.sr |= Interrupts
+	c.pc = uint16(c.memory[vector+1])<<8 | uint16(c.memory[vector])
+	c.cycles += 7
+}
+
 func (c *CPU) executeInstruction() {
+	switch {
+	case c.nmi:
+		c.nmi = false
+		c.interrupt(0xfffa)
+	case c.irq && c.sr&Interrupts == 0:
+		c.interrupt(0xfffe)
+	}
+
+	for _, o := range c.observers {
+		o.Before(c)
+	}
+	c.execute()
+	for _, o := range c.observers {
+		o.After(c)
+	}
+}
+
+func (c *CPU) execute() {
 	// decode instruction
 	opcode := c.memory[c.pc]
 	c.cycles += opcodes[opcode].noCycles + opcodes[opcode].extraCycles
@@ -1993,7 +2119,7 @@ func (c *CPU) executeInstruction() {
 	case 0x05:
 		c.ora(c.memory[c.zeroPage(c.pc, 0)])
 	case 0x06:
-		c.asl(&c.memory[c.zeroPage(c.pc, 0)])
+		c.modify(c.zeroPage(c.pc, 0), c.asl)
 	case 0x08:
 		c.php()
 	case 0x09:
@@ -2003,7 +2129,7 @@ func (c *CPU) executeInstruction() {
 	case 0x0d:
 		c.ora(c.memory[c.absolute(c.pc, 0)])
 	case 0x0e:
-		c.asl(&c.memory[c.absolute(c.pc, 0)])
+		c.modify(c.absolute(c.pc, 0), c.asl)
 	case 0x10:
 		if c.bpl(c.memory[c.pc+1]) {
 			return
@@ -2013,7 +2139,7 @@ func (c *CPU) executeInstruction() {
 	case 0x15:
 		c.ora(c.memory[c.zeroPage(c.pc, c.x)])
 	case 0x16:
-		c.asl(&c.memory[c.zeroPage(c.pc, c.x)])
+		c.modify(c.zeroPage(c.pc, c.x), c.asl)
 	case 0x18:
 		c.clc()
 	case 0x19:
@@ -2021,7 +2147,7 @@ func (c *CPU) executeInstruction() {
 	case 0x1d:
 		c.ora(c.memory[c.absolute(c.pc, c.x)])
 	case 0x1e:
-		c.asl(&c.memory[c.absolute(c.pc, c.x)])
+		c.modify(c.absolute(c.pc, c.x), c.asl)
 	case 0x20:
 		c.jsr(c.absolute(c.pc, 0))
 		return
@@ -2032,7 +2158,7 @@ func (c *CPU) executeInstruction() {
 	case 0x25:
 		c.and(c.memory[c.zeroPage(c.pc, 0)])
 	case 0x26:
-		c.rol(&c.memory[c.zeroPage(c.pc, 0)])
+		c.modify(c.zeroPage(c.pc, 0), c.rol)
 	case 0x28:
 		c.plp()
 	case 0x29:
@@ -2044,7 +2170,7 @@ func (c *CPU) executeInstruction() {
 	case 0x2d:
 		c.and(c.memory[c.absolute(c.pc, 0)])
 	case 0x2e:
-		c.rol(&c.memory[c.absolute(c.pc, 0)])
+		c.modify(c.absolute(c.pc, 0), c.rol)
 	case 0x30:
 		if c.bmi(c.memory[c.pc+1]) {
 			return
@@ -2054,7 +2180,7 @@ func (c *CPU) executeInstruction() {
 	case 0x35:
 		c.and(c.memory[c.zeroPage(c.pc, c.x)])
 	case 0x36:
-		c.rol(&c.memory[c.zeroPage(c.pc, c.x)])
+		c.modify(c.zeroPage(c.pc, c.x), c.rol)
 	case 0x38:
 		c.sec()
 	case 0x39:
@@ -2062,7 +2188,7 @@ func (c *CPU) executeInstruction() {
 	case 0x3d:
 		c.and(c.memory[c.absolute(c.pc, c.x)])
 	case 0x3e:
-		c.rol(&c.memory[c.absolute(c.pc, c.x)])
+		c.modify(c.absolute(c.pc, c.x), c.rol)
 	case 0x40:
 		c.rti()
 		return
@@ -2071,7 +2197,7 @@ func (c *CPU) executeInstruction() {
 	case 0x45:
 		c.eor(c.memory[c.zeroPage(c.pc, 0)])
 	case 0x46:
-		c.lsr(&c.memory[c.zeroPage(c.pc, 0)])
+		c.modify(c.zeroPage(c.pc, 0), c.lsr)
 	case 0x48:
 		c.pha()
 	case 0x49:
@@ -2084,7 +2210,7 @@ func (c *CPU) executeInstruction() {
 	case 0x4d:
 		c.eor(c.memory[c.absolute(c.pc, 0)])
 	case 0x4e:
-		c.lsr(&c.memory[c.absolute(c.pc, 0)])
+		c.modify(c.absolute(c.pc, 0), c.lsr)
 	case 0x50:
 		if c.bvc(c.memory[c.pc+1]) {
 			return
@@ -2094,7 +2220,7 @@ func (c *CPU) executeInstruction() {
 	case 0x55:
 		c.eor(c.memory[c.zeroPage(c.pc, c.x)])
 	case 0x56:
-		c.lsr(&c.memory[c.zeroPage(c.pc, c.x)])
+		c.modify(c.zeroPage(c.pc, c.x), c.lsr)
 	case 0x58:
 		c.cli()
 	case 0x59:
@@ -2102,7 +2228,7 @@ func (c *CPU) executeInstruction() {
 	case 0x5d:
 		c.eor(c.memory[c.absolute(c.pc, c.x)])
 	case 0x5e:
-		c.lsr(&c.memory[c.absolute(c.pc, c.x)])
+		c.modify(c.absolute(c.pc, c.x), c.lsr)
 	case 0x60:
 		c.rts()
 		return
@@ -2111,7 +2237,7 @@ func (c *CPU) executeInstruction() {
 	case 0x65:
 		c.adc(c.memory[c.zeroPage(c.pc, 0)])
 	case 0x66:
-		c.ror(&c.memory[c.zeroPage(c.pc, 0)])
+		c.modify(c.zeroPage(c.pc, 0), c.ror)
 	case 0x68:
 		c.pla()
 	case 0x69:
@@ -2124,7 +2250,7 @@ func (c *CPU) executeInstruction() {
 	case 0x6d:
 		c.adc(c.memory[c.absolute(c.pc, 0)])
 	case 0x6e:
-		c.ror(&c.memory[c.absolute(c.pc, 0)])
+		c.modify(c.absolute(c.pc, 0), c.ror)
 	case 0x70:
 		if c.bvs(c.memory[c.pc+1]) {
 			return
@@ -2134,7 +2260,7 @@ func (c *CPU) executeInstruction() {
 	case 0x75:
 		c.adc(c.memory[c.zeroPage(c.pc, c.x)])
 	case 0x76:
-		c.ror(&c.memory[c.zeroPage(c.pc, c.x)])
+		c.modify(c.zeroPage(c.pc, c.x), c.ror)
 	case 0x78:
 		c.sei()
 	case 0x79:
@@ -2142,7 +2268,7 @@ func (c *CPU) executeInstruction() {
 	case 0x7d:
 		c.adc(c.memory[c.absolute(c.pc, c.x)])
 	case 0x7e:
-		c.ror(&c.memory[c.absolute(c.pc, c.x)])
+		c.modify(c.absolute(c.pc, c.x), c.ror)
 	case 0x81:
 		c.sta(c.indexedIndirectX(c.pc, c.x))
 	case 0x84:
@@ -2238,7 +2364,7 @@ func (c *CPU) executeInstruction() {
 	case 0xc5:
 		c.cmp(c.memory[c.zeroPage(c.pc, 0)])
 	case 0xc6:
-		c.dec(&c.memory[c.zeroPage(c.pc, 0)])
+		c.modify(c.zeroPage(c.pc, 0), c.dec)
 	case 0xc8:
 		c.iny()
 	case 0xc9:
@@ -2250,7 +2376,7 @@ func (c *CPU) executeInstruction() {
 	case 0xcd:
 		c.cmp(c.memory[c.absolute(c.pc, 0)])
 	case 0xce:
-		c.dec(&c.memory[c.absolute(c.pc, 0)])
+		c.modify(c.absolute(c.pc, 0), c.dec)
 	case 0xd0:
 		if c.bne(c.memory[c.pc+1]) {
 			return
@@ -2260,7 +2386,7 @@ func (c *CPU) executeInstruction() {
 	case 0xd5:
 		c.cmp(c.memory[c.zeroPage(c.pc, c.x)])
 	case 0xd6:
-		c.dec(&c.memory[c.zeroPage(c.pc, c.x)])
+		c.modify(c.zeroPage(c.pc, c.x), c.dec)
 	case 0xd8:
 		c.cld()
 	case 0xd9:
@@ -2268,7 +2394,7 @@ func (c *CPU) executeInstruction() {
 	case 0xdd:
 		c.cmp(c.memory[c.absolute(c.pc, c.x)])
 	case 0xde:
-		c.dec(&c.memory[c.absolute(c.pc, c.x)])
+		c.modify(c.absolute(c.pc, c.x), c.dec)
 	case 0xe0:
 		c.cpx(c.memory[c.immediate(c.pc)])
 	case 0xe1:
@@ -2278,7 +2404,7 @@ func (c *CPU) executeInstruction() {
 	case 0xe5:
 		c.sbc(c.memory[c.zeroPage(c.pc, 0)])
 	case 0xe6:
-		c.inc(&c.memory[c.zeroPage(c.pc, 0)])
+		c.modify(c.zeroPage(c.pc, 0), c.inc)
 	case 0xe8:
 		c.inx()
 	case 0xe9:
@@ -2290,7 +2416,7 @@ func (c *CPU) executeInstruction() {
 	case 0xed:
 		c.sbc(c.memory[c.absolute(c.pc, 0)])
 	case 0xee:
-		c.inc(&c.memory[c.absolute(c.pc, 0)])
+		c.modify(c.absolute(c.pc, 0), c.inc)
 	case 0xf0:
 		if c.beq(c.memory[c.pc+1]) {
 			return
@@ -2300,7 +2426,7 @@ func (c *CPU) executeInstruction() {
 	case 0xf5:
 		c.sbc(c.memory[c.zeroPage(c.pc, c.x)])
 	case 0xf6:
-		c.inc(&c.memory[c.zeroPage(c.pc, c.x)])
+		c.modify(c.zeroPage(c.pc, c.x), c.inc)
 	case 0xf8:
 		c.sed()
 	case 0xf9:
@@ -2308,7 +2434,7 @@ func (c *CPU) executeInstruction() {
 	case 0xfd:
 		c.sbc(c.memory[c.absolute(c.pc, c.x)])
 	case 0xfe:
-		c.inc(&c.memory[c.absolute(c.pc, c.x)])
+		c.modify(c.absolute(c.pc, c.x), c.inc)
 	default:
 		// make this less drastic
 		panic(fmt.Sprintf("invalid opcode: $%02x PC $%04x",
@@ -2342,38 +2468,47 @@ func (c *CPU) disassemble(address uint16) (string, byte) {
 			c.memory[c.immediate(address)]), o.noBytes
 	case indirect:
 		// absolute call here is intended
-		return fmt.Sprintf("%v\t($%02X)", o.mnemonic,
-			c.absolute(address, 0)), o.noBytes
+		return fmt.Sprintf("%v\t(%v)", o.mnemonic,
+			c.operand(c.absolute(address, 0), "$%02X")), o.noBytes
 	case relative:
-		return fmt.Sprintf("%v\t$%04X", o.mnemonic,
-			c.relative(address)), o.noBytes
+		return fmt.Sprintf("%v\t%v", o.mnemonic,
+			c.operand(c.relative(address), "$%04X")), o.noBytes
 	case zeroPage:
-		return fmt.Sprintf("%v\t$%02X", o.mnemonic,
-			c.zeroPage(address, 0)), o.noBytes
+		return fmt.Sprintf("%v\t%v", o.mnemonic,
+			c.operand(c.zeroPage(address, 0), "$%02X")), o.noBytes
 	case zeroPageX:
-		return fmt.Sprintf("%v\t$%02X,X", o.mnemonic,
-			c.zeroPage(address, 0)), o.noBytes
+		return fmt.Sprintf("%v\t%v,X", o.mnemonic,
+			c.operand(c.zeroPage(address, 0), "$%02X")), o.noBytes
 	case zeroPageY:
-		return fmt.Sprintf("%v\t$%02X,Y", o.mnemonic,
-			c.zeroPage(address, 0)), o.noBytes
+		return fmt.Sprintf("%v\t%v,Y", o.mnemonic,
+			c.operand(c.zeroPage(address, 0), "$%02X")), o.noBytes
 	case absolute:
-		return fmt.Sprintf("%v\t$%04X", o.mnemonic,
-			c.absolute(address, 0)), o.noBytes
+		return fmt.Sprintf("%v\t%v", o.mnemonic,
+			c.operand(c.absolute(address, 0), "$%04X")), o.noBytes
 	case absoluteX:
-		return fmt.Sprintf("%v\t$%04X,X", o.mnemonic,
-			c.absolute(address, 0)), o.noBytes
+		return fmt.Sprintf("%v\t%v,X", o.mnemonic,
+			c.operand(c.absolute(address, 0), "$%04X")), o.noBytes
 	case absoluteY:
-		return fmt.Sprintf("%v\t$%04X,Y", o.mnemonic,
-			c.absolute(address, 0)), o.noBytes
+		return fmt.Sprintf("%v\t%v,Y", o.mnemonic,
+			c.operand(c.absolute(address, 0), "$%04X")), o.noBytes
 	case zeroPageIndirectX:
 		// zeroPage call here is intended
-		return fmt.Sprintf("%v\t($%02X,X)", o.mnemonic,
-			c.zeroPage(address, 0)), o.noBytes
+		return fmt.Sprintf("%v\t(%v,X)", o.mnemonic,
+			c.operand(c.zeroPage(address, 0), "$%02X")), o.noBytes
 	case zeroPageIndirectY:
 		// zeroPage call here is intended
-		return fmt.Sprintf("%v\t($%02X),Y", o.mnemonic,
-			c.zeroPage(address, 0)), o.noBytes
+		return fmt.Sprintf("%v\t(%v),Y", o.mnemonic,
+			c.operand(c.zeroPage(address, 0), "$%02X")), o.noBytes
 	default:
 		return fmt.Sprintf("INVALID MODE"), 0
 	}
 }
+
+// operand formats the operand address of a disassembled instruction, by
+// name when a symbol is defined at exactly address.
+func (c *CPU) operand(address uint16, format string) string {
+	if name, ok := c.symbols.Name(address); ok {
+		return name
+	}
+	return fmt.Sprintf(format, address)
+}
@@ -1,8 +1,28 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/marcopeereboom/toy6502/loader"
+)
+
+var (
+	traceFile   = flag.String("trace", "", "write Klaus Dormann trace to file")
+	traceFormat = flag.String("traceformat", "nestest",
+		"trace format: nestest, binary or json")
+	lcovFile = flag.String("lcov", "",
+		"write Klaus Dormann coverage in lcov format to file")
+	historySize = flag.Int("history", 32,
+		"instructions shown when Klaus Dormann's tests fail")
+	klausDir = flag.String("klausdir", "test",
+		"directory of Klaus Dormann's test binaries and listings")
 )
 
 func TestPha(t *testing.T) {
@@ -1042,7 +1062,7 @@ func TestJsr(t *testing.T) {
 		t.Fatalf("invalid low byte %0x", c.memory[0x1ff])
 	}
 	if c.memory[0x1fe] != 0x02 {
-		t.Fatal("invalid high byte %0x", c.memory[0x1fe])
+		t.Fatalf("invalid high byte %0x", c.memory[0x1fe])
 	}
 }
 
@@ -4729,61 +4749,584 @@ func TestAdcDecimal(t *testing.T) {
 	t.Logf("%v\n", d)
 }
 
-func TestKlausDormann6502(t *testing.T) {
+// klausReport describes a trap of the functional tests at pc: the test case
+// and section, the source leading up to the trap, the registers, the zero
+// page test variables and the last instructions executed.
+func klausReport(c *CPU, l *Listing, h *History, pc uint16) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "trap at %v", c.location(pc))
+	if l == nil {
+		fmt.Fprintf(&b, "\nregisters: %v\n", c.snapshot())
+		for _, r := range h.Records(c) {
+			fmt.Fprintf(&b, "%v\n", r)
+		}
+		return b.String()
+	}
+	if a, ok := l.Label("test_case"); ok {
+		fmt.Fprintf(&b, " in test case $%02X", c.memory[a])
+	}
+	if heading, ok := l.Heading(pc, "next_test"); ok {
+		fmt.Fprintf(&b, "\nsection: %v", heading)
+	}
+	fmt.Fprintf(&b, "\n%v\n", l.Context(pc))
+	if line, ok := l.Line(pc); ok {
+		for i := max(line-8, 1); i <= line; i++ {
+			fmt.Fprintf(&b, "%6d %v\n", i, l.Text(i))
+		}
+	}
+
+	flags := []byte("NV-BDIZC")
+	for i := range flags {
+		if c.sr&(0x80>>i) == 0 {
+			flags[i] = '.'
+		}
+	}
+	fmt.Fprintf(&b, "registers: %v flags: %s\n", c.snapshot(), flags)
+
+	b.WriteString("zero page:")
+	zp := l.Symbols().sorted
+	for i, sym := range zp {
+		if sym.address > 0xff {
+			break
+		}
+		if i > 0 && zp[i-1].address == sym.address {
+			continue // another name for the same variable
+		}
+		// variables are at most 4 bytes, up to the next one
+		end := sym.address + 1
+		for _, next := range zp[i+1:] {
+			if next.address > sym.address {
+				end = min(next.address, sym.address+4)
+				break
+			}
+		}
+		fmt.Fprintf(&b, " %v=", sym.name)
+		for a := sym.address; a < end; a++ {
+			fmt.Fprintf(&b, "%02X", c.memory[a])
+		}
+	}
+
+	fmt.Fprintf(&b, "\nlast %v instructions:\n", h.Len())
+	for _, r := range h.Records(c) {
+		fmt.Fprintf(&b, "%v\n", r)
+	}
+	return b.String()
+}
+
+// TestOpcodeTableZeroPageX checks the table entries of $55 and $56, which
+// were listed as EOR zero page and EOR zero page,X while they execute as EOR
+// zero page,X and LSR zero page,X.
+func TestOpcodeTableZeroPageX(t *testing.T) {
 	c := New()
-	f, err := os.Open("test/6502_functional_test.bin")
+	for _, test := range []struct {
+		code []byte
+		text string
+	}{
+		{[]byte{0x55, 0x10}, "EOR\t$10,X"},
+		{[]byte{0x56, 0x10}, "LSR\t$10,X"},
+	} {
+		copy(c.memory[caseStart:], test.code)
+		d, n := c.disassemble(caseStart)
+		if d != test.text || n != 2 {
+			t.Fatalf("$%02X: unexpected disassembly %q",
+				test.code[0], d)
+		}
+	}
+	runInstructionCases(t, []instructionCase{
+		{Asm: "EOR $10,X", Setup: "A=$0F X=$01 $0011=$FF",
+			Want: "A=$F0 N=1", Cycles: 4},
+		{Asm: "LSR $10,X", Setup: "X=$01 $0011=$03",
+			Want: "$0011=$01 C=1", Cycles: 6},
+	})
+}
+
+// klausTest describes one of Klaus Dormann's test programs.
+type klausTest struct {
+	dir     string // directory of the files, -klausdir by default
+	binary  string // file in dir
+	listing string // file in dir, optional unless success is 0
+	start   uint16 // start address
+
+	// success is the address of the success trap, 0 for the success
+	// macro of the listing.  Tests without a success trap set check.
+	success uint16
+
+	// check decides if the program passed once it trapped at pc.
+	check func(c *CPU, l *Listing, pc uint16) error
+
+	limit uint64 // instructions before giving up, 0 for no limit
+}
+
+// runKlaus loads and runs a test program until it traps.  Missing binaries
+// are skipped; they are not distributed with the emulator.  Binaries of the
+// whole address space load at $0000, smaller ones at the lowest address of
+// their listing.
+func runKlaus(t *testing.T, kt klausTest, observers ...Observer) {
+	dir := kt.dir
+	if dir == "" {
+		dir = *klausDir
+	}
+	binary := filepath.Join(dir, kt.binary)
+	info, err := os.Stat(binary)
+	if err != nil {
+		t.Skipf("%v not found, see README", binary)
+	}
+
+	var l *Listing
+	if kt.listing != "" {
+		l, err = loadListing(filepath.Join(dir, kt.listing))
+		switch {
+		case err != nil && kt.success == 0 && kt.check == nil:
+			t.Skipf("%v, see README", err)
+		case err != nil:
+			t.Logf("no listing: %v", err)
+		}
+	}
+	var load uint16
+	if info.Size() < 0x10000 {
+		var ok bool
+		if l != nil {
+			load, ok = l.Origin()
+		}
+		if !ok {
+			t.Skipf("load address of %v unknown without a listing",
+				binary)
+		}
+	}
+
+	c := New()
+	err = c.LoadFile(binary, loader.FormatRaw, load, StartNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetSymbols(l.Symbols())
+	success := kt.success
+	if success == 0 && kt.check == nil {
+		var ok bool
+		success, ok = l.MacroAddress("success")
+		if !ok {
+			t.Fatalf("no success trap in %v", kt.listing)
+		}
+	}
+
+	h := NewHistory(*historySize)
+	c.Attach(h)
+	for _, o := range observers {
+		c.Attach(o)
+	}
+
+	c.pc = kt.start
+	conditions := []HaltCondition{HaltOnJumpToSelf(), HaltOnBranchToSelf()}
+	if kt.limit > 0 {
+		conditions = append(conditions, HaltAfterInstructions(kt.limit))
+	}
+	halt := c.Run(context.Background(), conditions...)
+	pc := halt.PC
+	switch {
+	case halt.Kind == HaltInvalidOpcode:
+		t.Fatalf("invalid opcode $%02X\n%v", c.memory[pc],
+			klausReport(c, l, h, pc))
+	case halt.Kind == HaltInstructions:
+		t.Fatalf("no trap after %v instructions\n%v",
+			halt.Instructions, klausReport(c, l, h, pc))
+	case kt.check != nil:
+		if err := kt.check(c, l, pc); err != nil {
+			t.Fatalf("%v\n%v", err, klausReport(c, l, h, pc))
+		}
+	case pc != success:
+		t.Fatalf("%v", klausReport(c, l, h, pc))
+	}
+	t.Logf("%v passed.", kt.binary)
+	t.Logf("instructions run: %v cycles: %v", halt.Instructions,
+		halt.Cycles)
+}
+
+func TestKlausDormann6502(t *testing.T) {
+	var observers []Observer
+	if *traceFile != "" {
+		format, err := ParseTraceFormat(*traceFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tf, err := os.Create(*traceFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tf.Close()
+		tracer := NewTracer(tf, format)
+		defer func() {
+			if err := tracer.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		observers = append(observers, tracer)
+	}
+
+	if *lcovFile != "" {
+		l, err := loadListing(filepath.Join(*klausDir,
+			"6502_functional_test.lst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cv := NewCoverage()
+		observers = append(observers, cv)
+		defer func() {
+			err := writeFile(*lcovFile, func(w io.Writer) error {
+				return cv.WriteLcov(w, l, "klaus")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}()
+	}
+
+	runKlaus(t, klausTest{
+		binary:  "6502_functional_test.bin",
+		listing: "6502_functional_test.lst",
+		start:   0x0400,
+	}, observers...)
+}
+
+func TestKlausDormannDecimal(t *testing.T) {
+	runKlaus(t, klausTest{
+		binary:  "6502_decimal_test.bin",
+		listing: "6502_decimal_test.lst",
+		start:   0x0200,
+		limit:   100000000,
+		// The test ends in a trap and leaves 0 in ERROR when all
+		// results and flags matched.
+		check: func(c *CPU, l *Listing, pc uint16) error {
+			address := uint16(0x000b)
+			if a, ok := l.Symbols().Label("ERROR"); ok {
+				address = a
+			}
+			if e := c.memory[address]; e != 0 {
+				return fmt.Errorf("ERROR is $%02X", e)
+			}
+			return nil
+		},
+	})
+}
+
+func TestKlausDormannInterrupt(t *testing.T) {
+	runKlaus(t, klausTest{
+		binary:  "6502_interrupt_test.bin",
+		listing: "6502_interrupt_test.lst",
+		start:   0x0400,
+	}, NewFeedbackPort(0xbffc))
+}
+
+// writeKlausProgram assembles source and writes the bytes from its lowest
+// to its highest address with the listing to name.bin and name.lst in a
+// temporary directory.  It returns the directory and the labels.
+func writeKlausProgram(t *testing.T, name string, source []string) (string,
+	map[string]uint16) {
+
+	lines, labels := assembleSource(t, source)
+	image, listing := formatTestListing(lines)
+	start, end := len(image), 0
+	for _, line := range lines {
+		var address uint16
+		var code []byte
+		if _, err := fmt.Sscanf(line, "%04x %x|", &address,
+			&code); err != nil {
+			continue
+		}
+		start = min(start, int(address))
+		end = max(end, int(address)+len(code))
+	}
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, name+".bin"), image[start:end],
+		0o644)
 	if err != nil {
 		t.Fatal(err)
 	}
-	fi, err := f.Stat()
+	err = os.WriteFile(filepath.Join(dir, name+".lst"), []byte(listing),
+		0o644)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if fi.Size() > int64(len(c.memory)) {
-		t.Fatal("invalid ram image size")
+	return dir, labels
+}
+
+// TestDecimalProgram runs a decimal mode test like the one of the suite,
+// which is not distributed with the emulator.  It adds and subtracts all
+// valid BCD operands with both carries and compares the results with binary
+// arithmetic, leaving 0 in ERROR when all matched.
+func TestDecimalProgram(t *testing.T) {
+	source := []string{
+		"ERROR = $0b",
+		"b1 = $10        ; operands in binary",
+		"b2 = $11",
+		"cin = $12       ; carry in",
+		"n1 = $13        ; operands in BCD",
+		"n2 = $14",
+		"exp = $15       ; expected result in binary",
+		"ec = $16        ; expected carry",
+		"res = $17",
+		"        org $0200",
+		"start:  cld",
+		"        ldx #$ff",
+		"        txs",
+		"        lda #1",
+		"        sta ERROR",
+		"        lda #0",
+		"        sta b1",
+		"l1:     lda #0",
+		"        sta b2",
+		"l2:     lda #0",
+		"        sta cin",
+		"l3:     ldx b1",
+		"        lda tobcd,x",
+		"        sta n1",
+		"        ldx b2",
+		"        lda tobcd,x",
+		"        sta n2",
+		"; ADC",
+		"        clc",
+		"        lda b1",
+		"        adc b2",
+		"        adc cin",
+		"        sta exp",
+		"        cmp #100",
+		"        lda #0",
+		"        rol a",
+		"        sta ec",
+		"        lda cin",
+		"        lsr a",
+		"        sed",
+		"        lda n1",
+		"        adc n2",
+		"        cld",
+		"        sta res",
+		"        lda #0",
+		"        rol a",
+		"        cmp ec",
+		"        bne fail",
+		"        ldx exp",
+		"        lda tobcd,x",
+		"        cmp res",
+		"        bne fail",
+		"; SBC",
+		"        lda cin",
+		"        lsr a",
+		"        lda b1",
+		"        sbc b2",
+		"        sta exp",
+		"        lda #0",
+		"        rol a",
+		"        sta ec",
+		"        bne sbc1",
+		"        clc          ; a borrow, 100 more",
+		"        lda exp",
+		"        adc #100",
+		"        sta exp",
+		"sbc1:   lda cin",
+		"        lsr a",
+		"        sed",
+		"        lda n1",
+		"        sbc n2",
+		"        cld",
+		"        sta res",
+		"        lda #0",
+		"        rol a",
+		"        cmp ec",
+		"        bne fail",
+		"        ldx exp",
+		"        lda tobcd,x",
+		"        cmp res",
+		"        bne fail",
+		"; next operands",
+		"        inc cin",
+		"        lda cin",
+		"        cmp #2",
+		"        beq next2",
+		"        jmp l3",
+		"next2:  inc b2",
+		"        lda b2",
+		"        cmp #100",
+		"        beq next1",
+		"        jmp l2",
+		"next1:  inc b1",
+		"        lda b1",
+		"        cmp #100",
+		"        beq next0",
+		"        jmp l1",
+		"next0:  lda #0",
+		"        sta ERROR",
+		"done:   jmp done",
+		"fail:   jmp fail",
+		"; the BCD of 0 to 199, modulo 100",
+	}
+	for i := 0; i < 200; i += 8 {
+		var values []string
+		for j := i; j < i+8; j++ {
+			values = append(values, fmt.Sprintf("$%d%d", j%100/10,
+				j%10))
+		}
+		db := "db " + strings.Join(values, ",")
+		if i == 0 {
+			db = "tobcd:  " + db
+		} else {
+			db = "        " + db
+		}
+		source = append(source, db)
+	}
+
+	dir, labels := writeKlausProgram(t, "decimal", source)
+	runKlaus(t, klausTest{
+		dir:     dir,
+		binary:  "decimal.bin",
+		listing: "decimal.lst",
+		start:   0x0200,
+		limit:   10000000,
+		check: func(c *CPU, l *Listing, pc uint16) error {
+			switch {
+			case pc != labels["done"]:
+				return fmt.Errorf("trap at %v", c.location(pc))
+			case c.memory[0x000b] != 0:
+				return fmt.Errorf("ERROR is $%02X",
+					c.memory[0x000b])
+			}
+			return nil
+		},
+	})
+}
+
+// TestInterruptProgram runs an interrupt test like the one of the suite,
+// which is not distributed with the emulator.  It raises IRQ and NMI through
+// a FeedbackPort and executes BRK, counting the interrupts in their
+// handlers.
+func TestInterruptProgram(t *testing.T) {
+	source := []string{
+		"irqs = $10",
+		"nmis = $11",
+		"brks = $12",
+		"port = $bffc",
+		"        org $0400",
+		"start:  cld",
+		"        ldx #$ff",
+		"        txs",
+		"        lda #0",
+		"        sta irqs",
+		"        sta nmis",
+		"        sta brks",
+		"        sta port",
+		"; IRQ is masked while I is set",
+		"        sei",
+		"        lda #1",
+		"        sta port",
+		"        nop",
+		"        lda irqs",
+		"        bne fail",
+		"; and taken once it is clear, the handler releases it",
+		"        cli",
+		"        nop",
+		"        nop",
+		"        sei",
+		"        lda irqs",
+		"        cmp #1",
+		"        bne fail",
+		"; NMI on a rising bit 1 even with I set, not on a level",
+		"        lda #2",
+		"        sta port",
+		"        nop",
+		"        sta port",
+		"        nop",
+		"        lda nmis",
+		"        cmp #1",
+		"        bne fail",
+		"        lda #0",
+		"        sta port",
+		"; BRK goes through the IRQ vector with B set",
+		"        brk",
+		"        db $ea",
+		"        lda brks",
+		"        cmp #1",
+		"        bne fail",
+		"        lda irqs",
+		"        cmp #1",
+		"        bne fail",
+		"success: jmp success",
+		"fail:   jmp fail",
+		"irq:    pha",
+		"        tsx",
+		"        lda $0102,x  ; the pushed status register",
+		"        and #$10",
+		"        bne isbrk",
+		"        inc irqs",
+		"        lda #0",
+		"        sta port",
+		"        pla",
+		"        rti",
+		"isbrk:  inc brks",
+		"        pla",
+		"        rti",
+		"nmi:    inc nmis",
+		"        rti",
+		"        org $fffa",
+		"        db <nmi,>nmi,<start,>start,<irq,>irq",
+	}
+
+	dir, labels := writeKlausProgram(t, "interrupt", source)
+	runKlaus(t, klausTest{
+		dir:     dir,
+		binary:  "interrupt.bin",
+		listing: "interrupt.lst",
+		start:   0x0400,
+		success: labels["success"],
+		limit:   1000,
+	}, NewFeedbackPort(0xbffc))
+}
+
+// TestKlausDormann65C02 is skipped: the emulator is an NMOS 6502 and the
+// extended opcodes test cannot run until the 65C02 opcodes are implemented.
+func TestKlausDormann65C02(t *testing.T) {
+	t.Skip("65C02 not supported, only the NMOS 6502 opcodes are " +
+		"implemented")
+}
+
+func TestKlausDormannReport(t *testing.T) {
+	c := New()
+	err := c.LoadFile("test/6502_functional_test.bin", loader.FormatRaw, 0,
+		StartNone)
+	if err != nil {
+		t.Fatal(err)
 	}
-	_, err = f.Read(c.memory)
+	l, err := loadListing("test/6502_functional_test.lst")
 	if err != nil {
 		t.Fatal(err)
 	}
+	c.SetSymbols(l.Symbols())
+	h := NewHistory(4)
+	c.Attach(h)
 
+	// precharge the accumulator of the PHA test with the wrong value
+	c.memory[0x073d] = 0x02
 	c.pc = 0x0400
-	prevPC := uint16(0x0400)
-
-	var instructions uint64
-	for {
-		//d, _ := c.disassemble(c.pc)
-		//t.Logf("%v\n", d)
-		c.executeInstruction()
-		//fmt.Printf("%v\n", c.snapshot())
-		//fmt.Printf("A: $%02x X: $%02x Y: $%02x SR: $%02x PC: $%04x SP: $%02x"+
-		//	" %02x %02x %02x %02x %02x %02x %02x %02x\n",
-		//	c.a,
-		//	c.x,
-		//	c.y,
-		//	c.sr,
-		//	c.pc,
-		//	c.sp,
-		//	c.memory[0x0a],
-		//	c.memory[0x0b],
-		//	c.memory[0x0c],
-		//	c.memory[0x0d],
-		//	c.memory[0x0e],
-		//	c.memory[0x0f],
-		//	c.memory[0x10],
-		//	c.memory[0x11])
-		instructions++
-		if c.pc == prevPC {
-			if c.pc != 0x3399 {
-				t.Fatalf("loop detected at PC 0x%04X.", c.pc)
-			}
-			t.Logf("Klaus Dormann's 6502 functional tests passed.")
-			t.Logf("instructions run: %v cycles: %v",
-				instructions,
-				c.cycles)
-			return
+	halt := c.Run(context.Background(), HaltOnJumpToSelf(),
+		HaltOnBranchToSelf())
+	if halt.PC != 0x0743 {
+		t.Fatalf("unexpected halt %v", halt)
+	}
+
+	report := klausReport(c, l, h, c.pc)
+	for _, want := range []string{
+		"trap at $0743 (",
+		" in test case $05\n",
+		"section: ; test PHA does not alter flags or accumulator " +
+			"but PLA does\n",
+		"6502_functional_test.a65:1288: tst_a 1,$ff\n" +
+			"  > bne *",
+		"  1572             trap_ne\n",
+		"SR: $7d PC: $0743 SP: $fd flags: .V-BDI.C\n",
+		" adfc=00 ad1=00 ",
+		" zp1=C3824100 ",
+		"last 4 instructions:\n073F  48 ",
+		"0743  D0 FE     BNE $0743 ",
+	} {
+		if !strings.Contains(report, want) {
+			t.Fatalf("report lacks %q:\n%v", want, report)
 		}
-
-		prevPC = c.pc
 	}
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"testing/quick"
+)
+
+// The reference models below are written from the data sheet and from Bruce
+// Clark's "Decimal Mode" tutorial, independently of the emulator.  Each
+// returns the accumulator and the flags it defines.  In decimal mode only
+// the accumulator and carry are defined the same on all parts; N, V and Z
+// are not checked.
+
+// aluResult is what an ALU operation produced.
+type aluResult struct {
+	a          byte
+	n, v, z, c bool
+}
+
+func (r aluResult) String() string {
+	return fmt.Sprintf("A=$%02X N=%v V=%v Z=%v C=%v", r.a, b2i(r.n),
+		b2i(r.v), b2i(r.z), b2i(r.c))
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// refADC adds in binary using signed and unsigned integers.
+func refADC(a, m byte, c int) aluResult {
+	u := int(a) + int(m) + c
+	s := int(int8(a)) + int(int8(m)) + c
+	return aluResult{
+		a: byte(u),
+		n: byte(u)&0x80 != 0,
+		v: s < -128 || s > 127,
+		z: byte(u) == 0,
+		c: u > 0xff,
+	}
+}
+
+// refSBC subtracts in binary; the carry is the inverted borrow.
+func refSBC(a, m byte, c int) aluResult {
+	u := int(a) - int(m) - (1 - c)
+	s := int(int8(a)) - int(int8(m)) - (1 - c)
+	return aluResult{
+		a: byte(u),
+		n: byte(u)&0x80 != 0,
+		v: s < -128 || s > 127,
+		z: byte(u) == 0,
+		c: u >= 0,
+	}
+}
+
+// refADCDecimal is sequence 1 of Clark's tutorial, which gives the
+// accumulator and carry of the NMOS 6502 for all operands, valid BCD or not.
+func refADCDecimal(a, m byte, c int) (byte, bool) {
+	al := int(a&0x0f) + int(m&0x0f) + c
+	if al >= 0x0a {
+		al = (al+0x06)&0x0f + 0x10
+	}
+	r := int(a&0xf0) + int(m&0xf0) + al
+	if r >= 0xa0 {
+		r += 0x60
+	}
+	return byte(r), r >= 0x100
+}
+
+// refSBCDecimal is sequence 3 of Clark's tutorial.  The carry is the one of
+// the binary subtraction.
+func refSBCDecimal(a, m byte, c int) (byte, bool) {
+	al := int(a&0x0f) - int(m&0x0f) + c - 1
+	if al < 0 {
+		al = (al-0x06)&0x0f - 0x10
+	}
+	r := int(a&0xf0) - int(m&0xf0) + al
+	if r < 0 {
+		r -= 0x60
+	}
+	return byte(r), refSBC(a, m, c).c
+}
+
+// bcd returns the value of a packed BCD byte and whether it is valid.
+func bcd(b byte) (int, bool) {
+	return int(b>>4)*10 + int(b&0x0f), b>>4 <= 9 && b&0x0f <= 9
+}
+
+// aluCPU returns a CPU with A set to a and the carry set to c.  The other
+// flags are set to sr so that tests can check they are left alone.
+func aluCPU(a byte, c int, sr byte) *CPU {
+	cpu := New()
+	cpu.a = a
+	cpu.sr = sr &^ Carry
+	if c != 0 {
+		cpu.sr |= Carry
+	}
+	return cpu
+}
+
+// result returns the accumulator and flags of c.
+func result(c *CPU) aluResult {
+	return aluResult{
+		a: c.a,
+		n: c.sr&Negative != 0,
+		v: c.sr&Overflow != 0,
+		z: c.sr&Zero != 0,
+		c: c.sr&Carry != 0,
+	}
+}
+
+// forOperands calls f with every accumulator, operand and carry.
+func forOperands(f func(a, m byte, c int)) {
+	for a := 0; a < 256; a++ {
+		for m := 0; m < 256; m++ {
+			for c := 0; c < 2; c++ {
+				f(byte(a), byte(m), c)
+			}
+		}
+	}
+}
+
+func TestALUBinary(t *testing.T) {
+	forOperands(func(a, m byte, c int) {
+		cpu := aluCPU(a, c, Unused)
+		cpu.adcNormal(a, m, byte(c))
+		if got, want := result(cpu), refADC(a, m, c); got != want {
+			t.Fatalf("adc $%02X+$%02X+%v: expected %v, got %v",
+				a, m, c, want, got)
+		}
+
+		cpu = aluCPU(a, c, Unused)
+		cpu.sbc(m)
+		if got, want := result(cpu), refSBC(a, m, c); got != want {
+			t.Fatalf("sbc $%02X-$%02X-%v: expected %v, got %v",
+				a, m, 1-c, want, got)
+		}
+	})
+}
+
+func TestALUDecimal(t *testing.T) {
+	forOperands(func(a, m byte, c int) {
+		cpu := aluCPU(a, c, Unused|BCD)
+		cpu.adc(m)
+		r, carry := refADCDecimal(a, m, c)
+		if cpu.a != r || (cpu.sr&Carry != 0) != carry {
+			t.Fatalf("adc $%02X+$%02X+%v: expected A=$%02X C=%v, "+
+				"got %v", a, m, c, r, b2i(carry), result(cpu))
+		}
+		x, validA := bcd(a)
+		y, validM := bcd(m)
+		if validA && validM {
+			sum := x + y + c
+			if d, _ := bcd(cpu.a); d != sum%100 ||
+				(cpu.sr&Carry != 0) != (sum >= 100) {
+				t.Fatalf("adc %v+%v+%v: got %v", x, y, c,
+					result(cpu))
+			}
+		}
+
+		cpu = aluCPU(a, c, Unused|BCD)
+		cpu.sbc(m)
+		r, carry = refSBCDecimal(a, m, c)
+		if cpu.a != r || (cpu.sr&Carry != 0) != carry {
+			t.Fatalf("sbc $%02X-$%02X-%v: expected A=$%02X C=%v, "+
+				"got %v", a, m, 1-c, r, b2i(carry), result(cpu))
+		}
+		if validA && validM {
+			diff := x - y - (1 - c)
+			if d, _ := bcd(cpu.a); d != (diff+100)%100 ||
+				(cpu.sr&Carry != 0) != (diff >= 0) {
+				t.Fatalf("sbc %v-%v-%v: got %v", x, y, 1-c,
+					result(cpu))
+			}
+		}
+	})
+}
+
+func TestALUCompare(t *testing.T) {
+	forOperands(func(a, m byte, c int) {
+		cpu := aluCPU(a, c, Unused|Overflow)
+		cpu.cmp(m)
+		want := refSBC(a, m, 1)
+		want.a, want.v = a, true
+		if got := result(cpu); got != want {
+			t.Fatalf("cmp $%02X,$%02X: expected %v, got %v", a, m,
+				want, got)
+		}
+
+		cpu = aluCPU(a, c, Unused)
+		cpu.bit(m)
+		want = aluResult{
+			a: a,
+			n: m&0x80 != 0,
+			v: m&0x40 != 0,
+			z: a&m == 0,
+			c: c != 0,
+		}
+		if got := result(cpu); got != want {
+			t.Fatalf("bit $%02X,$%02X: expected %v, got %v", a, m,
+				want, got)
+		}
+	})
+}
+
+func TestALURotate(t *testing.T) {
+	for v := 0; v < 256; v++ {
+		for c := 0; c < 2; c++ {
+			cpu := aluCPU(0, c, Unused|Overflow)
+			b := byte(v)
+			cpu.rol(&b)
+			r := byte(v<<1 | c)
+			want := aluResult{n: r&0x80 != 0, v: true, z: r == 0,
+				c: v&0x80 != 0}
+			if got := result(cpu); b != r || got != want {
+				t.Fatalf("rol $%02X,%v: expected $%02X %v, "+
+					"got $%02X %v", v, c, r, want, b, got)
+			}
+
+			cpu = aluCPU(0, c, Unused|Overflow)
+			b = byte(v)
+			cpu.ror(&b)
+			r = byte(v>>1 | c<<7)
+			want = aluResult{n: c != 0, v: true, z: r == 0,
+				c: v&0x01 != 0}
+			if got := result(cpu); b != r || got != want {
+				t.Fatalf("ror $%02X,%v: expected $%02X %v, "+
+					"got $%02X %v", v, c, r, want, b, got)
+			}
+		}
+	}
+}
+
+// TestALUProperties checks invariants that hold whatever the other flags
+// are.
+func TestALUProperties(t *testing.T) {
+	// in binary mode SBC is ADC of the complement
+	sbcIsADC := func(a, m, sr byte) bool {
+		sr &^= BCD
+		x := aluCPU(a, int(sr&Carry), sr)
+		x.sbc(m)
+		y := aluCPU(a, int(sr&Carry), sr)
+		y.adc(^m)
+		return x.a == y.a && x.sr == y.sr
+	}
+
+	// adding and subtracting the same value restores the accumulator
+	addSub := func(a, m, sr byte) bool {
+		x := aluCPU(a, 0, sr)
+		x.adc(m)
+		x.sr |= Carry // no borrow
+		x.sbc(m)
+		if sr&BCD != 0 {
+			_, validA := bcd(a)
+			_, validM := bcd(m)
+			if !validA || !validM {
+				return true
+			}
+		}
+		return x.a == a
+	}
+
+	// ROR undoes ROL, carry included
+	rotate := func(v, sr byte) bool {
+		x := aluCPU(0, int(sr&Carry), sr)
+		b := v
+		x.rol(&b)
+		x.ror(&b)
+		return b == v && x.sr&Carry == sr&Carry
+	}
+
+	// the operations leave the flags they do not define alone
+	untouched := func(a, m, sr byte) bool {
+		keeps := func(x *CPU, defined byte) bool {
+			return x.sr&^defined == sr&^defined
+		}
+		x := aluCPU(a, int(sr&Carry), sr)
+		x.cmp(m)
+		y := aluCPU(a, int(sr&Carry), sr)
+		y.bit(m)
+		z := aluCPU(a, int(sr&Carry), sr)
+		z.rol(&m)
+		return keeps(x, Negative|Zero|Carry) &&
+			keeps(y, Negative|Overflow|Zero) &&
+			keeps(z, Negative|Zero|Carry)
+	}
+
+	for name, f := range map[string]interface{}{
+		"sbc is adc of the complement": sbcIsADC,
+		"add then subtract":            addSub,
+		"rotate":                       rotate,
+		"untouched flags":              untouched,
+	} {
+		err := quick.Check(f, &quick.Config{MaxCount: 10000})
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// assemble assembles a single instruction at pc.  Operands are written the
+// way disassemble prints them: $nn is a zero page address, $nnnn an
+// absolute one and branches take the target address.
+func assemble(pc uint16, text string) ([]byte, error) {
+	f := strings.Fields(text)
+	if len(f) == 0 {
+		return nil, fmt.Errorf("no instruction")
+	}
+	mnemonic := strings.ToUpper(f[0])
+	operand := strings.ToUpper(strings.Join(f[1:], ""))
+
+	var modes []mode // candidates, preferred first
+	value := operand
+	wide := func(s string) bool {
+		return strings.HasPrefix(s, "$") && len(s) > 3
+	}
+	paren := strings.HasPrefix(operand, "(")
+	switch {
+	case operand == "":
+		modes = []mode{implied, accumulator}
+	case operand == "A":
+		modes = []mode{accumulator}
+	case strings.HasPrefix(operand, "#"):
+		modes, value = []mode{immediate}, operand[1:]
+	case paren && strings.HasSuffix(operand, ",X)"):
+		modes = []mode{zeroPageIndirectX}
+		value = strings.TrimSuffix(operand[1:], ",X)")
+	case paren && strings.HasSuffix(operand, "),Y"):
+		modes = []mode{zeroPageIndirectY}
+		value = strings.TrimSuffix(operand[1:], "),Y")
+	case paren && strings.HasSuffix(operand, ")"):
+		modes, value = []mode{indirect}, operand[1:len(operand)-1]
+	case strings.HasSuffix(operand, ",X"):
+		value = strings.TrimSuffix(operand, ",X")
+		modes = []mode{zeroPageX, absoluteX}
+		if wide(value) {
+			modes = modes[1:]
+		}
+	case strings.HasSuffix(operand, ",Y"):
+		value = strings.TrimSuffix(operand, ",Y")
+		modes = []mode{zeroPageY, absoluteY}
+		if wide(value) {
+			modes = modes[1:]
+		}
+	default:
+		modes = []mode{relative, zeroPage, absolute}
+		if wide(value) {
+			modes = []mode{relative, absolute}
+		}
+	}
+
+	for _, m := range modes {
+		for i, o := range opcodes {
+			if o == invalidOpcode || o.mnemonic != mnemonic ||
+				o.mode != m {
+				continue
+			}
+			b := []byte{byte(i)}
+			if o.noBytes == 1 {
+				return b, nil
+			}
+			v, err := parseAddress(value)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case m == relative:
+				offset := int(v) - int(pc) - 2
+				if offset < -128 || offset > 127 {
+					return nil, fmt.Errorf("branch out of "+
+						"range: %v", text)
+				}
+				return append(b, byte(offset)), nil
+			case o.noBytes == 2 && v > 0xff:
+				continue
+			case o.noBytes == 2:
+				return append(b, byte(v)), nil
+			}
+			return append(b, byte(v), byte(v>>8)), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid instruction: %v", text)
+}
+
+func TestAssemble(t *testing.T) {
+	c := New()
+	for i, o := range opcodes {
+		if o == invalidOpcode {
+			continue
+		}
+		code := []byte{byte(i), 0x12, 0x34}[:o.noBytes]
+		copy(c.memory[caseStart:], code)
+		d, _ := c.disassemble(caseStart)
+		got, err := assemble(caseStart, d)
+		if err != nil {
+			t.Fatalf("%v: %v", d, err)
+		}
+		if string(got) != string(code) {
+			t.Fatalf("%v: expected % X, got % X", d, code, got)
+		}
+	}
+
+	for _, test := range []struct {
+		text string
+		code []byte
+	}{
+		{"lda #10", []byte{0xa9, 0x0a}},
+		{"LDA $0010", []byte{0xad, 0x10, 0x00}},
+		{"lda $1234 , x", []byte{0xbd, 0x34, 0x12}},
+		{"rol a", []byte{0x2a}},
+		{"jmp $10", []byte{0x4c, 0x10, 0x00}},
+		{"bne $0400", []byte{0xd0, 0xfe}},
+	} {
+		got, err := assemble(caseStart, test.text)
+		if err != nil || string(got) != string(test.code) {
+			t.Fatalf("%v: % X %v", test.text, got, err)
+		}
+	}
+	for _, text := range []string{"", "lda", "xyz #1", "sta #1",
+		"bne $0500", "lda ($1234),y"} {
+		if _, err := assemble(caseStart, text); err == nil {
+			t.Fatalf("%q assembled", text)
+		}
+	}
+}
+
+// assembleSource assembles a test program into lines for formatTestListing
+// and returns them with the labels.  A line is "label:" or an instruction as
+// taken by assemble, or both, "org value", "db value,..." or "name = value",
+// followed by an optional ; comment.  Values and operands may use labels,
+// <label and >label for the low and high byte.  Labels of code must be
+// above the zero page.
+func assembleSource(t *testing.T, source []string) ([]string,
+	map[string]uint16) {
+
+	t.Helper()
+	labels := make(map[string]uint16)
+	token := regexp.MustCompile(`[$%0-9]\w*|[<>]?[A-Za-z_]\w*`)
+	// resolve replaces labels with their values.  Unknown labels, which
+	// are defined further down, stand for pc on the first pass.
+	resolve := func(s string, pc uint16, final bool) string {
+		return token.ReplaceAllStringFunc(s, func(n string) string {
+			part := n[0]
+			switch part {
+			case '$', '%', '0', '1', '2', '3', '4', '5', '6', '7',
+				'8', '9':
+				return n // a number
+			case '<', '>':
+				n = n[1:]
+			}
+			v, ok := labels[n]
+			switch {
+			case !ok && len(n) == 1 &&
+				strings.Contains("AXY", strings.ToUpper(n)):
+				return n
+			case !ok && final:
+				t.Fatalf("unknown label %v", n)
+			case !ok:
+				v = pc
+			}
+			switch {
+			case part == '<':
+				return fmt.Sprintf("$%02X", v&0xff)
+			case part == '>':
+				return fmt.Sprintf("$%02X", v>>8)
+			case v < 0x100:
+				return fmt.Sprintf("$%02X", v)
+			}
+			return fmt.Sprintf("$%04X", v)
+		})
+	}
+
+	var lines []string
+	for pass := 0; pass < 2; pass++ {
+		final := pass == 1
+		lines = lines[:0]
+		var pc uint16
+		for _, text := range source {
+			statement, _, _ := strings.Cut(text, ";")
+			statement = strings.TrimSpace(statement)
+			if label, rest, ok := strings.Cut(statement, ":"); ok {
+				labels[label] = pc
+				statement = strings.TrimSpace(rest)
+			}
+			f := strings.Fields(statement)
+			var code []byte
+			switch {
+			case len(f) == 0:
+			case len(f) == 3 && f[1] == "=":
+				v, err := parseAddress(resolve(f[2], pc, final))
+				if err != nil {
+					t.Fatalf("%v: %v", text, err)
+				}
+				labels[f[0]] = v
+			case f[0] == "org":
+				v, err := parseAddress(resolve(f[1], pc, final))
+				if err != nil {
+					t.Fatalf("%v: %v", text, err)
+				}
+				pc = v
+			case f[0] == "db":
+				values := strings.Split(strings.Join(f[1:], ""),
+					",")
+				for _, value := range values {
+					value = resolve(value, pc, final)
+					v, err := parseAddress(value)
+					if err != nil || v > 0xff {
+						t.Fatalf("%v: invalid byte",
+							text)
+					}
+					code = append(code, byte(v))
+				}
+			default:
+				operand := strings.Join(f[1:], " ")
+				operand = resolve(operand, pc, final)
+				var err error
+				code, err = assemble(pc, f[0]+" "+operand)
+				if err != nil {
+					t.Fatalf("%v: %v", text, err)
+				}
+			}
+			if len(code) == 0 {
+				lines = append(lines, "|"+text)
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%04x %x|%v", pc,
+				code, text))
+			pc += uint16(len(code))
+		}
+	}
+	return lines, labels
+}
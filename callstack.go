@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// CallKind is the way a call frame was entered.
+type CallKind int
+
+const (
+	CallJSR CallKind = iota
+	CallBRK
+	CallIRQ
+	CallNMI
+)
+
+func (k CallKind) String() string {
+	switch k {
+	case CallJSR:
+		return "jsr"
+	case CallBRK:
+		return "brk"
+	case CallIRQ:
+		return "irq"
+	case CallNMI:
+		return "nmi"
+	}
+	return fmt.Sprintf("CallKind(%d)", int(k))
+}
+
+// CallFrame is an entry of the shadow call stack.
+type CallFrame struct {
+	Kind   CallKind
+	Caller uint16 // calling or interrupted instruction
+	Callee uint16 // subroutine or handler entry
+	Return uint16 // address execution is expected to return to
+	Cycle  uint64 // cycle count when the frame was entered
+	SP     byte   // stack pointer before the call
+}
+
+// ImbalanceKind classifies stack imbalances.
+type ImbalanceKind int
+
+const (
+	ImbalanceNoCall        ImbalanceKind = iota // return without a frame
+	ImbalanceTrampoline                         // return within the frame
+	ImbalanceReturnAddress                      // unexpected return address
+	ImbalanceReturnKind                         // RTS vs RTI mismatch
+	ImbalanceDiscarded                          // frames dropped by PLA
+	ImbalanceOverflow                           // SP wrapped pushing
+	ImbalanceUnderflow                          // SP wrapped pulling
+)
+
+func (k ImbalanceKind) String() string {
+	switch k {
+	case ImbalanceNoCall:
+		return "return without call"
+	case ImbalanceTrampoline:
+		return "return used as jump"
+	case ImbalanceReturnAddress:
+		return "return address modified"
+	case ImbalanceReturnKind:
+		return "mismatched return"
+	case ImbalanceDiscarded:
+		return "frames discarded"
+	case ImbalanceOverflow:
+		return "stack overflow"
+	case ImbalanceUnderflow:
+		return "stack underflow"
+	}
+	return fmt.Sprintf("ImbalanceKind(%d)", int(k))
+}
+
+// StackImbalance describes an instruction that did not keep the shadow call
+// stack balanced.
+type StackImbalance struct {
+	Kind   ImbalanceKind
+	PC     uint16      // offending instruction
+	Cycle  uint64      // cycle count when it started
+	SP     byte        // stack pointer before it executed
+	Frames []CallFrame // frames involved, innermost first
+}
+
+// CallStack is an Observer that maintains a shadow call stack from JSR, BRK,
+// interrupts, RTS and RTI.  Frames end when their return address is pulled
+// off the stack.
+type CallStack struct {
+	Listing     *Listing             // names addresses, optional
+	OnImbalance func(StackImbalance) // called for every imbalance, optional
+	Undo        int                  // instructions Unwind can undo
+
+	frames []CallFrame // outermost first
+
+	journal []callUndo
+	marks   undoMarks
+
+	pc     uint16
+	opcode byte
+	sp     byte
+	cycle  uint64
+}
+
+// callUndo undoes a change of the call stack, the push of a frame or the pop
+// of a frame.
+type callUndo struct {
+	push  bool
+	frame CallFrame
+}
+
+// NewCallStack returns an empty call stack.
+func NewCallStack() *CallStack {
+	return &CallStack{}
+}
+
+// stackEffect returns the bytes pushed and pulled by opcode.
+func stackEffect(opcode byte) (int, int) {
+	switch opcode {
+	case 0x48, 0x08: // PHA, PHP
+		return 1, 0
+	case 0x68, 0x28: // PLA, PLP
+		return 0, 1
+	case 0x20: // JSR
+		return 2, 0
+	case 0x00: // BRK
+		return 3, 0
+	case 0x60: // RTS
+		return 0, 2
+	case 0x40: // RTI
+		return 0, 3
+	}
+	return 0, 0
+}
+
+func (cs *CallStack) imbalance(kind ImbalanceKind, frames []CallFrame) {
+	if cs.OnImbalance == nil {
+		return
+	}
+	f := make([]CallFrame, 0, len(frames))
+	for i := len(frames) - 1; i >= 0; i-- {
+		f = append(f, frames[i])
+	}
+	cs.OnImbalance(StackImbalance{
+		Kind:   kind,
+		PC:     cs.pc,
+		Cycle:  cs.cycle,
+		SP:     cs.sp,
+		Frames: f,
+	})
+}
+
+// Interrupt pushes a frame for an interrupt that is about to be taken.
+func (cs *CallStack) Interrupt(c *CPU, vector uint16) {
+	kind := CallIRQ
+	if vector == 0xfffa {
+		kind = CallNMI
+	}
+	cs.push(CallFrame{
+		Kind:   kind,
+		Caller: c.pc,
+		Callee: uint16(c.memory[vector]) |
+			uint16(c.memory[vector+1])<<8,
+		Return: c.pc,
+		Cycle:  c.cycles,
+		SP:     c.sp,
+	})
+}
+
+// push pushes f.
+func (cs *CallStack) push(f CallFrame) {
+	cs.frames = append(cs.frames, f)
+	if cs.Undo > 0 {
+		cs.journal = append(cs.journal, callUndo{push: true, frame: f})
+	}
+}
+
+// pop pops frames until n are left.
+func (cs *CallStack) pop(n int) {
+	for cs.Undo > 0 && len(cs.frames) > n {
+		f := cs.frames[len(cs.frames)-1]
+		cs.journal = append(cs.journal, callUndo{frame: f})
+		cs.frames = cs.frames[:len(cs.frames)-1]
+	}
+	cs.frames = cs.frames[:n]
+}
+
+// mark starts the journal of the next instruction.
+func (cs *CallStack) mark() {
+	cs.marks.limit = cs.Undo
+	cs.journal = cs.journal[cs.marks.start(len(cs.journal)):]
+}
+
+// Unwind restores the frames from before the last n instructions, and the
+// next one.
+func (cs *CallStack) Unwind(c *CPU, n int) {
+	first := cs.marks.undo(n)
+	for i := len(cs.journal) - 1; i >= first; i-- {
+		u := cs.journal[i]
+		if u.push {
+			if len(cs.frames) > 0 {
+				cs.frames = cs.frames[:len(cs.frames)-1]
+			}
+			continue
+		}
+		cs.frames = append(cs.frames, u.frame)
+	}
+	cs.journal = cs.journal[:first]
+}
+
+// Before checks the instruction at pc for stack pointer wrap around.
+func (cs *CallStack) Before(c *CPU) {
+	cs.pc = c.pc
+	cs.opcode = c.memory[c.pc]
+	cs.sp = c.sp
+	cs.cycle = c.cycles
+	if cs.Undo > 0 && len(cs.marks.marks) == 0 {
+		cs.mark()
+	}
+
+	push, pull := stackEffect(cs.opcode)
+	switch {
+	case int(c.sp)-push < 0:
+		cs.imbalance(ImbalanceOverflow, nil)
+	case int(c.sp)+pull > 0xff:
+		cs.imbalance(ImbalanceUnderflow, nil)
+	}
+}
+
+// After updates the call stack.
+func (cs *CallStack) After(c *CPU) {
+	// Frames whose return address was pulled off the stack are unwound.
+	// A push that wrapped SP around unwinds nothing.
+	n := len(cs.frames)
+	for n > 0 && cs.frames[n-1].SP <= c.sp && c.sp >= cs.sp {
+		n--
+	}
+	unwound := cs.frames[n:]
+
+	switch cs.opcode {
+	case 0x60, 0x40: // RTS, RTI
+		switch {
+		case len(cs.frames) == 0:
+			cs.imbalance(ImbalanceNoCall, nil)
+		case len(unwound) == 0:
+			cs.imbalance(ImbalanceTrampoline,
+				cs.frames[len(cs.frames)-1:])
+		default:
+			f := unwound[0]
+			interrupt := f.Kind != CallJSR
+			switch {
+			case interrupt != (cs.opcode == 0x40):
+				cs.imbalance(ImbalanceReturnKind, unwound[:1])
+			case c.pc != f.Return:
+				cs.imbalance(ImbalanceReturnAddress,
+					unwound[:1])
+			}
+			if len(unwound) > 1 {
+				cs.imbalance(ImbalanceDiscarded, unwound[1:])
+			}
+		}
+	default:
+		if len(unwound) > 0 {
+			cs.imbalance(ImbalanceDiscarded, unwound)
+		}
+	}
+	cs.pop(n)
+
+	switch cs.opcode {
+	case 0x20: // JSR
+		cs.push(CallFrame{
+			Kind:   CallJSR,
+			Caller: cs.pc,
+			Callee: c.pc,
+			Return: cs.pc + 3,
+			Cycle:  cs.cycle,
+			SP:     cs.sp,
+		})
+	case 0x00: // BRK
+		cs.push(CallFrame{
+			Kind:   CallBRK,
+			Caller: cs.pc,
+			Callee: c.pc,
+			Return: cs.pc + 2,
+			Cycle:  cs.cycle,
+			SP:     cs.sp,
+		})
+	}
+	if cs.Undo > 0 {
+		cs.mark()
+	}
+}
+
+// Depth returns the number of frames.
+func (cs *CallStack) Depth() int {
+	return len(cs.frames)
+}
+
+// Frames returns the call frames, innermost first.
+func (cs *CallStack) Frames() []CallFrame {
+	f := make([]CallFrame, 0, len(cs.frames))
+	for i := len(cs.frames) - 1; i >= 0; i-- {
+		f = append(f, cs.frames[i])
+	}
+	return f
+}
+
+// Sync drops frames that are no longer on the stack of c, e.g. after the
+// machine state was changed by a debugger or rewound.
+func (cs *CallStack) Sync(c *CPU) {
+	for len(cs.frames) > 0 && cs.frames[len(cs.frames)-1].SP <= c.sp {
+		cs.frames = cs.frames[:len(cs.frames)-1]
+	}
+}
+
+// Reset drops all frames.
+func (cs *CallStack) Reset() {
+	cs.frames = nil
+	cs.journal = nil
+	cs.marks.marks = nil
+}
+
+// Restored drops all frames; the calls that led to a loaded state are not
+// known.
+func (cs *CallStack) Restored(c *CPU) {
+	cs.Reset()
+}
+
+// symbolName returns address as label+offset when listing l has a label at
+// or below it and in hex otherwise.
+func symbolName(l *Listing, address uint16) string {
+	if l == nil {
+		return fmt.Sprintf("$%04X", address)
+	}
+	return l.symbols.addressName(address)
+}
+
+// WriteBacktrace writes the backtrace of c, innermost first.  Addresses are
+// named by the symbols of c, or by Listing when c has none.
+func (cs *CallStack) WriteBacktrace(w io.Writer, c *CPU) error {
+	names := c.symbols
+	if names.Len() == 0 && cs.Listing != nil {
+		names = cs.Listing.symbols
+	}
+	bw := bufio.NewWriter(w)
+	pc := c.pc
+	for i, f := range cs.Frames() {
+		fmt.Fprintf(bw, "#%-2d $%04X %v, %v from $%04X %v at "+
+			"cycle %v\n", i, pc, names.addressName(pc), f.Kind,
+			f.Caller, names.addressName(f.Caller), f.Cycle)
+		pc = f.Caller
+	}
+	fmt.Fprintf(bw, "#%-2d $%04X %v\n", len(cs.frames), pc,
+		names.addressName(pc))
+	return bw.Flush()
+}
+
+// String returns the imbalance in human readable form.
+func (si StackImbalance) String() string {
+	s := fmt.Sprintf("%v at $%04X, cycle %v, SP $%02X", si.Kind, si.PC,
+		si.Cycle, si.SP)
+	for _, f := range si.Frames {
+		s += fmt.Sprintf("; %v $%04X from $%04X", f.Kind, f.Callee,
+			f.Caller)
+	}
+	return s
+}
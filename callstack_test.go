@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// callStackCPU returns a CPU with code at 0x0400 and a call stack that
+// records imbalances.
+func callStackCPU(code []byte) (*CPU, *CallStack, *[]StackImbalance) {
+	c := New()
+	c.pc = 0x0400
+	c.sp = 0xfd
+	copy(c.memory[0x0400:], code)
+	cs := NewCallStack()
+	var imbalances []StackImbalance
+	cs.OnImbalance = func(si StackImbalance) {
+		imbalances = append(imbalances, si)
+	}
+	c.Attach(cs)
+	return c, cs, &imbalances
+}
+
+func TestCallStackBacktrace(t *testing.T) {
+	bin, lst := writeTestListing(t, []string{
+		"0400 201004|start   jsr outer",
+		"0403 4c0304|done    jmp done",
+		"0410 202004|outer   jsr inner",
+		"0413 60|        rts",
+		"0420 ea|inner   nop",
+		"0421 60|        rts",
+	})
+	c := New()
+	if err := c.load(bin, 0); err != nil {
+		t.Fatal(err)
+	}
+	c.pc = 0x0400
+	l, err := loadListing(lst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := NewCallStack()
+	cs.Listing = l
+	cs.OnImbalance = func(si StackImbalance) {
+		t.Fatalf("unexpected imbalance %v", si)
+	}
+	c.Attach(cs)
+
+	for i := 0; i < 3; i++ {
+		c.executeInstruction()
+	}
+	frames := cs.Frames()
+	if len(frames) != 2 {
+		t.Fatalf("unexpected frames %+v", frames)
+	}
+	if frames[0].Callee != 0x0420 || frames[0].Caller != 0x0410 ||
+		frames[0].Return != 0x0413 || frames[0].Cycle != 6 ||
+		frames[1].Callee != 0x0410 || frames[1].Kind != CallJSR {
+		t.Fatalf("unexpected frames %+v", frames)
+	}
+
+	var b bytes.Buffer
+	if err := cs.WriteBacktrace(&b, c); err != nil {
+		t.Fatal(err)
+	}
+	expected := "#0  $0421 inner+$1, jsr from $0410 outer at cycle 6\n" +
+		"#1  $0410 outer, jsr from $0400 start at cycle 0\n" +
+		"#2  $0400 start\n"
+	if b.String() != expected {
+		t.Fatalf("unexpected backtrace:\n%v", b.String())
+	}
+	// the symbols of the CPU name addresses before the listing
+	syms := NewSymbols()
+	syms.Add("main", 0x0400)
+	c.SetSymbols(syms)
+	b.Reset()
+	if err := cs.WriteBacktrace(&b, c); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(b.String(), "#2  $0400 main\n") {
+		t.Fatalf("unexpected backtrace:\n%v", b.String())
+	}
+	c.SetSymbols(nil)
+
+	for i := 0; i < 2; i++ {
+		c.executeInstruction()
+	}
+	if cs.Depth() != 0 || c.pc != 0x0403 {
+		t.Fatalf("unexpected depth %v at $%04x", cs.Depth(), c.pc)
+	}
+}
+
+func TestCallStackImbalances(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  []byte
+		n     int
+		kinds []ImbalanceKind
+		depth int
+	}{
+		{
+			name:  "rts without jsr",
+			code:  []byte{0x60},
+			n:     1,
+			kinds: []ImbalanceKind{ImbalanceNoCall},
+		},
+		{
+			// jsr sub; sub: lda #$04 pha lda #$1f pha rts
+			name: "trampoline",
+			code: []byte{0x20, 0x03, 0x04, 0xa9, 0x04, 0x48,
+				0xa9, 0x1f, 0x48, 0x60},
+			n:     6,
+			kinds: []ImbalanceKind{ImbalanceTrampoline},
+			depth: 1,
+		},
+		{
+			// jsr sub; sub: pla pla
+			name:  "discarded",
+			code:  []byte{0x20, 0x03, 0x04, 0x68, 0x68},
+			n:     3,
+			kinds: []ImbalanceKind{ImbalanceDiscarded},
+		},
+		{
+			// jsr sub; sub: rti
+			name:  "rti from subroutine",
+			code:  []byte{0x20, 0x03, 0x04, 0x40},
+			n:     2,
+			kinds: []ImbalanceKind{ImbalanceReturnKind},
+		},
+		{
+			// jsr sub; sub: pla clc adc #2 pha rts
+			name: "return address",
+			code: []byte{0x20, 0x03, 0x04, 0x68, 0x18, 0x69, 0x02,
+				0x48, 0x60},
+			n:     6,
+			kinds: []ImbalanceKind{ImbalanceReturnAddress},
+		},
+		{
+			// ldx #0 txs pha
+			name:  "overflow",
+			code:  []byte{0xa2, 0x00, 0x9a, 0x48},
+			n:     3,
+			kinds: []ImbalanceKind{ImbalanceOverflow},
+		},
+		{
+			// ldx #$ff txs pla
+			name:  "underflow",
+			code:  []byte{0xa2, 0xff, 0x9a, 0x68},
+			n:     3,
+			kinds: []ImbalanceKind{ImbalanceUnderflow},
+		},
+	}
+	for _, test := range tests {
+		c, cs, imbalances := callStackCPU(test.code)
+		for i := 0; i < test.n; i++ {
+			c.executeInstruction()
+		}
+		if len(*imbalances) != len(test.kinds) {
+			t.Fatalf("%v: unexpected imbalances %v", test.name,
+				*imbalances)
+		}
+		for i, kind := range test.kinds {
+			if (*imbalances)[i].Kind != kind {
+				t.Fatalf("%v: unexpected imbalance %v",
+					test.name, (*imbalances)[i])
+			}
+		}
+		if cs.Depth() != test.depth {
+			t.Fatalf("%v: unexpected depth %v", test.name,
+				cs.Depth())
+		}
+	}
+}
+
+func TestCallStackInterrupt(t *testing.T) {
+	c, cs, imbalances := callStackCPU([]byte{0xea, 0xea})
+	c.memory[0x0500] = 0x40 // rti
+	c.memory[0xfffa] = 0x00
+	c.memory[0xfffb] = 0x05
+
+	c.executeInstruction()
+	c.NMI()
+	c.executeInstruction() // nmi entry and rti
+	if len(*imbalances) != 0 || cs.Depth() != 0 || c.pc != 0x0401 {
+		t.Fatalf("unexpected state %v %v", *imbalances, c.snapshot())
+	}
+
+	c.pc = 0x0400
+	c.memory[0x0500] = 0xea // nop
+	c.NMI()
+	c.executeInstruction()
+	frames := cs.Frames()
+	if len(frames) != 1 || frames[0].Kind != CallNMI ||
+		frames[0].Caller != 0x0400 || frames[0].Callee != 0x0500 {
+		t.Fatalf("unexpected frames %+v", frames)
+	}
+	if !strings.Contains((StackImbalance{Kind: ImbalanceNoCall}).String(),
+		"return without call") {
+		t.Fatalf("unexpected imbalance string")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// EdgeKind is the way control flows from a basic block to another.
+type EdgeKind int
+
+const (
+	EdgeFallthrough EdgeKind = iota // next instruction
+	EdgeTaken                       // taken conditional branch
+	EdgeJump                        // JMP absolute
+	EdgeIndirect                    // JMP indirect, target as in memory
+	EdgeReturn                      // JSR returning to the next instruction
+)
+
+func (k EdgeKind) String() string {
+	switch k {
+	case EdgeFallthrough:
+		return "fallthrough"
+	case EdgeTaken:
+		return "taken"
+	case EdgeJump:
+		return "jump"
+	case EdgeIndirect:
+		return "indirect"
+	case EdgeReturn:
+		return "return"
+	}
+	return fmt.Sprintf("EdgeKind(%d)", int(k))
+}
+
+// MarshalText encodes the kind by name.
+func (k EdgeKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Edge is a control flow edge between basic blocks.
+type Edge struct {
+	To   uint16   `json:"to"`
+	Kind EdgeKind `json:"kind"`
+}
+
+// BasicBlock is a straight sequence of instructions with a single entry.
+type BasicBlock struct {
+	Start        uint16     `json:"start"`
+	Instructions []uint16   `json:"instructions"` // addresses in order
+	Edges        []Edge     `json:"edges"`
+	Calls        []CallSite `json:"calls,omitempty"` // JSRs in the block
+	Exit         string     `json:"exit,omitempty"`  // rts, rti, brk, invalid
+}
+
+// Last returns the address of the last instruction of the block.
+func (b *BasicBlock) Last() uint16 {
+	return b.Instructions[len(b.Instructions)-1]
+}
+
+// Subroutine is the control flow graph of the code reachable from an entry
+// point without following JSR.
+type Subroutine struct {
+	Entry  uint16                 `json:"entry"`
+	Name   string                 `json:"name"`
+	Blocks map[uint16]*BasicBlock `json:"blocks"`
+}
+
+// CallSite is a JSR from one subroutine to another.
+type CallSite struct {
+	Caller uint16 `json:"caller"` // subroutine entry
+	Site   uint16 `json:"site"`   // address of the JSR
+	Callee uint16 `json:"callee"` // subroutine entry
+}
+
+// CFG holds the control flow graphs of all subroutines reachable from a set
+// of entry points and the call graph between them.
+type CFG struct {
+	Subroutines map[uint16]*Subroutine `json:"subroutines"`
+	Calls       []CallSite             `json:"calls"`
+
+	cpu     *CPU
+	listing *Listing
+}
+
+// BuildCFG statically analyzes the code in the memory of c reachable from
+// entries.  Targets of indirect jumps are taken from memory as it is.  Names
+// come from listing l when not nil.
+func BuildCFG(c *CPU, l *Listing, entries []uint16) *CFG {
+	g := &CFG{
+		Subroutines: make(map[uint16]*Subroutine),
+		cpu:         c,
+		listing:     l,
+	}
+	todo := append([]uint16(nil), entries...)
+	for len(todo) > 0 {
+		entry := todo[0]
+		todo = todo[1:]
+		if _, ok := g.Subroutines[entry]; ok {
+			continue
+		}
+		s := g.subroutine(entry)
+		g.Subroutines[entry] = s
+		for _, b := range s.sortedBlocks() {
+			for _, call := range b.Calls {
+				g.Calls = append(g.Calls, call)
+				todo = append(todo, call.Callee)
+			}
+		}
+	}
+	sort.Slice(g.Calls, func(i, j int) bool {
+		if g.Calls[i].Caller != g.Calls[j].Caller {
+			return g.Calls[i].Caller < g.Calls[j].Caller
+		}
+		return g.Calls[i].Site < g.Calls[j].Site
+	})
+	return g
+}
+
+// successors returns the control flow out of the instruction at address.
+// The call target of JSR and the kind of exit, if any, are returned as well.
+func (g *CFG) successors(address uint16) ([]Edge, uint16, bool, string) {
+	m := g.cpu.memory
+	opcode := m[address]
+	o := opcodes[opcode]
+	next := address + uint16(o.noBytes)
+	switch {
+	case o == invalidOpcode:
+		return nil, 0, false, "invalid"
+	case o.mode == relative:
+		return []Edge{
+			{To: g.cpu.relative(address), Kind: EdgeTaken},
+			{To: next, Kind: EdgeFallthrough},
+		}, 0, false, ""
+	}
+	switch opcode {
+	case 0x00: // BRK
+		return nil, 0, false, "brk"
+	case 0x20: // JSR
+		return []Edge{{To: next, Kind: EdgeReturn}},
+			g.cpu.absolute(address, 0), true, ""
+	case 0x40: // RTI
+		return nil, 0, false, "rti"
+	case 0x60: // RTS
+		return nil, 0, false, "rts"
+	case 0x4c: // JMP absolute
+		return []Edge{{To: g.cpu.absolute(address, 0), Kind: EdgeJump}},
+			0, false, ""
+	case 0x6c: // JMP indirect
+		return []Edge{{To: g.cpu.indirect(address),
+			Kind: EdgeIndirect}}, 0, false, ""
+	}
+	return []Edge{{To: next, Kind: EdgeFallthrough}}, 0, false, ""
+}
+
+// subroutine builds the basic blocks reachable from entry.
+func (g *CFG) subroutine(entry uint16) *Subroutine {
+	// Find all instructions and the leaders that start blocks.
+	type instruction struct {
+		edges  []Edge
+		callee uint16
+		call   bool
+		exit   string
+	}
+	code := make(map[uint16]instruction)
+	leaders := map[uint16]bool{entry: true}
+	todo := []uint16{entry}
+	for len(todo) > 0 {
+		a := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if _, ok := code[a]; ok {
+			continue
+		}
+		edges, callee, call, exit := g.successors(a)
+		code[a] = instruction{edges, callee, call, exit}
+		for _, e := range edges {
+			// Jump targets and both branch directions start
+			// blocks.  JSR falls through to the return address.
+			if len(edges) > 1 || (e.Kind != EdgeFallthrough &&
+				e.Kind != EdgeReturn) {
+				leaders[e.To] = true
+			}
+			todo = append(todo, e.To)
+		}
+	}
+
+	s := &Subroutine{
+		Entry:  entry,
+		Name:   symbolName(g.listing, entry),
+		Blocks: make(map[uint16]*BasicBlock),
+	}
+	for start := range leaders {
+		if _, ok := code[start]; !ok {
+			continue
+		}
+		b := &BasicBlock{Start: start}
+		a := start
+		for {
+			in := code[a]
+			b.Instructions = append(b.Instructions, a)
+			if in.call {
+				b.Calls = append(b.Calls, CallSite{
+					Caller: entry,
+					Site:   a,
+					Callee: in.callee,
+				})
+			}
+			// Blocks end at control flow other than falling through
+			// or a JSR returning, and before leaders.
+			if in.exit != "" {
+				b.Exit = in.exit
+				break
+			}
+			if len(in.edges) != 1 ||
+				(in.edges[0].Kind != EdgeFallthrough &&
+					in.edges[0].Kind != EdgeReturn) ||
+				leaders[in.edges[0].To] {
+				b.Edges = in.edges
+				break
+			}
+			a = in.edges[0].To
+		}
+		s.Blocks[start] = b
+	}
+	return s
+}
+
+// sortedBlocks returns the blocks of s by address.
+func (s *Subroutine) sortedBlocks() []*BasicBlock {
+	blocks := make([]*BasicBlock, 0, len(s.Blocks))
+	for _, b := range s.Blocks {
+		blocks = append(blocks, b)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Start < blocks[j].Start
+	})
+	return blocks
+}
+
+// sortedSubroutines returns the subroutines by entry.
+func (g *CFG) sortedSubroutines() []*Subroutine {
+	subs := make([]*Subroutine, 0, len(g.Subroutines))
+	for _, s := range g.Subroutines {
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Entry < subs[j].Entry
+	})
+	return subs
+}
+
+// dotEscape escapes s for use in a quoted DOT string.
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// WriteDOT writes the control flow graphs of all subroutines in Graphviz
+// DOT format, one cluster per subroutine.
+func (g *CFG) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph cfg {\n")
+	fmt.Fprintf(bw, "\tnode [shape=box fontname=monospace];\n")
+	for _, s := range g.sortedSubroutines() {
+		fmt.Fprintf(bw, "\tsubgraph cluster_%04X {\n", s.Entry)
+		fmt.Fprintf(bw, "\t\tlabel=\"%v\";\n", dotEscape(s.Name))
+		for _, b := range s.sortedBlocks() {
+			var label strings.Builder
+			for _, a := range b.Instructions {
+				d, _ := g.cpu.disassemble(a)
+				fmt.Fprintf(&label, "%04X  %v\\l", a,
+					dotEscape(strings.ReplaceAll(d, "\t", " ")))
+			}
+			fmt.Fprintf(bw, "\t\tb%04X_%04X [label=\"%v\"];\n",
+				s.Entry, b.Start, label.String())
+		}
+		for _, b := range s.sortedBlocks() {
+			for _, e := range b.Edges {
+				if _, ok := s.Blocks[e.To]; !ok {
+					continue
+				}
+				fmt.Fprintf(bw, "\t\tb%04X_%04X -> b%04X_%04X "+
+					"[label=\"%v\"];\n", s.Entry, b.Start,
+					s.Entry, e.To, e.Kind)
+			}
+		}
+		fmt.Fprintf(bw, "\t}\n")
+	}
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
+
+// WriteCallGraphDOT writes the call graph in Graphviz DOT format.
+func (g *CFG) WriteCallGraphDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph calls {\n")
+	fmt.Fprintf(bw, "\tnode [shape=box];\n")
+	for _, s := range g.sortedSubroutines() {
+		fmt.Fprintf(bw, "\ts%04X [label=\"%v\"];\n", s.Entry,
+			dotEscape(s.Name))
+	}
+	seen := make(map[[2]uint16]bool)
+	for _, call := range g.Calls {
+		k := [2]uint16{call.Caller, call.Callee}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		fmt.Fprintf(bw, "\ts%04X -> s%04X;\n", call.Caller, call.Callee)
+	}
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
+
+// WriteJSON writes the subroutines and the call graph as JSON.
+func (g *CFG) WriteJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	return e.Encode(g)
+}
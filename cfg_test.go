@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func cfgProgram(t *testing.T) (*CPU, *Listing) {
+	bin, lst := writeTestListing(t, []string{
+		"0400 a203|start   ldx #3",
+		"0402 201004|loop    jsr sub",
+		"0405 ca|        dex",
+		"0406 d0fa|        bne loop",
+		"0408 4c0804|done    jmp done",
+		"0410 e8|sub     inx",
+		"0411 6c2004|        jmp (vector)",
+		"0420 2404|vector  .word tail",
+		"0424 60|tail    rts",
+	})
+	l, err := loadListing(lst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New()
+	if err := c.load(bin, 0); err != nil {
+		t.Fatal(err)
+	}
+	return c, l
+}
+
+func TestCFG(t *testing.T) {
+	c, l := cfgProgram(t)
+	g := BuildCFG(c, l, []uint16{0x0400})
+
+	if len(g.Subroutines) != 2 {
+		t.Fatalf("subroutines %v", len(g.Subroutines))
+	}
+	main := g.Subroutines[0x0400]
+	if main.Name != "start" {
+		t.Fatalf("name %v", main.Name)
+	}
+	want := map[uint16]*BasicBlock{
+		0x0400: {
+			Start:        0x0400,
+			Instructions: []uint16{0x0400},
+			Edges:        []Edge{{0x0402, EdgeFallthrough}},
+		},
+		0x0402: {
+			Start:        0x0402,
+			Instructions: []uint16{0x0402, 0x0405, 0x0406},
+			Edges: []Edge{
+				{0x0402, EdgeTaken},
+				{0x0408, EdgeFallthrough},
+			},
+			Calls: []CallSite{{0x0400, 0x0402, 0x0410}},
+		},
+		0x0408: {
+			Start:        0x0408,
+			Instructions: []uint16{0x0408},
+			Edges:        []Edge{{0x0408, EdgeJump}},
+		},
+	}
+	if !reflect.DeepEqual(main.Blocks, want) {
+		for a, b := range main.Blocks {
+			t.Logf("$%04X: %+v", a, *b)
+		}
+		t.Fatalf("unexpected blocks")
+	}
+
+	sub := g.Subroutines[0x0410]
+	want = map[uint16]*BasicBlock{
+		0x0410: {
+			Start:        0x0410,
+			Instructions: []uint16{0x0410, 0x0411},
+			Edges:        []Edge{{0x0424, EdgeIndirect}},
+		},
+		0x0424: {
+			Start:        0x0424,
+			Instructions: []uint16{0x0424},
+			Exit:         "rts",
+		},
+	}
+	if !reflect.DeepEqual(sub.Blocks, want) {
+		for a, b := range sub.Blocks {
+			t.Logf("$%04X: %+v", a, *b)
+		}
+		t.Fatalf("unexpected subroutine blocks")
+	}
+	if !reflect.DeepEqual(g.Calls, []CallSite{{0x0400, 0x0402, 0x0410}}) {
+		t.Fatalf("calls %v", g.Calls)
+	}
+}
+
+func TestCFGExport(t *testing.T) {
+	c, l := cfgProgram(t)
+	g := BuildCFG(c, l, []uint16{0x0400})
+
+	var b bytes.Buffer
+	if err := g.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"subgraph cluster_0400",
+		`label="start"`,
+		"b0400_0402 -> b0400_0402 [label=\"taken\"]",
+		"b0410_0410 -> b0410_0424 [label=\"indirect\"]",
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Fatalf("missing %q in\n%v", s, b.String())
+		}
+	}
+
+	b.Reset()
+	if err := g.WriteCallGraphDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "s0400 -> s0410;") {
+		t.Fatalf("missing call in\n%v", b.String())
+	}
+
+	b.Reset()
+	if err := g.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var j struct {
+		Subroutines map[string]struct {
+			Name   string
+			Blocks map[string]struct {
+				Edges []struct {
+					To   uint16
+					Kind string
+				}
+			}
+		}
+		Calls []CallSite
+	}
+	if err := json.Unmarshal(b.Bytes(), &j); err != nil {
+		t.Fatal(err)
+	}
+	if j.Subroutines["1040"].Name != "sub" ||
+		j.Subroutines["1024"].Blocks["1026"].Edges[1].Kind !=
+			"fallthrough" || len(j.Calls) != 1 {
+		t.Fatalf("unexpected json %v", b.String())
+	}
+}
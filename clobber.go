@@ -0,0 +1,783 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Registers in Resources.
+const (
+	RegisterA byte = 1 << iota
+	RegisterX
+	RegisterY
+)
+
+// statusFlags are the flags tracked in Resources.  Break and the unused bit
+// are not flags of the status register proper.
+const statusFlags = Negative | Overflow | BCD | Interrupts | Zero | Carry
+
+// Resources is a set of registers, flags and zero page locations.
+type Resources struct {
+	Registers byte      // RegisterA, RegisterX, RegisterY
+	Flags     byte      // status register bits
+	ZeroPage  [4]uint64 // bit per location
+	Indexed   bool      // indexed zero page locations, unknown statically
+}
+
+// allResources returns the set of all registers, flags and locations.
+func allResources() Resources {
+	return Resources{
+		Registers: RegisterA | RegisterX | RegisterY,
+		Flags:     statusFlags,
+		ZeroPage:  [4]uint64{^uint64(0), ^uint64(0), ^uint64(0), ^uint64(0)},
+	}
+}
+
+// AddZeroPage adds zero page location address.
+func (r *Resources) AddZeroPage(address byte) {
+	r.ZeroPage[address/64] |= 1 << (address % 64)
+}
+
+// HasZeroPage returns true if location address is in r.
+func (r Resources) HasZeroPage(address byte) bool {
+	return r.ZeroPage[address/64]&(1<<(address%64)) != 0
+}
+
+// Empty returns true if r holds nothing.
+func (r Resources) Empty() bool {
+	return r == Resources{}
+}
+
+// Union returns the resources in r or o.
+func (r Resources) Union(o Resources) Resources {
+	r.Registers |= o.Registers
+	r.Flags |= o.Flags
+	for i := range r.ZeroPage {
+		r.ZeroPage[i] |= o.ZeroPage[i]
+	}
+	r.Indexed = r.Indexed || o.Indexed
+	return r
+}
+
+// Minus returns the resources in r but not in o.  Unknown indexed locations
+// are never removed.
+func (r Resources) Minus(o Resources) Resources {
+	r.Registers &^= o.Registers
+	r.Flags &^= o.Flags
+	for i := range r.ZeroPage {
+		r.ZeroPage[i] &^= o.ZeroPage[i]
+	}
+	return r
+}
+
+// Intersect returns the resources in both r and o.
+func (r Resources) Intersect(o Resources) Resources {
+	r.Registers &= o.Registers
+	r.Flags &= o.Flags
+	for i := range r.ZeroPage {
+		r.ZeroPage[i] &= o.ZeroPage[i]
+	}
+	r.Indexed = r.Indexed && o.Indexed
+	return r
+}
+
+var (
+	registerNames = []struct {
+		bit  byte
+		name string
+	}{{RegisterA, "A"}, {RegisterX, "X"}, {RegisterY, "Y"}}
+	flagNames = []struct {
+		bit  byte
+		name string
+	}{
+		{Negative, "N"}, {Overflow, "V"}, {BCD, "D"},
+		{Interrupts, "I"}, {Zero, "Z"}, {Carry, "C"},
+	}
+)
+
+// String returns r as a comma separated list, e.g. "A,X,C,$10-$11", or
+// "none".
+func (r Resources) String() string {
+	var s []string
+	for _, n := range registerNames {
+		if r.Registers&n.bit != 0 {
+			s = append(s, n.name)
+		}
+	}
+	for _, n := range flagNames {
+		if r.Flags&n.bit != 0 {
+			s = append(s, n.name)
+		}
+	}
+	for a := 0; a < 256; a++ {
+		if !r.HasZeroPage(byte(a)) {
+			continue
+		}
+		end := a
+		for end < 255 && r.HasZeroPage(byte(end+1)) {
+			end++
+		}
+		if end == a {
+			s = append(s, fmt.Sprintf("$%02X", a))
+		} else {
+			s = append(s, fmt.Sprintf("$%02X-$%02X", a, end))
+		}
+		a = end
+	}
+	if r.Indexed {
+		s = append(s, "indexed")
+	}
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, ",")
+}
+
+// ParseResources parses the format of Resources.String.
+func ParseResources(s string) (Resources, error) {
+	var r Resources
+	if s == "" || s == "none" {
+		return r, nil
+	}
+next:
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		for _, n := range registerNames {
+			if strings.EqualFold(f, n.name) {
+				r.Registers |= n.bit
+				continue next
+			}
+		}
+		for _, n := range flagNames {
+			if strings.EqualFold(f, n.name) {
+				r.Flags |= n.bit
+				continue next
+			}
+		}
+		if f == "indexed" {
+			r.Indexed = true
+			continue
+		}
+		first, last, isRange := strings.Cut(f, "-")
+		if !isRange {
+			last = first
+		}
+		lo, err := parseAddress(first)
+		if err != nil || lo > 0xff {
+			return r, fmt.Errorf("invalid resource: %v", f)
+		}
+		hi, err := parseAddress(last)
+		if err != nil || hi > 0xff || hi < lo {
+			return r, fmt.Errorf("invalid resource: %v", f)
+		}
+		for a := lo; a <= hi; a++ {
+			r.AddZeroPage(byte(a))
+		}
+	}
+	return r, nil
+}
+
+// zeroPageOperand returns the zero page locations the operand of the
+// instruction at address accesses and the zero page pointer it reads, if
+// any.  Indexed locations are resolved with the registers and memory of c
+// when resolve is set and marked as unknown otherwise.
+func zeroPageOperand(c *CPU, address uint16, resolve bool) (Resources,
+	Resources) {
+
+	var operand, pointer Resources
+	o := opcodes[c.memory[address]]
+	b := c.memory[address+1]
+	w := uint16(b) | uint16(c.memory[address+2])<<8
+	add := func(r *Resources, a uint16) {
+		if a < 0x100 {
+			r.AddZeroPage(byte(a))
+		}
+	}
+	switch o.mode {
+	case zeroPage:
+		operand.AddZeroPage(b)
+	case zeroPageX, zeroPageY:
+		if !resolve {
+			operand.Indexed = true
+			break
+		}
+		index := c.x
+		if o.mode == zeroPageY {
+			index = c.y
+		}
+		operand.AddZeroPage(b + index)
+	case absolute:
+		add(&operand, w)
+	case absoluteX, absoluteY:
+		switch {
+		case resolve && o.mode == absoluteX:
+			add(&operand, w+uint16(c.x))
+		case resolve:
+			add(&operand, w+uint16(c.y))
+		case w < 0x100:
+			operand.Indexed = true
+		}
+	case zeroPageIndirectX:
+		if !resolve {
+			pointer.Indexed = true
+			break
+		}
+		p := b + c.x
+		pointer.AddZeroPage(p)
+		pointer.AddZeroPage(p + 1)
+		add(&operand, uint16(c.memory[p])|uint16(c.memory[p+1])<<8)
+	case zeroPageIndirectY:
+		pointer.AddZeroPage(b)
+		pointer.AddZeroPage(b + 1)
+		if resolve {
+			add(&operand, (uint16(c.memory[b])|
+				uint16(c.memory[b+1])<<8)+uint16(c.y))
+		}
+	case indirect:
+		add(&pointer, w)
+		add(&pointer, w+1)
+	}
+	return operand, pointer
+}
+
+// instructionEffects returns the registers, flags and zero page locations
+// the instruction at address reads and writes.  JSR and RTS have no effects
+// of their own.
+func instructionEffects(c *CPU, address uint16, resolve bool) (Resources,
+	Resources) {
+
+	const nz = Negative | Zero
+	var r, w Resources
+	o := opcodes[c.memory[address]]
+	mem, ptr := zeroPageOperand(c, address, resolve)
+	switch o.mnemonic {
+	case "ADC", "SBC":
+		r = mem
+		r.Registers |= RegisterA
+		r.Flags |= Carry | BCD
+		w.Registers |= RegisterA
+		w.Flags |= nz | Overflow | Carry
+	case "AND", "ORA", "EOR":
+		r = mem
+		r.Registers |= RegisterA
+		w.Registers |= RegisterA
+		w.Flags |= nz
+	case "ASL", "LSR", "ROL", "ROR":
+		if o.mode == accumulator {
+			r.Registers |= RegisterA
+			w.Registers |= RegisterA
+		} else {
+			r, w = mem, mem
+		}
+		if o.mnemonic == "ROL" || o.mnemonic == "ROR" {
+			r.Flags |= Carry
+		}
+		w.Flags |= nz | Carry
+	case "BIT":
+		r = mem
+		r.Registers |= RegisterA
+		w.Flags |= nz | Overflow
+	case "BCC", "BCS":
+		r.Flags |= Carry
+	case "BEQ", "BNE":
+		r.Flags |= Zero
+	case "BMI", "BPL":
+		r.Flags |= Negative
+	case "BVC", "BVS":
+		r.Flags |= Overflow
+	case "BRK", "CLI", "SEI":
+		w.Flags |= Interrupts
+	case "CLC", "SEC":
+		w.Flags |= Carry
+	case "CLD", "SED":
+		w.Flags |= BCD
+	case "CLV":
+		w.Flags |= Overflow
+	case "CMP", "CPX", "CPY":
+		r = mem
+		r.Registers |= register(o.mnemonic[2]) // P for CMP
+		if o.mnemonic == "CMP" {
+			r.Registers |= RegisterA
+		}
+		w.Flags |= nz | Carry
+	case "DEC", "INC":
+		r, w = mem, mem
+		w.Flags |= nz
+	case "DEX", "INX", "DEY", "INY":
+		r.Registers |= register(o.mnemonic[2])
+		w.Registers |= register(o.mnemonic[2])
+		w.Flags |= nz
+	case "LDA", "LDX", "LDY":
+		r = mem
+		w.Registers |= register(o.mnemonic[2])
+		w.Flags |= nz
+	case "STA", "STX", "STY":
+		w = mem
+		r.Registers |= register(o.mnemonic[2])
+	case "TAX", "TAY", "TXA", "TYA", "TSX":
+		r.Registers |= register(o.mnemonic[1])
+		w.Registers |= register(o.mnemonic[2])
+		w.Flags |= nz
+	case "TXS":
+		r.Registers |= RegisterX
+	case "PHA":
+		r.Registers |= RegisterA
+	case "PHP":
+		r.Flags |= statusFlags
+	case "PLA":
+		w.Registers |= RegisterA
+		w.Flags |= nz
+	case "PLP", "RTI":
+		w.Flags |= statusFlags
+	}
+	switch o.mode {
+	case zeroPageX, absoluteX, zeroPageIndirectX:
+		r.Registers |= RegisterX
+	case zeroPageY, absoluteY, zeroPageIndirectY:
+		r.Registers |= RegisterY
+	}
+	return r.Union(ptr), w
+}
+
+// register returns the register named by r, none for the stack pointer.
+func register(r byte) byte {
+	switch r {
+	case 'A':
+		return RegisterA
+	case 'X':
+		return RegisterX
+	case 'Y':
+		return RegisterY
+	}
+	return 0
+}
+
+// Effects are the inputs and clobbers of a subroutine, including the
+// subroutines it calls.
+type Effects struct {
+	Entry    uint16
+	Inputs   Resources // read before written
+	Clobbers Resources // modified
+	Calls    uint64    // calls observed, dynamic analysis only
+
+	written Resources // written on every path to a return
+}
+
+// Contract declares the inputs and clobbers of a subroutine.
+type Contract struct {
+	Entry    uint16
+	Inputs   Resources
+	Clobbers Resources
+}
+
+// difference returns the resources in a but not in b, including unknown
+// indexed locations.
+func difference(a, b Resources) Resources {
+	d := a.Minus(b)
+	d.Indexed = a.Indexed && !b.Indexed
+	return d
+}
+
+// Check returns the differences between e and contract ct.
+func (e *Effects) Check(ct Contract) []string {
+	var d []string
+	for _, c := range []struct {
+		r    Resources
+		what string
+	}{
+		{difference(e.Inputs, ct.Inputs), "reads undeclared inputs"},
+		{difference(e.Clobbers, ct.Clobbers), "clobbers undeclared"},
+		{difference(ct.Inputs, e.Inputs), "never reads declared inputs"},
+		{difference(ct.Clobbers, e.Clobbers), "never modifies declared"},
+	} {
+		if !c.r.Empty() {
+			d = append(d, fmt.Sprintf("%v %v", c.what, c.r))
+		}
+	}
+	return d
+}
+
+// effectAnalyzer statically computes the effects of the subroutines of a
+// CFG.
+type effectAnalyzer struct {
+	g      *CFG
+	done   map[uint16]*Effects
+	active map[uint16]bool
+}
+
+// AnalyzeEffects statically computes the effects of every subroutine in g.
+// Clobbers are the resources written on any path, even when a routine
+// restores them, e.g. with PHA and PLA; use an EffectMonitor to observe what
+// actually changes.
+func AnalyzeEffects(g *CFG) (map[uint16]*Effects, error) {
+	ea := &effectAnalyzer{
+		g:      g,
+		done:   make(map[uint16]*Effects),
+		active: make(map[uint16]bool),
+	}
+	for _, s := range g.sortedSubroutines() {
+		if _, err := ea.subroutine(s.Entry); err != nil {
+			return nil, err
+		}
+	}
+	return ea.done, nil
+}
+
+// blockEffects are the effects of a basic block.
+type blockEffects struct {
+	use   Resources // read before written in the block
+	kill  Resources // written on every path through the block
+	may   Resources // written
+	in    Resources // live on entry
+	must  Resources // written on every path to the end of the block
+	preds []uint16
+}
+
+func (ea *effectAnalyzer) subroutine(entry uint16) (*Effects, error) {
+	if e, ok := ea.done[entry]; ok {
+		return e, nil
+	}
+	if ea.active[entry] {
+		return nil, fmt.Errorf("recursive call to $%04X", entry)
+	}
+	s, ok := ea.g.Subroutines[entry]
+	if !ok {
+		return nil, fmt.Errorf("no subroutine at $%04X", entry)
+	}
+	ea.active[entry] = true
+	defer delete(ea.active, entry)
+
+	c := ea.g.cpu
+	blocks := s.sortedBlocks()
+	be := make(map[uint16]*blockEffects, len(blocks))
+	for _, b := range blocks {
+		if b.Exit == "invalid" {
+			return nil, fmt.Errorf("invalid opcode $%02X at $%04X",
+				c.memory[b.Last()], b.Last())
+		}
+		calls := make(map[uint16]uint16)
+		for _, call := range b.Calls {
+			calls[call.Site] = call.Callee
+		}
+		x := &blockEffects{}
+		for _, a := range b.Instructions {
+			var r, w, k Resources
+			if callee, ok := calls[a]; ok {
+				ce, err := ea.subroutine(callee)
+				if err != nil {
+					return nil, err
+				}
+				r, w, k = ce.Inputs, ce.Clobbers, ce.written
+			} else {
+				r, w = instructionEffects(c, a, false)
+				k = w
+			}
+			x.use = x.use.Union(r.Minus(x.kill))
+			x.kill = x.kill.Union(k)
+			x.may = x.may.Union(w)
+		}
+		be[b.Start] = x
+	}
+	for _, b := range blocks {
+		for _, e := range b.Edges {
+			if x, ok := be[e.To]; ok {
+				x.preds = append(x.preds, b.Start)
+			}
+		}
+	}
+
+	// Inputs are live on entry and clobbers are written anywhere.
+	e := &Effects{Entry: entry}
+	for changed := true; changed; {
+		changed = false
+		for i := len(blocks) - 1; i >= 0; i-- {
+			b := blocks[i]
+			x := be[b.Start]
+			var out Resources
+			for _, edge := range b.Edges {
+				if y, ok := be[edge.To]; ok {
+					out = out.Union(y.in)
+				}
+			}
+			in := x.use.Union(out.Minus(x.kill))
+			if in != x.in {
+				x.in = in
+				changed = true
+			}
+		}
+	}
+	e.Inputs = be[entry].in
+	for _, x := range be {
+		e.Clobbers = e.Clobbers.Union(x.may)
+	}
+
+	// Resources written on every path to RTS are killed at the call site.
+	for _, x := range be {
+		x.must = allResources()
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range blocks {
+			x := be[b.Start]
+			in := allResources()
+			if b.Start == entry {
+				in = Resources{}
+			}
+			for _, p := range x.preds {
+				in = in.Intersect(be[p].must)
+			}
+			must := in.Union(x.kill)
+			if must != x.must {
+				x.must = must
+				changed = true
+			}
+		}
+	}
+	e.written = allResources()
+	returns := false
+	for _, b := range blocks {
+		if b.Exit == "rts" {
+			e.written = e.written.Intersect(be[b.Start].must)
+			returns = true
+		}
+	}
+	if !returns {
+		e.written = Resources{}
+	}
+	ea.done[entry] = e
+	return e, nil
+}
+
+// effectFrame is a subroutine call observed by an EffectMonitor.
+type effectFrame struct {
+	entry     uint16
+	interrupt bool // interrupt or BRK, not tracked
+	sp        byte
+	a, x, y   byte
+	sr        byte
+	zeroPage  [256]byte
+	inputs    Resources
+	written   Resources
+}
+
+// EffectMonitor is an Observer that records the inputs and clobbers of
+// subroutines as they run.  Clobbers are resources that were written and
+// held a different value on return.
+type EffectMonitor struct {
+	effects map[uint16]*Effects
+	frames  []*effectFrame
+
+	opcode byte
+}
+
+// NewEffectMonitor returns a monitor that has observed nothing.
+func NewEffectMonitor() *EffectMonitor {
+	return &EffectMonitor{effects: make(map[uint16]*Effects)}
+}
+
+// Interrupt starts an untracked frame for the handler.
+func (m *EffectMonitor) Interrupt(c *CPU, vector uint16) {
+	m.frames = append(m.frames, &effectFrame{interrupt: true, sp: c.sp})
+}
+
+// Before records the effects of the instruction that is about to execute
+// on the innermost subroutine.
+func (m *EffectMonitor) Before(c *CPU) {
+	m.opcode = c.memory[c.pc]
+	if len(m.frames) == 0 {
+		return
+	}
+	f := m.frames[len(m.frames)-1]
+	if f.interrupt {
+		return
+	}
+	r, w := instructionEffects(c, c.pc, true)
+	f.inputs = f.inputs.Union(r.Minus(f.written))
+	f.written = f.written.Union(w)
+}
+
+// After starts and ends frames.
+func (m *EffectMonitor) After(c *CPU) {
+	switch m.opcode {
+	case 0x20: // JSR
+		f := &effectFrame{
+			entry: c.pc,
+			sp:    c.sp + 2,
+			a:     c.a,
+			x:     c.x,
+			y:     c.y,
+			sr:    c.sr,
+		}
+		copy(f.zeroPage[:], c.memory[:256])
+		m.frames = append(m.frames, f)
+	case 0x00: // BRK
+		m.frames = append(m.frames, &effectFrame{interrupt: true,
+			sp: c.sp + 3})
+	case 0x60, 0x40: // RTS, RTI
+		if len(m.frames) == 0 {
+			return
+		}
+		f := m.frames[len(m.frames)-1]
+		m.frames = m.frames[:len(m.frames)-1]
+		if !f.interrupt {
+			m.ret(c, f)
+		}
+	}
+}
+
+// ret ends frame f.
+func (m *EffectMonitor) ret(c *CPU, f *effectFrame) {
+	var changed Resources
+	for _, r := range []struct {
+		bit      byte
+		old, new byte
+	}{
+		{RegisterA, f.a, c.a},
+		{RegisterX, f.x, c.x},
+		{RegisterY, f.y, c.y},
+	} {
+		if f.written.Registers&r.bit != 0 && r.old != r.new {
+			changed.Registers |= r.bit
+		}
+	}
+	changed.Flags = (f.sr ^ c.sr) & f.written.Flags
+	for a := 0; a < 256; a++ {
+		if f.written.HasZeroPage(byte(a)) &&
+			f.zeroPage[a] != c.memory[a] {
+			changed.AddZeroPage(byte(a))
+		}
+	}
+
+	e, ok := m.effects[f.entry]
+	if !ok {
+		e = &Effects{Entry: f.entry}
+		m.effects[f.entry] = e
+	}
+	e.Inputs = e.Inputs.Union(f.inputs)
+	e.Clobbers = e.Clobbers.Union(changed)
+	e.Calls++
+
+	if len(m.frames) > 0 && !m.frames[len(m.frames)-1].interrupt {
+		p := m.frames[len(m.frames)-1]
+		p.inputs = p.inputs.Union(f.inputs.Minus(p.written))
+		p.written = p.written.Union(f.written)
+	}
+}
+
+// Effects returns the effects observed for the subroutine at entry.
+func (m *EffectMonitor) Effects(entry uint16) (*Effects, bool) {
+	e, ok := m.effects[entry]
+	return e, ok
+}
+
+// All returns the effects of all subroutines that returned, by entry.
+func (m *EffectMonitor) All() map[uint16]*Effects {
+	return m.effects
+}
+
+// Reset forgets all frames and effects.
+func (m *EffectMonitor) Reset() {
+	m.frames = nil
+	m.effects = make(map[uint16]*Effects)
+}
+
+// Restored forgets the subroutines that were running; the effects of those
+// that returned are kept.
+func (m *EffectMonitor) Restored(c *CPU) {
+	m.frames = nil
+}
+
+// WriteEffects writes effects by entry, named from listing l if not nil,
+// followed by the differences from contracts.  It returns the number of
+// contracts that were violated.
+func WriteEffects(w io.Writer, effects map[uint16]*Effects, l *Listing,
+	contracts []Contract) (int, error) {
+
+	bw := bufio.NewWriter(w)
+	entries := make([]uint16, 0, len(effects))
+	for a := range effects {
+		entries = append(entries, a)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i] < entries[j]
+	})
+	for _, a := range entries {
+		e := effects[a]
+		fmt.Fprintf(bw, "%v: inputs %v clobbers %v", timingName(l, a),
+			e.Inputs, e.Clobbers)
+		if e.Calls > 0 {
+			fmt.Fprintf(bw, " (%v calls)", e.Calls)
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+
+	violated := 0
+	for _, ct := range contracts {
+		e, ok := effects[ct.Entry]
+		if !ok {
+			fmt.Fprintf(bw, "%v: not analyzed\n",
+				timingName(l, ct.Entry))
+			continue
+		}
+		d := e.Check(ct)
+		if len(d) == 0 {
+			continue
+		}
+		violated++
+		for _, s := range d {
+			fmt.Fprintf(bw, "%v: %v\n", timingName(l, ct.Entry), s)
+		}
+	}
+	return violated, bw.Flush()
+}
+
+// parseContracts reads contracts, one per line:
+//
+//	entry inputs=A,X clobbers=A,C,Z,N,$10-$11
+//
+// Entries are addresses or labels of listing l.  Lines starting with # are
+// comments.
+func parseContracts(r io.Reader, l *Listing) ([]Contract, error) {
+	var contracts []Contract
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var ct Contract
+		a, err := parseAddress(fields[0])
+		if err != nil {
+			var ok bool
+			if l != nil {
+				a, ok = l.Label(fields[0])
+			}
+			if !ok {
+				return nil, fmt.Errorf("line %v: unknown "+
+					"subroutine: %v", n, fields[0])
+			}
+		}
+		ct.Entry = a
+		for _, f := range fields[1:] {
+			k, v, _ := strings.Cut(f, "=")
+			r, err := ParseResources(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", n, err)
+			}
+			switch k {
+			case "inputs":
+				ct.Inputs = r
+			case "clobbers":
+				ct.Clobbers = r
+			default:
+				return nil, fmt.Errorf("line %v: invalid "+
+					"field: %v", n, f)
+			}
+		}
+		contracts = append(contracts, ct)
+	}
+	return contracts, s.Err()
+}
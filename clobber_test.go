@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResources(t *testing.T) {
+	var r Resources
+	r.Registers = RegisterA | RegisterY
+	r.Flags = Carry | Negative
+	r.AddZeroPage(0x10)
+	r.AddZeroPage(0x11)
+	r.AddZeroPage(0x80)
+	r.Indexed = true
+	s := r.String()
+	if s != "A,Y,N,C,$10-$11,$80,indexed" {
+		t.Fatalf("got %v", s)
+	}
+	p, err := ParseResources(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != r {
+		t.Fatalf("got %v", p)
+	}
+	if (Resources{}).String() != "none" {
+		t.Fatalf("empty %v", Resources{})
+	}
+	for _, s := range []string{"Q", "$100", "$11-$10"} {
+		if _, err := ParseResources(s); err == nil {
+			t.Fatalf("%v: expected error", s)
+		}
+	}
+}
+
+func clobberProgram(t *testing.T) (*CPU, *Listing) {
+	bin, lst := writeTestListing(t, []string{
+		"0400 a905|start   lda #5",
+		"0402 201004|        jsr sub",
+		"0405 4c0504|done    jmp done",
+		"0410 48|sub     pha",
+		"0411 a510|        lda $10",
+		"0413 6511|        adc $11",
+		"0415 8512|        sta $12",
+		"0417 68|        pla",
+		"0418 e8|        inx",
+		"0419 60|        rts",
+	})
+	l, err := loadListing(lst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New()
+	if err := c.load(bin, 0); err != nil {
+		t.Fatal(err)
+	}
+	return c, l
+}
+
+func mustResources(t *testing.T, s string) Resources {
+	r, err := ParseResources(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestAnalyzeEffects(t *testing.T) {
+	c, l := clobberProgram(t)
+	effects, err := AnalyzeEffects(BuildCFG(c, l, []uint16{0x0400}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		entry            uint16
+		inputs, clobbers string
+	}{
+		{0x0410, "A,X,D,C,$10-$11", "A,X,N,V,Z,C,$12"},
+		{0x0400, "X,D,C,$10-$11", "A,X,N,V,Z,C,$12"},
+	}
+	for _, test := range tests {
+		e := effects[test.entry]
+		if e.Inputs != mustResources(t, test.inputs) ||
+			e.Clobbers != mustResources(t, test.clobbers) {
+			t.Fatalf("$%04X: inputs %v clobbers %v", test.entry,
+				e.Inputs, e.Clobbers)
+		}
+	}
+
+	ct := Contract{
+		Entry:    0x0410,
+		Inputs:   mustResources(t, "A,X,C,D,$10-$11"),
+		Clobbers: mustResources(t, "X,$12,$13"),
+	}
+	d := effects[0x0410].Check(ct)
+	want := []string{
+		"clobbers undeclared A,N,V,Z,C",
+		"never modifies declared $13",
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Fatalf("got %q", d)
+	}
+}
+
+func TestEffectsIndexed(t *testing.T) {
+	c := New()
+	copy(c.memory[0x0400:], []byte{
+		0xb5, 0x10, // lda $10,x
+		0x91, 0x20, // sta ($20),y
+	})
+	r, w := instructionEffects(c, 0x0400, false)
+	if r != mustResources(t, "X,indexed") || w != mustResources(t, "A,N,Z") {
+		t.Fatalf("lda static: %v %v", r, w)
+	}
+	c.x = 3
+	r, _ = instructionEffects(c, 0x0400, true)
+	if r != mustResources(t, "X,$13") {
+		t.Fatalf("lda resolved: %v", r)
+	}
+	c.memory[0x20] = 0x40
+	c.y = 2
+	r, w = instructionEffects(c, 0x0402, true)
+	if r != mustResources(t, "A,Y,$20-$21") || w != mustResources(t, "$42") {
+		t.Fatalf("sta resolved: %v %v", r, w)
+	}
+}
+
+func TestEffectMonitor(t *testing.T) {
+	c, l := clobberProgram(t)
+	c.memory[0x10] = 1
+	c.memory[0x11] = 2
+	c.pc = 0x0400
+	c.sp = 0xfd
+	m := NewEffectMonitor()
+	c.Attach(m)
+	for i := 0; i < 100; i++ {
+		c.executeInstruction()
+	}
+
+	e, ok := m.Effects(0x0410)
+	if !ok {
+		t.Fatalf("sub not observed")
+	}
+	if e.Calls != 1 || e.Inputs != mustResources(t, "A,X,D,C,$10-$11") ||
+		e.Clobbers != mustResources(t, "X,$12") {
+		t.Fatalf("calls %v inputs %v clobbers %v", e.Calls, e.Inputs,
+			e.Clobbers)
+	}
+
+	contracts, err := parseContracts(strings.NewReader(
+		"# comment\nsub inputs=A,X,C,D,$10-$11 clobbers=X,$12\n"), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	n, err := WriteEffects(&b, m.All(), l, contracts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || !strings.Contains(b.String(),
+		"$0410 sub: inputs A,X,D,C,$10-$11 clobbers X,$12 (1 calls)") {
+		t.Fatalf("%v violations\n%v", n, b.String())
+	}
+
+	if _, err := parseContracts(strings.NewReader("nosuch inputs=A\n"),
+		l); err == nil {
+		t.Fatalf("expected unknown subroutine")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// Coverage is an Observer that records which instructions executed and which
+// directions conditional branches took.
+type Coverage struct {
+	count    []uint64 // executions by address
+	taken    []uint64 // taken branches by address
+	notTaken []uint64 // branches that fell through by address
+}
+
+// NewCoverage returns empty coverage.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		count:    make([]uint64, 65536),
+		taken:    make([]uint64, 65536),
+		notTaken: make([]uint64, 65536),
+	}
+}
+
+// branchTaken returns whether the conditional branch opcode is taken with
+// status register sr.  It returns false in ok if opcode is not a branch.
+func branchTaken(opcode, sr byte) (taken bool, ok bool) {
+	var flag byte
+	switch opcode & 0xc0 {
+	case 0x00:
+		flag = Negative
+	case 0x40:
+		flag = Overflow
+	case 0x80:
+		flag = Carry
+	case 0xc0:
+		flag = Zero
+	}
+	if opcode&0x1f != 0x10 {
+		return false, false
+	}
+	set := opcode&0x20 != 0 // BMI, BVS, BCS, BEQ
+	return (sr&flag != 0) == set, true
+}
+
+// Before records the instruction that is about to execute.  Branch
+// directions are taken from the flags so that a branch to the next
+// instruction still counts as taken.
+func (cv *Coverage) Before(c *CPU) {
+	cv.count[c.pc]++
+	if taken, ok := branchTaken(c.memory[c.pc], c.sr); ok {
+		if taken {
+			cv.taken[c.pc]++
+		} else {
+			cv.notTaken[c.pc]++
+		}
+	}
+}
+
+// After is a no-op.
+func (cv *Coverage) After(c *CPU) {}
+
+// Count returns the number of times the instruction at address executed.
+func (cv *Coverage) Count(address uint16) uint64 {
+	return cv.count[address]
+}
+
+// Branches returns how often the branch at address was taken and not taken.
+func (cv *Coverage) Branches(address uint16) (uint64, uint64) {
+	return cv.taken[address], cv.notTaken[address]
+}
+
+// CoverageSummary counts listing lines and branch directions.
+type CoverageSummary struct {
+	Lines        int // instruction lines
+	LinesHit     int
+	Branches     int // branch directions, two per branch
+	BranchesHit  int
+	Instructions int // distinct addresses executed
+}
+
+// Summary returns the coverage of the instructions in listing l.
+func (cv *Coverage) Summary(l *Listing) CoverageSummary {
+	var s CoverageSummary
+	for _, n := range cv.count {
+		if n > 0 {
+			s.Instructions++
+		}
+	}
+	for _, ll := range l.lines {
+		if !ll.instruction() {
+			continue
+		}
+		s.Lines++
+		if cv.count[ll.address] > 0 {
+			s.LinesHit++
+		}
+		if _, ok := branchTaken(ll.first, 0); ok {
+			s.Branches += 2
+			if cv.taken[ll.address] > 0 {
+				s.BranchesHit++
+			}
+			if cv.notTaken[ll.address] > 0 {
+				s.BranchesHit++
+			}
+		}
+	}
+	return s
+}
+
+// lcovLine is the coverage of a source line: the most executions of its
+// instructions and the executions of its branches with the times they were
+// taken and not taken.
+type lcovLine struct {
+	count    uint64
+	branches [][3]uint64
+}
+
+// WriteLcov writes the coverage of the instructions in listing l in lcov
+// tracefile format, one record per source file.  Instructions are counted on
+// the source line of their statement, so the code of a macro expansion
+// counts on the line that invoked the macro.  Instructions without a source
+// line count on the line of the listing itself.
+func (cv *Coverage) WriteLcov(w io.Writer, l *Listing, test string) error {
+	var files []string
+	lines := make(map[string]map[int]*lcovLine)
+	for i, ll := range l.lines {
+		if !ll.instruction() {
+			continue
+		}
+		file, line, ok := l.Source(ll.address)
+		if ok {
+			file = filepath.Join(filepath.Dir(l.Path), file)
+		} else {
+			file, line = l.Path, i+1
+		}
+		if lines[file] == nil {
+			files = append(files, file)
+			lines[file] = make(map[int]*lcovLine)
+		}
+		sl := lines[file][line]
+		if sl == nil {
+			sl = &lcovLine{}
+			lines[file][line] = sl
+		}
+		n := cv.count[ll.address]
+		if n > sl.count {
+			sl.count = n
+		}
+		if _, ok := branchTaken(ll.first, 0); ok {
+			sl.branches = append(sl.branches, [3]uint64{n,
+				cv.taken[ll.address], cv.notTaken[ll.address]})
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, file := range files {
+		fmt.Fprintf(bw, "TN:%v\n", test)
+		fmt.Fprintf(bw, "SF:%v\n", file)
+		numbers := make([]int, 0, len(lines[file]))
+		for line := range lines[file] {
+			numbers = append(numbers, line)
+		}
+		sort.Ints(numbers)
+
+		var (
+			found, hit     int
+			brFound, brHit int
+		)
+		for _, line := range numbers {
+			sl := lines[file][line]
+			found++
+			if sl.count > 0 {
+				hit++
+			}
+			for block, br := range sl.branches {
+				brFound += 2
+				for b, v := range br[1:] {
+					// lcov uses - for branches that were
+					// never reached
+					taken := "-"
+					if br[0] > 0 {
+						taken = fmt.Sprint(v)
+					}
+					fmt.Fprintf(bw, "BRDA:%v,%v,%v,%v\n",
+						line, block, b, taken)
+					if v > 0 {
+						brHit++
+					}
+				}
+			}
+			fmt.Fprintf(bw, "DA:%v,%v\n", line, sl.count)
+		}
+		fmt.Fprintf(bw, "BRF:%v\nBRH:%v\n", brFound, brHit)
+		fmt.Fprintf(bw, "LF:%v\nLH:%v\n", found, hit)
+		fmt.Fprintf(bw, "end_of_record\n")
+	}
+	return bw.Flush()
+}
+
+// WriteAnnotated writes listing l with execution counts.  Instructions that
+// never executed are marked with #####, branches that only went one way with
+// "taken" or "not taken".
+func (cv *Coverage) WriteAnnotated(w io.Writer, l *Listing) error {
+	bw := bufio.NewWriter(w)
+	for _, ll := range l.lines {
+		if !ll.instruction() {
+			fmt.Fprintf(bw, "%10s %-10s  %v\n", "", "", ll.text)
+			continue
+		}
+		n := cv.count[ll.address]
+		count := "#####"
+		if n > 0 {
+			count = fmt.Sprint(n)
+		}
+		branch := ""
+		if _, ok := branchTaken(ll.first, 0); ok && n > 0 {
+			switch {
+			case cv.taken[ll.address] == 0:
+				branch = "not taken"
+			case cv.notTaken[ll.address] == 0:
+				branch = "taken"
+			}
+		}
+		fmt.Fprintf(bw, "%10s %-10s  %04X  %v\n", count, branch,
+			ll.address, ll.text)
+	}
+	return bw.Flush()
+}
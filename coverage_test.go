@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBranchTaken(t *testing.T) {
+	tests := []struct {
+		opcode byte
+		sr     byte
+		taken  bool
+	}{
+		{0x10, 0, true},         // bpl
+		{0x30, Negative, true},  // bmi
+		{0x50, Overflow, false}, // bvc
+		{0x70, Overflow, true},  // bvs
+		{0x90, Carry, false},    // bcc
+		{0xb0, Carry, true},     // bcs
+		{0xd0, 0, true},         // bne
+		{0xf0, 0, false},        // beq
+	}
+	for _, test := range tests {
+		taken, ok := branchTaken(test.opcode, test.sr)
+		if !ok || taken != test.taken {
+			t.Fatalf("$%02x: taken %v ok %v", test.opcode, taken, ok)
+		}
+	}
+	if _, ok := branchTaken(0x20, 0); ok {
+		t.Fatalf("jsr is not a branch")
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	bin, lst := writeTestListing(t, []string{
+		"0400 a203|start   ldx #3",
+		"0402 ca|loop    dex",
+		"0403 d0fd|        bne loop",
+		"0405 f003|        beq done",
+		"0407 4c0704|never   jmp never",
+		"040a 4c0a04|done    jmp done",
+		"040d 0102|data    db 1,2",
+	})
+	c := New()
+	if err := c.load(bin, 0); err != nil {
+		t.Fatal(err)
+	}
+	c.pc = 0x0400
+	l, err := loadListing(lst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cv := NewCoverage()
+	c.Attach(cv)
+	for i := 0; i < 9; i++ {
+		c.executeInstruction()
+	}
+
+	if cv.Count(0x0402) != 3 {
+		t.Fatalf("unexpected dex count %v", cv.Count(0x0402))
+	}
+	if taken, notTaken := cv.Branches(0x0403); taken != 2 ||
+		notTaken != 1 {
+		t.Fatalf("unexpected bne %v %v", taken, notTaken)
+	}
+
+	s := cv.Summary(l)
+	expected := CoverageSummary{
+		Lines:        6,
+		LinesHit:     5,
+		Branches:     4,
+		BranchesHit:  3,
+		Instructions: 5,
+	}
+	if s != expected {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+
+	var b bytes.Buffer
+	if err := cv.WriteLcov(&b, l, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"SF:" + lst, "DA:2,3", "DA:5,0",
+		"BRDA:3,0,0,2", "BRDA:3,0,1,1", "BRDA:4,0,1,0", "LF:6",
+		"LH:5", "BRF:4", "BRH:3", "end_of_record"} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Fatalf("%v missing from:\n%v", line, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "DA:7,") {
+		t.Fatalf("data line covered:\n%v", b.String())
+	}
+
+	b.Reset()
+	if err := cv.WriteAnnotated(&b, l); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(b.String(), "\n")
+	if !strings.HasPrefix(strings.TrimSpace(lines[4]), "#####") ||
+		!strings.Contains(lines[3], "taken") {
+		t.Fatalf("unexpected annotation:\n%v", b.String())
+	}
+}
+
+func TestCoverageLcovSources(t *testing.T) {
+	bin, lst := writeTestListing(t, []string{
+		"---------------- test.a65 ----------------",
+		"",
+		"|; test.a65 line 1",
+		"0400 a203|start   ldx #3",
+		"|        dec2",
+		"0402 ca|>        dex",
+		"0403 ca|>        dex",
+		"|",
+		"0404 f0fa|        beq start",
+		"0406 4c0604|done    jmp done",
+	})
+	c := New()
+	if err := c.load(bin, 0); err != nil {
+		t.Fatal(err)
+	}
+	c.pc = 0x0400
+	l, err := loadListing(lst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cv := NewCoverage()
+	c.Attach(cv)
+	for i := 0; i < 6; i++ {
+		c.executeInstruction()
+	}
+
+	var b bytes.Buffer
+	if err := cv.WriteLcov(&b, l, "test"); err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(filepath.Dir(lst), "test.a65")
+	want := "TN:test\nSF:" + source + "\n" +
+		"DA:2,1\nDA:3,1\nBRDA:4,0,0,0\nBRDA:4,0,1,1\nDA:4,1\nDA:5,2\n" +
+		"BRF:2\nBRH:1\nLF:4\nLH:4\nend_of_record\n"
+	if b.String() != want {
+		t.Fatalf("expected:\n%vgot:\n%v", want, b.String())
+	}
+}
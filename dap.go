@@ -0,0 +1,1014 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Debug Adapter Protocol server.  See
+// https://microsoft.github.io/debug-adapter-protocol/specification
+
+const (
+	dapThreadID = 1
+
+	// variable references
+	dapRegisters = 1
+	dapFlags     = 2
+	dapMemory    = 3
+	dapPage      = 0x100 // dapPage + page number
+
+	dapBatch = 4096 // instructions executed per lock
+
+	// rewind history of about a million instructions
+	dapRewindInterval  = 65536
+	dapRewindKeyframes = 16
+
+	dapWriteDepth = 8 // writes remembered per address
+)
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapBreakpoint struct {
+	ID       int        `json:"id,omitempty"`
+	Verified bool       `json:"verified"`
+	Line     int        `json:"line,omitempty"`
+	Message  string     `json:"message,omitempty"`
+	Source   *dapSource `json:"source,omitempty"`
+}
+
+type dapStackFrame struct {
+	ID                          int        `json:"id"`
+	Name                        string     `json:"name"`
+	Source                      *dapSource `json:"source,omitempty"`
+	Line                        int        `json:"line"`
+	Column                      int        `json:"column"`
+	InstructionPointerReference string     `json:"instructionPointerReference,omitempty"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+type dapLaunchArguments struct {
+	Program     string  `json:"program"`
+	Listing     string  `json:"listing"`
+	Symbols     string  `json:"symbols"`
+	LoadAddress uint16  `json:"loadAddress"`
+	Start       *uint16 `json:"start"`
+	StopOnEntry bool    `json:"stopOnEntry"`
+}
+
+// dapStep is the way execution resumes.
+type dapStep int
+
+const (
+	dapContinue dapStep = iota
+	dapStepIn
+	dapNext
+	dapStepOut
+)
+
+type dapServer struct {
+	r *bufio.Reader
+
+	wmtx sync.Mutex // protects w and seq
+	w    io.Writer
+	seq  int
+
+	pause atomic.Bool
+
+	mtx         sync.Mutex // protects everything below
+	cpu         *CPU
+	listing     *Listing
+	symbols     *Symbols
+	rewind      *Rewinder
+	writes      *WriteTracker
+	launched    bool
+	stopOnEntry bool
+	running     bool
+	requested   map[string][]int    // breakpoint lines by source path
+	functions   []string            // breakpoint symbols
+	breakpoints map[uint16]struct{} // breakpoints by address
+	calls       *CallStack
+	done        chan struct{} // closed when the run goroutine exits
+}
+
+func newDAPServer(r io.Reader, w io.Writer) *dapServer {
+	return &dapServer{
+		r:           bufio.NewReader(r),
+		w:           w,
+		requested:   make(map[string][]int),
+		breakpoints: make(map[uint16]struct{}),
+	}
+}
+
+// readDAPMessage reads a single Content-Length framed message.
+func readDAPMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header: %q", line)
+		}
+		if strings.EqualFold(strings.TrimSpace(k), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("invalid content length: %v",
+					err)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("missing content length")
+	}
+
+	b := make([]byte, length)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// writeDAPMessage writes a single Content-Length framed message.
+func writeDAPMessage(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(b), b)
+	return err
+}
+
+func (s *dapServer) send(v interface{}) {
+	s.wmtx.Lock()
+	defer s.wmtx.Unlock()
+
+	s.seq++
+	switch m := v.(type) {
+	case *dapResponse:
+		m.Seq = s.seq
+	case *dapEvent:
+		m.Seq = s.seq
+	}
+	// A failed write shows up as a read error on the next request.
+	_ = writeDAPMessage(s.w, v)
+}
+
+func (s *dapServer) event(event string, body interface{}) {
+	s.send(&dapEvent{Type: "event", Event: event, Body: body})
+}
+
+func (s *dapServer) respond(req *dapRequest, body interface{}, err error) {
+	r := dapResponse{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    err == nil,
+		Command:    req.Command,
+		Body:       body,
+	}
+	if err != nil {
+		r.Message = err.Error()
+	}
+	s.send(&r)
+}
+
+// serve handles requests until the client disconnects.
+func (s *dapServer) serve() error {
+	defer s.halt()
+
+	for {
+		b, err := readDAPMessage(s.r)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var req dapRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			return fmt.Errorf("invalid message: %v", err)
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if !s.handle(&req) {
+			return nil
+		}
+	}
+}
+
+// handle dispatches a request and returns false when the session is over.
+func (s *dapServer) handle(req *dapRequest) bool {
+	var (
+		body interface{}
+		err  error
+	)
+	switch req.Command {
+	case "initialize":
+		s.respond(req, map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsReadMemoryRequest":        true,
+			"supportsStepBack":                 true,
+			"supportsSteppingGranularity":      true,
+			"supportsTerminateRequest":         true,
+		}, nil)
+		s.event("initialized", nil)
+		return true
+	case "launch":
+		err = s.launch(req.Arguments)
+	case "setBreakpoints":
+		body, err = s.setBreakpoints(req.Arguments)
+	case "setFunctionBreakpoints":
+		body, err = s.setFunctionBreakpoints(req.Arguments)
+	case "configurationDone":
+		s.respond(req, nil, nil)
+		s.configurationDone()
+		return true
+	case "threads":
+		body = map[string]interface{}{
+			"threads": []map[string]interface{}{
+				{"id": dapThreadID, "name": "6502"},
+			},
+		}
+	case "stackTrace":
+		body = s.stackTrace()
+	case "scopes":
+		body = s.scopes()
+	case "variables":
+		body, err = s.variables(req.Arguments)
+	case "readMemory":
+		body, err = s.readMemory(req.Arguments)
+	case "evaluate":
+		body, err = s.evaluate(req.Arguments)
+	case "continue":
+		err = s.resume(dapContinue, false)
+		if err == nil {
+			body = map[string]interface{}{
+				"allThreadsContinued": true,
+			}
+		}
+	case "next":
+		err = s.resume(dapNext, s.byLine(req.Arguments))
+	case "stepIn":
+		err = s.resume(dapStepIn, s.byLine(req.Arguments))
+	case "stepOut":
+		err = s.resume(dapStepOut, false)
+	case "stepBack", "reverseContinue", "backCycles":
+		var reason, text string
+		reason, text, err = s.reverse(req.Command, req.Arguments)
+		s.respond(req, nil, err)
+		if err == nil {
+			s.stopped(reason, text)
+		}
+		return true
+	case "pause":
+		s.pause.Store(true)
+	case "terminate":
+		s.halt()
+		s.respond(req, nil, nil)
+		s.event("terminated", nil)
+		return true
+	case "disconnect":
+		s.halt()
+		s.respond(req, nil, nil)
+		return false
+	default:
+		err = fmt.Errorf("unsupported command: %v", req.Command)
+	}
+	s.respond(req, body, err)
+	return true
+}
+
+func (s *dapServer) launch(args json.RawMessage) error {
+	var a dapLaunchArguments
+	if err := json.Unmarshal(args, &a); err != nil {
+		return err
+	}
+	if a.Program == "" {
+		return fmt.Errorf("no program specified")
+	}
+
+	c := New()
+	if err := c.load(a.Program, a.LoadAddress); err != nil {
+		return err
+	}
+	if a.Start != nil {
+		c.pc = *a.Start
+	} else {
+		c.pc = c.resetVector()
+	}
+
+	var (
+		l   *Listing
+		err error
+	)
+	symbols := NewSymbols()
+	if a.Listing != "" {
+		l, err = loadListing(a.Listing)
+		if err != nil {
+			return err
+		}
+		symbols.Merge(l.Symbols())
+	}
+	if a.Symbols != "" {
+		st, err := LoadSymbols(a.Symbols)
+		if err != nil {
+			return err
+		}
+		symbols.Merge(st)
+	}
+	c.SetSymbols(symbols)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.running {
+		return fmt.Errorf("already running")
+	}
+	s.cpu = c
+	s.listing = l
+	s.symbols = symbols
+	s.rewind = NewRewinder(dapRewindInterval, dapRewindKeyframes)
+	c.Attach(s.rewind)
+	s.writes = NewWriteTracker(dapWriteDepth)
+	s.writes.Undo = dapRewindInterval * dapRewindKeyframes
+	c.Attach(s.writes)
+	s.launched = true
+	s.stopOnEntry = a.StopOnEntry
+	s.calls = NewCallStack()
+	s.calls.Listing = l
+	s.calls.Undo = dapRewindInterval * dapRewindKeyframes
+	c.Attach(s.calls)
+	s.resolveBreakpoints()
+
+	return nil
+}
+
+// sameFile returns true if both paths refer to the same file.
+func sameFile(a, b string) bool {
+	if a == b {
+		return true
+	}
+	aa, err1 := filepath.Abs(a)
+	bb, err2 := filepath.Abs(b)
+	return err1 == nil && err2 == nil && aa == bb
+}
+
+// resolveBreakpoints maps the requested breakpoint lines and functions to
+// addresses.  It returns the line breakpoints by source path and the
+// function breakpoints.  It must be called with the mutex held.
+func (s *dapServer) resolveBreakpoints() (map[string][]dapBreakpoint,
+	[]dapBreakpoint) {
+
+	sources := make(map[string][]dapBreakpoint)
+	s.breakpoints = make(map[uint16]struct{})
+	for path, lines := range s.requested {
+		var bps []dapBreakpoint
+		for _, line := range lines {
+			bp := dapBreakpoint{Line: line}
+			if s.listing == nil {
+				bp.Message = "no listing loaded"
+				bps = append(bps, bp)
+				continue
+			}
+			a, l, err := s.listing.Location(path, line)
+			switch {
+			case err != nil:
+				bp.Message = err.Error()
+			case sameFile(path, s.listing.Path):
+				bp.Line = l
+			default:
+				// the source line of the code
+				_, bp.Line, _ = s.listing.Source(a)
+			}
+			if err == nil {
+				s.breakpoints[a] = struct{}{}
+				bp.Verified = true
+			}
+			bps = append(bps, bp)
+		}
+		sources[path] = bps
+	}
+	return sources, s.resolveFunctionBreakpoints()
+}
+
+// resolveFunctionBreakpoints maps the requested breakpoint symbols and
+// file:line locations to addresses.  It must be called with the mutex held.
+func (s *dapServer) resolveFunctionBreakpoints() []dapBreakpoint {
+	bps := make([]dapBreakpoint, 0, len(s.functions))
+	for _, name := range s.functions {
+		var bp dapBreakpoint
+		a, err := s.symbols.Resolve(name)
+		if err != nil && s.listing != nil &&
+			strings.Contains(name, ":") {
+			a, _, err = s.listing.ParseLocation(name)
+		}
+		switch {
+		case !s.launched:
+			bp.Message = "no program launched"
+		case err != nil:
+			bp.Message = err.Error()
+		default:
+			s.breakpoints[a] = struct{}{}
+			bp.Verified = true
+		}
+		bps = append(bps, bp)
+	}
+	return bps
+}
+
+func (s *dapServer) setFunctionBreakpoints(args json.RawMessage) (interface{},
+	error) {
+
+	var a struct {
+		Breakpoints []struct {
+			Name string `json:"name"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.functions = s.functions[:0]
+	for _, bp := range a.Breakpoints {
+		s.functions = append(s.functions, bp.Name)
+	}
+	_, bps := s.resolveBreakpoints()
+	return map[string]interface{}{"breakpoints": bps}, nil
+}
+
+func (s *dapServer) setBreakpoints(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+
+	lines := make([]int, 0, len(a.Breakpoints))
+	for _, bp := range a.Breakpoints {
+		lines = append(lines, bp.Line)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Breakpoints are resolved for all sources but only the ones for
+	// this source are returned.
+	if len(lines) > 0 {
+		s.requested[a.Source.Path] = lines
+	} else {
+		delete(s.requested, a.Source.Path)
+	}
+	sources, _ := s.resolveBreakpoints()
+	bps := sources[a.Source.Path]
+	if bps == nil {
+		bps = []dapBreakpoint{}
+	}
+	for i := range bps {
+		bps[i].Source = &a.Source
+	}
+
+	return map[string]interface{}{"breakpoints": bps}, nil
+}
+
+func (s *dapServer) configurationDone() {
+	s.mtx.Lock()
+	launched := s.launched
+	entry := s.stopOnEntry
+	s.mtx.Unlock()
+
+	if !launched {
+		return
+	}
+	if entry {
+		s.stopped("entry", "")
+		return
+	}
+	// The program was launched so resume can not fail.
+	_ = s.resume(dapContinue, false)
+}
+
+func (s *dapServer) stopped(reason, text string) {
+	body := map[string]interface{}{
+		"reason":            reason,
+		"threadId":          dapThreadID,
+		"allThreadsStopped": true,
+	}
+	if text != "" {
+		body["description"] = text
+		body["text"] = text
+	}
+	s.event("stopped", body)
+}
+
+// halt stops the run goroutine, if any, and waits for it to exit.
+func (s *dapServer) halt() {
+	s.mtx.Lock()
+	done := s.done
+	s.mtx.Unlock()
+
+	if done == nil {
+		return
+	}
+	s.pause.Store(true)
+	<-done
+}
+
+// byLine returns true when a step request steps source lines rather than
+// instructions.  Source lines are stepped when a listing is loaded unless
+// the client asks for instruction granularity.
+func (s *dapServer) byLine(args json.RawMessage) bool {
+	var a struct {
+		Granularity string `json:"granularity"`
+	}
+	// a missing granularity is the default
+	_ = json.Unmarshal(args, &a)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.listing != nil && a.Granularity != "instruction"
+}
+
+// resume starts executing instructions in the background.  A stopped event
+// is sent once execution stops.  When byLine is set steps complete at the
+// next source statement, which spans whole macro expansions.
+func (s *dapServer) resume(step dapStep, byLine bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.launched {
+		return fmt.Errorf("no program launched")
+	}
+	if s.running {
+		return fmt.Errorf("already running")
+	}
+	s.running = true
+	s.pause.Store(false)
+	done := make(chan struct{})
+	s.done = done
+
+	go func() {
+		defer close(done)
+
+		reason, text := s.execute(step, byLine)
+
+		s.mtx.Lock()
+		s.running = false
+		s.done = nil
+		s.mtx.Unlock()
+
+		s.stopped(reason, text)
+	}()
+
+	return nil
+}
+
+// execute runs instructions until a breakpoint, trap, completed step or pause
+// request.  It returns the DAP stop reason and a description.
+func (s *dapServer) execute(step dapStep, byLine bool) (string, string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c := s.cpu
+	depth := s.calls.Depth()
+	var statement int
+	if byLine {
+		statement, _ = s.listing.Statement(c.pc)
+	}
+	// moved returns true once execution left the starting statement.
+	moved := func() bool {
+		if !byLine {
+			return true
+		}
+		line, ok := s.listing.Statement(c.pc)
+		return !ok || line != statement
+	}
+	for n := 0; ; n++ {
+		if n > 0 && n%dapBatch == 0 {
+			// let requests in
+			s.mtx.Unlock()
+			s.mtx.Lock()
+		}
+		if s.pause.Load() {
+			return "pause", ""
+		}
+		if _, ok := s.breakpoints[c.pc]; ok && n > 0 {
+			return "breakpoint", ""
+		}
+		if opcodes[c.memory[c.pc]] == invalidOpcode {
+			return "exception", fmt.Sprintf("invalid opcode $%02X "+
+				"at $%04X", c.memory[c.pc], c.pc)
+		}
+
+		pc := c.pc
+		c.executeInstruction()
+		if c.pc == pc {
+			return "exception", fmt.Sprintf("trap at $%04X", pc)
+		}
+
+		switch step {
+		case dapStepIn:
+			if moved() {
+				return "step", ""
+			}
+		case dapNext:
+			if s.calls.Depth() <= depth && moved() {
+				return "step", ""
+			}
+		case dapStepOut:
+			if s.calls.Depth() < depth {
+				return "step", ""
+			}
+		}
+	}
+}
+
+// reverse undoes the last instruction for stepBack or instructions until a
+// breakpoint is hit for reverseContinue.  backCycles, a custom request, goes
+// back to the last instruction boundary at least the cycles of its
+// arguments ago.  It returns the DAP stop reason and a description.
+func (s *dapServer) reverse(command string, args json.RawMessage) (string,
+	string, error) {
+
+	var a struct {
+		Cycles uint64 `json:"cycles"`
+	}
+	if command == "backCycles" {
+		if err := json.Unmarshal(args, &a); err != nil {
+			return "", "", err
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.launched {
+		return "", "", fmt.Errorf("no program launched")
+	}
+	if s.running {
+		return "", "", fmt.Errorf("running")
+	}
+
+	c := s.cpu
+	var ok bool
+	switch command {
+	case "reverseContinue":
+		_, ok = s.rewind.ReverseContinue(c, func(c *CPU) bool {
+			_, bp := s.breakpoints[c.pc]
+			return bp
+		})
+	case "backCycles":
+		ok = s.rewind.BackCycles(c, a.Cycles)
+	default:
+		ok = s.rewind.StepBack(c)
+	}
+
+	switch {
+	case !ok:
+		return "step", "start of rewind history", nil
+	case command == "reverseContinue":
+		return "breakpoint", "", nil
+	}
+	return "step", "", nil
+}
+
+// name returns a symbolic name for address.
+func (s *dapServer) name(address uint16) string {
+	return s.symbols.addressName(address)
+}
+
+func (s *dapServer) frame(id int, name string, pc uint16) dapStackFrame {
+	f := dapStackFrame{
+		ID:                          id,
+		Name:                        name,
+		Column:                      1,
+		InstructionPointerReference: fmt.Sprintf("0x%04X", pc),
+	}
+	if s.listing != nil {
+		if line, ok := s.listing.Line(pc); ok {
+			f.Line = line
+			f.Source = &dapSource{
+				Name: filepath.Base(s.listing.Path),
+				Path: s.listing.Path,
+			}
+		}
+	}
+	return f
+}
+
+func (s *dapServer) stackTrace() interface{} {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	frames := []dapStackFrame{}
+	if s.cpu == nil {
+		return map[string]interface{}{"stackFrames": frames}
+	}
+
+	pc := s.cpu.pc
+	for _, f := range s.calls.Frames() {
+		frames = append(frames,
+			s.frame(len(frames), s.name(f.Callee), pc))
+		pc = f.Caller
+	}
+	frames = append(frames, s.frame(len(frames), s.name(pc), pc))
+
+	return map[string]interface{}{
+		"stackFrames": frames,
+		"totalFrames": len(frames),
+	}
+}
+
+func (s *dapServer) scopes() interface{} {
+	return map[string]interface{}{
+		"scopes": []map[string]interface{}{
+			{
+				"name":               "Registers",
+				"variablesReference": dapRegisters,
+				"expensive":          false,
+			},
+			{
+				"name":               "Flags",
+				"variablesReference": dapFlags,
+				"expensive":          false,
+			},
+			{
+				"name":               "Memory",
+				"variablesReference": dapMemory,
+				"namedVariables":     256,
+				"expensive":          true,
+			},
+		},
+	}
+}
+
+func (s *dapServer) variables(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c := s.cpu
+	if c == nil {
+		return nil, fmt.Errorf("no program launched")
+	}
+
+	hex8 := func(name string, v byte) dapVariable {
+		return dapVariable{Name: name, Value: fmt.Sprintf("$%02X", v)}
+	}
+	vars := []dapVariable{}
+	ref := a.VariablesReference
+	switch {
+	case ref == dapRegisters:
+		vars = append(vars,
+			dapVariable{Name: "PC", Value: fmt.Sprintf("$%04X", c.pc),
+				MemoryReference: fmt.Sprintf("0x%04X", c.pc)},
+			hex8("A", c.a),
+			hex8("X", c.x),
+			hex8("Y", c.y),
+			hex8("SP", c.sp),
+			hex8("SR", c.sr),
+			dapVariable{Name: "cycles",
+				Value: strconv.FormatUint(c.cycles, 10)})
+	case ref == dapFlags:
+		flags := []struct {
+			name string
+			bit  byte
+		}{
+			{"N", Negative},
+			{"V", Overflow},
+			{"B", Break},
+			{"D", BCD},
+			{"I", Interrupts},
+			{"Z", Zero},
+			{"C", Carry},
+		}
+		for _, f := range flags {
+			v := "0"
+			if c.sr&f.bit != 0 {
+				v = "1"
+			}
+			vars = append(vars, dapVariable{Name: f.name, Value: v})
+		}
+	case ref == dapMemory:
+		for page := 0; page < 256; page++ {
+			vars = append(vars, dapVariable{
+				Name:               fmt.Sprintf("$%02X00", page),
+				Value:              fmt.Sprintf("page $%02X", page),
+				VariablesReference: dapPage + page,
+				MemoryReference:    fmt.Sprintf("0x%02X00", page),
+			})
+		}
+	case ref >= dapPage && ref < dapPage+256:
+		page := uint16(ref-dapPage) << 8
+		for row := uint16(0); row < 256; row += 16 {
+			var b strings.Builder
+			for i := uint16(0); i < 16; i++ {
+				if i > 0 {
+					b.WriteByte(' ')
+				}
+				fmt.Fprintf(&b, "%02X", c.memory[page+row+i])
+			}
+			vars = append(vars, dapVariable{
+				Name:            fmt.Sprintf("$%04X", page+row),
+				Value:           b.String(),
+				MemoryReference: fmt.Sprintf("0x%04X", page+row),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("invalid variables reference: %v", ref)
+	}
+
+	return map[string]interface{}{"variables": vars}, nil
+}
+
+func (s *dapServer) readMemory(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Count           int    `json:"count"`
+	}
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	base, err := strconv.ParseUint(a.MemoryReference, 0, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory reference: %v",
+			a.MemoryReference)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.cpu == nil {
+		return nil, fmt.Errorf("no program launched")
+	}
+
+	start := int(base) + a.Offset
+	end := start + a.Count
+	unreadable := 0
+	if start < 0 {
+		start = 0
+	}
+	if start > len(s.cpu.memory) {
+		start = len(s.cpu.memory)
+	}
+	if end > len(s.cpu.memory) {
+		unreadable = min(end-len(s.cpu.memory), a.Count)
+		end = len(s.cpu.memory)
+	}
+	if end < start {
+		end = start
+	}
+
+	data := s.cpu.memory[start:end]
+	return map[string]interface{}{
+		"address":         fmt.Sprintf("0x%04X", start),
+		"data":            base64.StdEncoding.EncodeToString(data),
+		"unreadableBytes": unreadable,
+	}, nil
+}
+
+// parseAddress parses a $ or 0x hex, % binary or decimal address.  Leading
+// zeros do not make an address octal.
+func parseAddress(s string) (uint16, error) {
+	a, err := parseNumber(s)
+	if err != nil || a > 0xffff {
+		return 0, fmt.Errorf("invalid address: %v", s)
+	}
+	return uint16(a), nil
+}
+
+// evaluate answers debugger queries.  "writes address" returns the last
+// writes to address, which may be a symbol.  "source [address]" returns the
+// source of the code at address, PC by default.
+func (s *dapServer) evaluate(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(a.Expression)
+	switch {
+	case len(fields) == 2 && fields[0] == "writes":
+	case len(fields) <= 2 && len(fields) > 0 && fields[0] == "source":
+	default:
+		return nil, fmt.Errorf("unsupported expression: %v",
+			a.Expression)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.writes == nil {
+		return nil, fmt.Errorf("no program launched")
+	}
+	address := s.cpu.pc
+	if len(fields) == 2 {
+		var err error
+		address, err = s.symbols.Resolve(fields[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	var result string
+	switch {
+	case fields[0] == "writes":
+		result = s.writes.Report(address)
+	case s.listing == nil:
+		return nil, fmt.Errorf("no listing loaded")
+	default:
+		result = s.listing.Context(address)
+	}
+	return map[string]interface{}{
+		"result":             result,
+		"variablesReference": 0,
+	}, nil
+}
+
+// serveDAP serves a single DAP session on the provided reader and writer.
+func serveDAP(r io.Reader, w io.Writer) error {
+	return newDAPServer(r, w).serve()
+}
+
+// listenDAP serves DAP sessions, one at a time, on a TCP address.
+func listenDAP(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		err = serveDAP(conn, conn)
+		conn.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dap: %v\n", err)
+		}
+	}
+}
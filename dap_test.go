@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dapClient drives a dapServer over pipes.
+type dapClient struct {
+	t        *testing.T
+	w        io.Writer
+	seq      int
+	messages chan map[string]interface{}
+}
+
+func newDAPClient(t *testing.T) *dapClient {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	dc := &dapClient{
+		t:        t,
+		w:        cw,
+		messages: make(chan map[string]interface{}, 100),
+	}
+	go func() {
+		serveDAP(sr, sw)
+		sw.Close()
+	}()
+	go func() {
+		r := bufio.NewReader(cr)
+		for {
+			b, err := readDAPMessage(r)
+			if err != nil {
+				close(dc.messages)
+				return
+			}
+			var m map[string]interface{}
+			if err := json.Unmarshal(b, &m); err != nil {
+				panic(err)
+			}
+			dc.messages <- m
+		}
+	}()
+	t.Cleanup(func() { cw.Close() })
+
+	return dc
+}
+
+func (dc *dapClient) next() map[string]interface{} {
+	select {
+	case m, ok := <-dc.messages:
+		if !ok {
+			dc.t.Fatalf("connection closed")
+		}
+		return m
+	case <-time.After(10 * time.Second):
+		dc.t.Fatalf("timeout")
+	}
+	return nil
+}
+
+// request sends a request and returns the body of its response.
+func (dc *dapClient) request(command string,
+	args interface{}) map[string]interface{} {
+	m := dc.send(command, args)
+	if m["success"] != true {
+		dc.t.Fatalf("%v failed: %v", command, m["message"])
+	}
+	body, _ := m["body"].(map[string]interface{})
+	return body
+}
+
+// send sends a request and returns its response.
+func (dc *dapClient) send(command string,
+	args interface{}) map[string]interface{} {
+	dc.seq++
+	err := writeDAPMessage(dc.w, map[string]interface{}{
+		"seq":       dc.seq,
+		"type":      "request",
+		"command":   command,
+		"arguments": args,
+	})
+	if err != nil {
+		dc.t.Fatal(err)
+	}
+	for {
+		m := dc.next()
+		if m["type"] != "response" {
+			continue
+		}
+		if int(m["request_seq"].(float64)) != dc.seq {
+			dc.t.Fatalf("unexpected response %v", m)
+		}
+		return m
+	}
+}
+
+// event waits for the named event and returns its body.
+func (dc *dapClient) event(name string) map[string]interface{} {
+	for {
+		m := dc.next()
+		if m["type"] == "event" && m["event"] == name {
+			body, _ := m["body"].(map[string]interface{})
+			return body
+		}
+	}
+}
+
+// writeTestListing writes an AS65 style listing and the matching binary of
+// the first $0500 bytes of memory.  Lines are as for formatTestListing.
+func writeTestListing(t *testing.T, lines []string) (string, string) {
+	dir := t.TempDir()
+	image, listing := formatTestListing(lines)
+	bin := filepath.Join(dir, "test.bin")
+	lst := filepath.Join(dir, "test.lst")
+	if err := os.WriteFile(bin, image[:0x0500], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lst, []byte(listing), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return bin, lst
+}
+
+// formatTestListing returns the memory image and the AS65 style listing of
+// lines.  Lines are "address code|source" or "|source".  Source starting
+// with ">" is part of a macro expansion.  Lines without "|" are copied
+// verbatim.
+func formatTestListing(lines []string) ([]byte, string) {
+	image := make([]byte, 0x10000)
+	var b strings.Builder
+	for _, l := range lines {
+		prefix, source, ok := strings.Cut(l, "|")
+		if !ok {
+			fmt.Fprintf(&b, "%s\n", l)
+			continue
+		}
+		marker := " "
+		if strings.HasPrefix(source, ">") {
+			marker, source = ">", source[1:]
+		}
+		var (
+			address uint16
+			code    string
+		)
+		if _, err := fmt.Sscanf(prefix, "%x %s", &address,
+			&code); err != nil {
+			fmt.Fprintf(&b, "%23s%s%s\n", "", marker, source)
+			continue
+		}
+		fmt.Fprintf(&b, "%04x : %-16s%s%s\n", address, code, marker,
+			source)
+		for i := 0; i < len(code); i += 2 {
+			var v byte
+			fmt.Sscanf(code[i:i+2], "%02x", &v)
+			image[int(address)+i/2] = v
+		}
+	}
+	return image, b.String()
+}
+
+func TestDAP(t *testing.T) {
+	bin, lst := writeTestListing(t, []string{
+		"0400 201004|start   jsr sub",
+		"0403 4c0304|loop    jmp loop",
+		"|; subroutine",
+		"0410 a942|sub     lda #$42",
+		"0412 60|        rts",
+	})
+
+	dc := newDAPClient(t)
+	dc.request("initialize", map[string]interface{}{"adapterID": "toy6502"})
+	dc.event("initialized")
+	dc.request("launch", map[string]interface{}{
+		"program":     bin,
+		"listing":     lst,
+		"start":       0x0400,
+		"stopOnEntry": true,
+	})
+
+	// line 3 is a comment and moves to the next line with code
+	body := dc.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": lst},
+		"breakpoints": []map[string]interface{}{{"line": 3}},
+	})
+	bps := body["breakpoints"].([]interface{})
+	bp := bps[0].(map[string]interface{})
+	if bp["verified"] != true || bp["line"].(float64) != 4 {
+		t.Fatalf("unexpected breakpoint %v", bp)
+	}
+
+	dc.request("configurationDone", nil)
+	if e := dc.event("stopped"); e["reason"] != "entry" {
+		t.Fatalf("unexpected stop %v", e)
+	}
+
+	dc.request("continue", map[string]interface{}{"threadId": 1})
+	if e := dc.event("stopped"); e["reason"] != "breakpoint" {
+		t.Fatalf("unexpected stop %v", e)
+	}
+
+	body = dc.request("stackTrace", map[string]interface{}{"threadId": 1})
+	frames := body["stackFrames"].([]interface{})
+	if len(frames) != 2 {
+		t.Fatalf("unexpected frames %v", frames)
+	}
+	top := frames[0].(map[string]interface{})
+	caller := frames[1].(map[string]interface{})
+	if top["name"] != "sub" || top["line"].(float64) != 4 {
+		t.Fatalf("unexpected top frame %v", top)
+	}
+	if caller["name"] != "start" || caller["line"].(float64) != 1 {
+		t.Fatalf("unexpected caller frame %v", caller)
+	}
+
+	dc.request("next", map[string]interface{}{"threadId": 1})
+	if e := dc.event("stopped"); e["reason"] != "step" {
+		t.Fatalf("unexpected stop %v", e)
+	}
+	body = dc.request("variables", map[string]interface{}{
+		"variablesReference": dapRegisters,
+	})
+	found := false
+	for _, v := range body["variables"].([]interface{}) {
+		v := v.(map[string]interface{})
+		if v["name"] == "A" {
+			if v["value"] != "$42" {
+				t.Fatalf("unexpected A %v", v["value"])
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("no accumulator")
+	}
+
+	dc.request("stepOut", map[string]interface{}{"threadId": 1})
+	dc.event("stopped")
+	body = dc.request("stackTrace", map[string]interface{}{"threadId": 1})
+	frames = body["stackFrames"].([]interface{})
+	top = frames[0].(map[string]interface{})
+	if len(frames) != 1 || top["line"].(float64) != 2 {
+		t.Fatalf("unexpected frames %v", frames)
+	}
+
+	body = dc.request("readMemory", map[string]interface{}{
+		"memoryReference": "0x0410",
+		"count":           2,
+	})
+	if body["data"] != "qUI=" {
+		t.Fatalf("unexpected memory %v", body)
+	}
+	// reads past the end of memory
+	for _, test := range []struct {
+		offset     int
+		address    string
+		unreadable float64
+		data       string
+	}{
+		{-2, "0xFFFD", 1, "AAAA"},
+		{2, "0x10000", 4, ""},
+	} {
+		body = dc.request("readMemory", map[string]interface{}{
+			"memoryReference": "0xFFFF",
+			"offset":          test.offset,
+			"count":           4,
+		})
+		if body["address"] != test.address ||
+			body["unreadableBytes"].(float64) != test.unreadable ||
+			body["data"] != test.data {
+			t.Fatalf("unexpected memory %v", body)
+		}
+	}
+
+	dc.request("continue", map[string]interface{}{"threadId": 1})
+	e := dc.event("stopped")
+	if e["reason"] != "exception" || e["text"] != "trap at $0403" {
+		t.Fatalf("unexpected stop %v", e)
+	}
+
+	body = dc.request("evaluate", map[string]interface{}{
+		"expression": "writes $01fe",
+	})
+	if !strings.Contains(body["result"].(string), "by $0400 at cycle 0") {
+		t.Fatalf("unexpected writes %v", body)
+	}
+
+	// back into the subroutine to the breakpoint, then to the start
+	dc.request("reverseContinue", map[string]interface{}{"threadId": 1})
+	if e := dc.event("stopped"); e["reason"] != "breakpoint" {
+		t.Fatalf("unexpected stop %v", e)
+	}
+	// the frame of the undone return is back
+	body = dc.request("stackTrace", map[string]interface{}{"threadId": 1})
+	frames = body["stackFrames"].([]interface{})
+	top = frames[0].(map[string]interface{})
+	if len(frames) != 2 || top["line"].(float64) != 4 {
+		t.Fatalf("unexpected frames %v", frames)
+	}
+	// the custom backCycles request goes back before the call, which
+	// undoes its writes
+	dc.request("backCycles", map[string]interface{}{"cycles": 6})
+	if e := dc.event("stopped"); e["reason"] != "step" {
+		t.Fatalf("unexpected stop %v", e)
+	}
+	body = dc.request("stackTrace", map[string]interface{}{"threadId": 1})
+	frames = body["stackFrames"].([]interface{})
+	top = frames[0].(map[string]interface{})
+	if len(frames) != 1 || top["line"].(float64) != 1 {
+		t.Fatalf("unexpected frames %v", frames)
+	}
+	body = dc.request("evaluate", map[string]interface{}{
+		"expression": "writes $01fe",
+	})
+	if body["result"] != "$01FE: no writes recorded" {
+		t.Fatalf("unexpected writes %v", body)
+	}
+	dc.request("stepBack", map[string]interface{}{"threadId": 1})
+	e = dc.event("stopped")
+	if e["text"] != "start of rewind history" {
+		t.Fatalf("unexpected stop %v", e)
+	}
+
+	dc.request("disconnect", nil)
+}
+
+func TestDAPFunctionBreakpoints(t *testing.T) {
+	bin, lst := writeTestListing(t, []string{
+		"0400 201004|start   jsr sub",
+		"0403 4c0304|loop    jmp loop",
+		"0410 a942|        lda #$42",
+		"0412 60|        rts",
+	})
+	symbols := filepath.Join(t.TempDir(), "test.sym")
+	err := os.WriteFile(symbols, []byte("sub = $0410\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := newDAPClient(t)
+	dc.request("initialize", map[string]interface{}{"adapterID": "toy6502"})
+	dc.event("initialized")
+	dc.request("launch", map[string]interface{}{
+		"program": bin,
+		"listing": lst,
+		"symbols": symbols,
+		"start":   0x0400,
+	})
+	body := dc.request("setFunctionBreakpoints", map[string]interface{}{
+		"breakpoints": []map[string]interface{}{
+			{"name": "sub"}, {"name": "nothere"},
+		},
+	})
+	bps := body["breakpoints"].([]interface{})
+	if bps[0].(map[string]interface{})["verified"] != true ||
+		bps[1].(map[string]interface{})["verified"] == true {
+		t.Fatalf("unexpected breakpoints %v", bps)
+	}
+
+	dc.request("configurationDone", nil)
+	if e := dc.event("stopped"); e["reason"] != "breakpoint" {
+		t.Fatalf("unexpected stop %v", e)
+	}
+	body = dc.request("stackTrace", map[string]interface{}{"threadId": 1})
+	top := body["stackFrames"].([]interface{})[0].(map[string]interface{})
+	if top["name"] != "sub" || top["line"].(float64) != 3 {
+		t.Fatalf("unexpected frame %v", top)
+	}
+
+	dc.request("disconnect", nil)
+}
+
+// TestDAPBreakpointSources checks that setting the breakpoints of one
+// source keeps those of the others.
+func TestDAPBreakpointSources(t *testing.T) {
+	bin, lst := writeTestListing(t, []string{
+		"---------------- main.a65 ----------------",
+		"",
+		"0400 201004|start   jsr sub",
+		"0403 e8|loop    inx",
+		"0404 4c0304|        jmp loop",
+		"---------------- sub.a65 ----------------",
+		"",
+		"0410 a942|sub     lda #$42",
+		"0412 60|        rts",
+	})
+
+	dc := newDAPClient(t)
+	dc.request("initialize", map[string]interface{}{"adapterID": "toy6502"})
+	dc.event("initialized")
+	dc.request("launch", map[string]interface{}{
+		"program":     bin,
+		"listing":     lst,
+		"start":       0x0400,
+		"stopOnEntry": true,
+	})
+
+	for _, test := range []struct {
+		path string
+		line float64
+	}{
+		{"main.a65", 2},
+		{"sub.a65", 1},
+	} {
+		body := dc.request("setBreakpoints", map[string]interface{}{
+			"source": map[string]interface{}{"path": test.path},
+			"breakpoints": []map[string]interface{}{
+				{"line": test.line},
+			},
+		})
+		bps := body["breakpoints"].([]interface{})
+		if len(bps) != 1 {
+			t.Fatalf("%v: unexpected breakpoints %v", test.path,
+				bps)
+		}
+		bp := bps[0].(map[string]interface{})
+		if bp["verified"] != true || bp["line"] != test.line {
+			t.Fatalf("%v: unexpected breakpoint %v", test.path, bp)
+		}
+	}
+
+	dc.request("configurationDone", nil)
+	dc.event("stopped")
+	for _, want := range []string{"sub", "loop"} {
+		dc.request("continue", map[string]interface{}{"threadId": 1})
+		if e := dc.event("stopped"); e["reason"] != "breakpoint" {
+			t.Fatalf("unexpected stop %v", e)
+		}
+		body := dc.request("stackTrace", map[string]interface{}{
+			"threadId": 1,
+		})
+		top := body["stackFrames"].([]interface{})[0]
+		if name := top.(map[string]interface{})["name"]; name != want {
+			t.Fatalf("expected %v, got %v", want, name)
+		}
+	}
+
+	// clearing the breakpoints of a source keeps the others
+	dc.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": "sub.a65"},
+		"breakpoints": []map[string]interface{}{},
+	})
+	dc.request("continue", map[string]interface{}{"threadId": 1})
+	if e := dc.event("stopped"); e["reason"] != "breakpoint" {
+		t.Fatalf("unexpected stop %v", e)
+	}
+
+	// a running program cannot be launched again
+	dc.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": "main.a65"},
+		"breakpoints": []map[string]interface{}{},
+	})
+	dc.request("continue", map[string]interface{}{"threadId": 1})
+	m := dc.send("launch", map[string]interface{}{
+		"program": bin,
+		"listing": lst,
+		"start":   0x0400,
+	})
+	if m["success"] != false || m["message"] != "already running" {
+		t.Fatalf("unexpected response %v", m)
+	}
+	dc.request("pause", map[string]interface{}{"threadId": 1})
+	if e := dc.event("stopped"); e["reason"] != "pause" {
+		t.Fatalf("unexpected stop %v", e)
+	}
+
+	dc.request("disconnect", nil)
+}
+
+func TestDAPSourceStepping(t *testing.T) {
+	bin, lst := writeTestListing(t, []string{
+		"---------------- test.a65 ----------------",
+		"",
+		"|; test.a65 line 1",
+		"0400 a200|start   ldx #0",
+		"|        inc2",
+		"0402 e8|>        inx",
+		"0403 e8|>        inx",
+		"|",
+		"0404 4c0404|done    jmp done",
+	})
+
+	dc := newDAPClient(t)
+	dc.request("initialize", map[string]interface{}{"adapterID": "toy6502"})
+	dc.event("initialized")
+	dc.request("launch", map[string]interface{}{
+		"program":     bin,
+		"listing":     lst,
+		"start":       0x0400,
+		"stopOnEntry": true,
+	})
+
+	// source line 3 is the macro invocation
+	body := dc.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": "test.a65"},
+		"breakpoints": []map[string]interface{}{{"line": 3}},
+	})
+	bp := body["breakpoints"].([]interface{})[0].(map[string]interface{})
+	if bp["verified"] != true || bp["line"].(float64) != 3 {
+		t.Fatalf("unexpected breakpoint %v", bp)
+	}
+	body = dc.request("setFunctionBreakpoints", map[string]interface{}{
+		"breakpoints": []map[string]interface{}{{"name": "test.a65:1"}},
+	})
+	bp = body["breakpoints"].([]interface{})[0].(map[string]interface{})
+	if bp["verified"] != true {
+		t.Fatalf("unexpected breakpoint %v", bp)
+	}
+
+	dc.request("configurationDone", nil)
+	dc.event("stopped")
+	dc.request("continue", map[string]interface{}{"threadId": 1})
+	dc.event("stopped")
+
+	body = dc.request("evaluate", map[string]interface{}{
+		"expression": "source",
+	})
+	want := "test.a65:3: inc2\n  > inx"
+	if body["result"] != want {
+		t.Fatalf("expected %q, got %q", want, body["result"])
+	}
+
+	// one source line steps over the whole macro expansion
+	dc.request("next", map[string]interface{}{"threadId": 1})
+	dc.event("stopped")
+	body = dc.request("evaluate", map[string]interface{}{
+		"expression": "source",
+	})
+	if body["result"] != "test.a65:4: done    jmp done" {
+		t.Fatalf("unexpected source %q", body["result"])
+	}
+	body = dc.request("variables", map[string]interface{}{
+		"variablesReference": dapRegisters,
+	})
+	for _, v := range body["variables"].([]interface{}) {
+		v := v.(map[string]interface{})
+		if v["name"] == "X" && v["value"] != "$02" {
+			t.Fatalf("unexpected X %v", v["value"])
+		}
+	}
+
+	dc.request("disconnect", nil)
+}
+
+func TestDAPStepKinds(t *testing.T) {
+	bin, lst := writeTestListing(t, []string{
+		"0400 201004|start   jsr sub",
+		"0403 201004|        jsr sub",
+		"0406 4c0604|loop    jmp loop",
+		"0410 201804|sub     jsr sub2",
+		"0413 a202|        ldx #2",
+		"0415 60|        rts",
+		"0418 a901|sub2    lda #1",
+		"041a 60|        rts",
+	})
+
+	dc := newDAPClient(t)
+	dc.request("initialize", map[string]interface{}{"adapterID": "toy6502"})
+	dc.event("initialized")
+	dc.request("launch", map[string]interface{}{
+		"program":     bin,
+		"listing":     lst,
+		"start":       0x0400,
+		"stopOnEntry": true,
+	})
+	dc.request("configurationDone", nil)
+	dc.event("stopped")
+
+	for _, test := range []struct {
+		step string
+		pc   string
+	}{
+		{"stepIn", "0x0410"},  // into sub
+		{"next", "0x0413"},    // over the call of sub2
+		{"stepIn", "0x0415"},  // a single instruction
+		{"stepIn", "0x0403"},  // the return
+		{"stepIn", "0x0410"},  // into sub again
+		{"stepIn", "0x0418"},  // into sub2
+		{"stepOut", "0x0413"}, // back to sub
+		{"stepOut", "0x0406"}, // back to start
+	} {
+		dc.request(test.step, map[string]interface{}{
+			"threadId":    1,
+			"granularity": "instruction",
+		})
+		if e := dc.event("stopped"); e["reason"] != "step" {
+			t.Fatalf("%v: unexpected stop %v", test.step, e)
+		}
+		body := dc.request("stackTrace", map[string]interface{}{
+			"threadId": 1,
+		})
+		top := body["stackFrames"].([]interface{})[0]
+		f := top.(map[string]interface{})
+		if pc := f["instructionPointerReference"]; pc != test.pc {
+			t.Fatalf("%v: expected %v, got %v", test.step,
+				test.pc, pc)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import "fmt"
+
+// FeedbackPort emulates the interrupt feedback register of Klaus Dormann's
+// interrupt test.  The program writes the register to raise interrupts:
+// IRQ is asserted for as long as IRQBit is set and an NMI is signalled when
+// NMIBit goes from clear to set.  A bit of -1 is not connected.
+type FeedbackPort struct {
+	Address uint16
+	IRQBit  int
+	NMIBit  int
+
+	value byte
+}
+
+// NewFeedbackPort returns a feedback port at address with IRQ on bit 0 and
+// NMI on bit 1, the defaults of the interrupt test.
+func NewFeedbackPort(address uint16) *FeedbackPort {
+	return &FeedbackPort{Address: address, IRQBit: 0, NMIBit: 1}
+}
+
+// Before does nothing.
+func (p *FeedbackPort) Before(c *CPU) {}
+
+// After does nothing.
+func (p *FeedbackPort) After(c *CPU) {}
+
+// MemoryWrite drives the interrupt lines from writes to the register.
+func (p *FeedbackPort) MemoryWrite(c *CPU, address uint16, old, value byte) {
+	if address != p.Address {
+		return
+	}
+	// isSet returns true if connected bit n of v is set.
+	isSet := func(v byte, n int) bool {
+		return n >= 0 && n < 8 && v&(1<<n) != 0
+	}
+	if p.IRQBit >= 0 {
+		c.IRQ(isSet(value, p.IRQBit))
+	}
+	if isSet(value, p.NMIBit) && !isSet(p.value, p.NMIBit) {
+		c.NMI()
+	}
+	p.value = value
+}
+
+// StateID identifies the port in save states.
+func (p *FeedbackPort) StateID() string {
+	return fmt.Sprintf("feedback %04X", p.Address)
+}
+
+// MarshalState returns the register value.  The interrupt lines are part of
+// the CPU state.
+func (p *FeedbackPort) MarshalState() ([]byte, error) {
+	return []byte{p.value}, nil
+}
+
+// UnmarshalState restores the register value.
+func (p *FeedbackPort) UnmarshalState(b []byte) error {
+	if len(b) != 1 {
+		return fmt.Errorf("invalid feedback port state")
+	}
+	p.value = b[0]
+	return nil
+}
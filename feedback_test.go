@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestFeedbackPort(t *testing.T) {
+	c := New()
+	copy(c.memory[0x0400:], []byte{
+		0x58,       // cli
+		0xa9, 0x01, // lda #$01
+		0x8d, 0xfc, 0xbf, // sta $bffc
+		0xea, // nop
+	})
+	copy(c.memory[0x0500:], []byte{
+		0xa9, 0x02, // lda #$02
+		0x8d, 0xfc, 0xbf, // sta $bffc
+		0xea, // nop
+	})
+	c.memory[0xfffe], c.memory[0xffff] = 0x00, 0x05 // IRQ
+	c.memory[0xfffa], c.memory[0xfffb] = 0x00, 0x06 // NMI
+	c.memory[0x0600] = 0xea
+	p := NewFeedbackPort(0xbffc)
+	c.Attach(p)
+
+	c.pc = 0x0400
+	for i := 0; i < 3; i++ {
+		c.executeInstruction()
+	}
+	if !c.irq {
+		t.Fatalf("IRQ not asserted")
+	}
+	// the IRQ is taken instead of the nop
+	c.executeInstruction()
+	if c.pc != 0x0502 {
+		t.Fatalf("IRQ not taken, pc $%04X", c.pc)
+	}
+	// clearing bit 0 releases IRQ, setting bit 1 signals NMI
+	c.executeInstruction()
+	if c.irq || !c.nmi {
+		t.Fatalf("unexpected lines irq %v nmi %v", c.irq, c.nmi)
+	}
+	c.executeInstruction()
+	if c.pc != 0x0601 {
+		t.Fatalf("NMI not taken, pc $%04X", c.pc)
+	}
+
+	// bit 1 staying set is not another edge
+	c.write(0xbffc, 0x02)
+	if c.nmi {
+		t.Fatalf("NMI on a level")
+	}
+
+	b, err := p.MarshalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewFeedbackPort(0xbffc)
+	if err := q.UnmarshalState(b); err != nil || q.value != 0x02 {
+		t.Fatalf("unexpected state %v %v", q.value, err)
+	}
+}
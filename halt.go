@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// HaltKind is the kind of condition that stopped a run.
+type HaltKind int
+
+const (
+	HaltJumpToSelf    HaltKind = iota // JMP to its own address
+	HaltBranchToSelf                  // taken branch to its own address
+	HaltPC                            // PC reached an address
+	HaltMemory                        // memory matched a value
+	HaltCycles                        // cycle budget exhausted
+	HaltInstructions                  // instruction budget exhausted
+	HaltInvalidOpcode                 // invalid opcode, not executed
+	HaltBRK                           // BRK, not executed
+	HaltCustom                        // user condition
+	HaltCanceled                      // context canceled
+)
+
+var haltKinds = []string{
+	"jump to self",
+	"branch to self",
+	"pc",
+	"memory",
+	"cycles",
+	"instructions",
+	"invalid opcode",
+	"brk",
+	"custom",
+	"canceled",
+}
+
+func (k HaltKind) String() string {
+	if k < 0 || int(k) >= len(haltKinds) {
+		return fmt.Sprintf("HaltKind(%d)", int(k))
+	}
+	return haltKinds[k]
+}
+
+// Progress is what a run did so far.
+type Progress struct {
+	Instructions uint64
+	Cycles       uint64
+}
+
+// Registers are the CPU registers.
+type Registers struct {
+	PC     uint16
+	A      byte
+	X      byte
+	Y      byte
+	SP     byte
+	SR     byte
+	Cycles uint64
+}
+
+// registers returns the registers of c.
+func (c *CPU) registers() Registers {
+	return Registers{
+		PC:     c.pc,
+		A:      c.a,
+		X:      c.x,
+		Y:      c.y,
+		SP:     c.sp,
+		SR:     c.sr,
+		Cycles: c.cycles,
+	}
+}
+
+// HaltCondition stops a run.  Before is checked before every instruction
+// and After once it executed; either may be nil.  pc is the address of the
+// instruction, which is the interrupt handler when an interrupt is taken
+// first.  A Before that changes where execution continues, e.g. by raising
+// an interrupt or setting PC, makes the run check all conditions again.
+//
+// Conditions that keep state set Start instead, which every run calls for
+// the condition it uses, so that runs, also concurrent ones, do not share
+// the state.
+type HaltCondition struct {
+	Kind   HaltKind
+	Name   string // describes custom conditions
+	Before func(c *CPU, pc uint16, p Progress) bool
+	After  func(c *CPU, pc uint16, p Progress) bool
+	Start  func() HaltCondition
+}
+
+// startConditions returns the conditions of a run: those with Start are
+// replaced by the condition it returns.
+func startConditions(conditions []HaltCondition) []HaltCondition {
+	var started []HaltCondition
+	for i, h := range conditions {
+		if h.Start == nil {
+			continue
+		}
+		if started == nil {
+			started = append(started, conditions...)
+		}
+		started[i] = h.Start()
+	}
+	if started == nil {
+		return conditions
+	}
+	return started
+}
+
+// Halt is why and where a run stopped.
+type Halt struct {
+	Kind      HaltKind
+	Name      string    // name of a custom condition
+	PC        uint16    // instruction that stopped the run
+	Progress            // done by the run
+	Registers Registers // state once stopped
+	Err       error     // context error of canceled runs
+}
+
+// String describes the halt, e.g. "jump to self at $3399".
+func (h Halt) String() string {
+	what := h.Kind.String()
+	if h.Kind == HaltCustom && h.Name != "" {
+		what = h.Name
+	}
+	return fmt.Sprintf("%v at $%04X after %v instructions, %v cycles",
+		what, h.PC, h.Instructions, h.Cycles)
+}
+
+// HaltOnJumpToSelf stops after a JMP to its own address, the usual trap of
+// test programs.
+func HaltOnJumpToSelf() HaltCondition {
+	return HaltCondition{
+		Kind: HaltJumpToSelf,
+		After: func(c *CPU, pc uint16, p Progress) bool {
+			o := c.memory[pc]
+			return c.pc == pc && (o == 0x4c || o == 0x6c)
+		},
+	}
+}
+
+// HaltOnBranchToSelf stops after a taken branch to its own address.
+func HaltOnBranchToSelf() HaltCondition {
+	return HaltCondition{
+		Kind: HaltBranchToSelf,
+		After: func(c *CPU, pc uint16, p Progress) bool {
+			o := opcodes[c.memory[pc]]
+			return c.pc == pc && o.mode == relative
+		},
+	}
+}
+
+// HaltAtPC stops before the instruction at any of addresses executes.  The
+// first instruction of a run does not stop it so that a halted run can be
+// resumed.
+func HaltAtPC(addresses ...uint16) HaltCondition {
+	set := make(map[uint16]bool, len(addresses))
+	for _, a := range addresses {
+		set[a] = true
+	}
+	return HaltCondition{
+		Kind: HaltPC,
+		Before: func(c *CPU, pc uint16, p Progress) bool {
+			return p.Instructions > 0 && set[pc]
+		},
+	}
+}
+
+// HaltOnMemory stops after an instruction once the bits of mask at address
+// equal value.
+func HaltOnMemory(address uint16, value, mask byte) HaltCondition {
+	return HaltCondition{
+		Kind: HaltMemory,
+		After: func(c *CPU, pc uint16, p Progress) bool {
+			return c.memory[address]&mask == value&mask
+		},
+	}
+}
+
+// HaltAfterCycles stops before the instruction that starts once n cycles
+// were spent.
+func HaltAfterCycles(n uint64) HaltCondition {
+	return HaltCondition{
+		Kind: HaltCycles,
+		Before: func(c *CPU, pc uint16, p Progress) bool {
+			return p.Cycles >= n
+		},
+	}
+}
+
+// HaltAfterInstructions stops once n instructions executed.
+func HaltAfterInstructions(n uint64) HaltCondition {
+	return HaltCondition{
+		Kind: HaltInstructions,
+		Before: func(c *CPU, pc uint16, p Progress) bool {
+			return p.Instructions >= n
+		},
+	}
+}
+
+// HaltOnBRK stops before a BRK executes.
+func HaltOnBRK() HaltCondition {
+	return HaltCondition{
+		Kind: HaltBRK,
+		Before: func(c *CPU, pc uint16, p Progress) bool {
+			return c.memory[pc] == 0x00
+		},
+	}
+}
+
+// HaltWhen stops after an instruction once f returns true.
+func HaltWhen(name string, f func(c *CPU) bool) HaltCondition {
+	return HaltCondition{
+		Kind: HaltCustom,
+		Name: name,
+		After: func(c *CPU, pc uint16, p Progress) bool {
+			return f(c)
+		},
+	}
+}
+
+// YieldEvery never stops a run; it yields the processor to other goroutines
+// every n cycles so that machines run by one goroutine each share the
+// processors fairly.  The condition may be used for several runs, also at
+// once.
+func YieldEvery(n uint64) HaltCondition {
+	return everyCycles("yield", n, runtime.Gosched)
+}
+
+// everyCycles returns a condition that never stops a run and calls f every n
+// cycles.  The count starts over with every run.
+func everyCycles(name string, n uint64, f func()) HaltCondition {
+	start := func() HaltCondition {
+		next := n
+		return HaltCondition{
+			Kind: HaltCustom,
+			Name: name,
+			Before: func(c *CPU, pc uint16, p Progress) bool {
+				if n > 0 && p.Cycles >= next {
+					f()
+					next = p.Cycles + n
+				}
+				return false
+			},
+		}
+	}
+	return HaltCondition{Kind: HaltCustom, Name: name, Start: start}
+}
+
+// nextPC returns the address of the next instruction to execute, the
+// interrupt handler when an interrupt is pending.
+func (c *CPU) nextPC() uint16 {
+	vector := uint16(0)
+	switch {
+	case c.nmi:
+		vector = 0xfffa
+	case c.irq && c.sr&Interrupts == 0:
+		vector = 0xfffe
+	default:
+		return c.pc
+	}
+	return uint16(c.memory[vector+1])<<8 | uint16(c.memory[vector])
+}
+
+// Run executes instructions until one of conditions holds or ctx is done.
+// Invalid opcodes always stop the run before they execute.  Cancellation is
+// checked between instructions, so the CPU is left in a consistent state and
+// can be run again.  The Progress of the returned Halt counts the
+// instructions and cycles consumed.
+func (c *CPU) Run(ctx context.Context, conditions ...HaltCondition) Halt {
+	var p Progress
+	start := c.cycles
+	done := ctx.Done()
+	conditions = startConditions(conditions)
+	halt := func(h HaltCondition, pc uint16) Halt {
+		return Halt{
+			Kind:      h.Kind,
+			Name:      h.Name,
+			PC:        pc,
+			Progress:  p,
+			Registers: c.registers(),
+		}
+	}
+	for {
+		pc := c.nextPC()
+		p.Cycles = c.cycles - start
+		if done != nil {
+			select {
+			case <-done:
+				h := halt(HaltCondition{Kind: HaltCanceled}, pc)
+				h.Err = ctx.Err()
+				return h
+			default:
+			}
+		}
+		for _, h := range conditions {
+			if h.Before != nil && h.Before(c, pc, p) {
+				return halt(h, pc)
+			}
+		}
+		if c.nextPC() != pc {
+			continue // a condition moved execution
+		}
+		if opcodes[c.memory[pc]] == invalidOpcode {
+			return halt(HaltCondition{Kind: HaltInvalidOpcode}, pc)
+		}
+
+		c.executeInstruction()
+		p.Instructions++
+		p.Cycles = c.cycles - start
+		for _, h := range conditions {
+			if h.After != nil && h.After(c, pc, p) {
+				return halt(h, pc)
+			}
+		}
+	}
+}
+
+// RunFor is Run with a budget of cycles.  The run stops before the first
+// instruction that starts once the budget is spent, so the cycles consumed
+// exceed it by less than an instruction.  Calling RunFor in turn on several
+// CPUs interleaves them in one goroutine.
+func (c *CPU) RunFor(ctx context.Context, cycles uint64,
+	conditions ...HaltCondition) Halt {
+	return c.Run(ctx, append(conditions[:len(conditions):len(conditions)],
+		HaltAfterCycles(cycles))...)
+}
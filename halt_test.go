@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func xIsOne(c *CPU) bool {
+	return c.x == 1
+}
+
+func TestRun(t *testing.T) {
+	program := []byte{
+		0xa2, 0x03, // start: ldx #3
+		0xca,       // loop:  dex
+		0xd0, 0xfd, //        bne loop
+		0x8e, 0x00, 0x02, //  stx $0200
+		0x00, //              brk
+		0x02, //              jam
+	}
+	tests := []struct {
+		name       string
+		conditions []HaltCondition
+		kind       HaltKind
+		pc         uint16
+		progress   Progress
+	}{
+		{"invalid opcode", nil, HaltInvalidOpcode, 0x0409,
+			Progress{9, 28}},
+		{"brk", []HaltCondition{HaltOnBRK()}, HaltBRK, 0x0408,
+			Progress{8, 21}},
+		{"pc", []HaltCondition{HaltAtPC(0x0400, 0x0403)}, HaltPC,
+			0x0403, Progress{2, 4}},
+		{"instructions", []HaltCondition{HaltAfterInstructions(4)},
+			HaltInstructions, 0x0403, Progress{4, 9}},
+		{"cycles", []HaltCondition{HaltAfterCycles(3)}, HaltCycles,
+			0x0403, Progress{2, 4}},
+		{"memory", []HaltCondition{HaltOnMemory(0x0200, 0x00, 0xff)},
+			HaltMemory, 0x0405, Progress{8, 21}},
+		{"custom", []HaltCondition{HaltWhen("x is 1", xIsOne)},
+			HaltCustom, 0x0402, Progress{4, 9}},
+	}
+	for _, test := range tests {
+		c := New()
+		copy(c.memory[0x0400:], program)
+		c.memory[0x0200] = 0xff
+		// the IRQ vector of BRK points at the jam
+		c.memory[0xfffe], c.memory[0xffff] = 0x09, 0x04
+		c.pc = 0x0400
+		h := c.Run(context.Background(), test.conditions...)
+		if h.Kind != test.kind || h.PC != test.pc ||
+			h.Progress != test.progress {
+			t.Fatalf("%v: unexpected halt %v", test.name, h)
+		}
+		if h.Registers.PC != c.pc || h.Registers.X != c.x ||
+			h.Registers.Cycles != c.cycles {
+			t.Fatalf("%v: unexpected registers %+v", test.name,
+				h.Registers)
+		}
+	}
+}
+
+func TestRunTraps(t *testing.T) {
+	c := New()
+	copy(c.memory[0x0400:], []byte{
+		0x4c, 0x03, 0x04, // jmp $0403
+		0xf0, 0xfe, //       beq *
+		0x4c, 0x05, 0x04, // jmp *
+	})
+	c.pc = 0x0400
+	ctx := context.Background()
+	h := c.Run(ctx, HaltOnJumpToSelf(), HaltOnBranchToSelf())
+	if h.Kind != HaltJumpToSelf || h.PC != 0x0405 || h.Instructions != 3 {
+		t.Fatalf("unexpected halt %v", h)
+	}
+	if h.String() != "jump to self at $0405 after 3 instructions, "+
+		"9 cycles" {
+		t.Fatalf("unexpected string %q", h.String())
+	}
+
+	// resuming at the stop address does not stop at once
+	c.pc = 0x0403
+	c.sr |= Zero
+	h = c.Run(ctx, HaltOnJumpToSelf(), HaltOnBranchToSelf(),
+		HaltAtPC(0x0403))
+	if h.Kind != HaltBranchToSelf || h.PC != 0x0403 {
+		t.Fatalf("unexpected halt %v", h)
+	}
+
+	// a pending interrupt runs the handler first
+	c.memory[0xfffa], c.memory[0xfffb] = 0x00, 0x05
+	c.memory[0x0500] = 0x02 // jam
+	c.NMI()
+	h = c.Run(ctx)
+	if h.Kind != HaltInvalidOpcode || h.PC != 0x0500 {
+		t.Fatalf("unexpected halt %v", h)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	c := New()
+	copy(c.memory[0x0400:], []byte{0x4c, 0x00, 0x04}) // jmp *
+	c.pc = 0x0400
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h := c.Run(ctx)
+	if h.Kind != HaltCanceled || h.Instructions != 0 ||
+		!errors.Is(h.Err, context.Canceled) {
+		t.Fatalf("unexpected halt %v", h)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	h = c.Run(ctx, YieldEvery(1000))
+	if h.Kind != HaltCanceled || h.PC != 0x0400 || h.Instructions == 0 ||
+		!errors.Is(h.Err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected halt %v", h)
+	}
+	if h.Cycles != h.Instructions*3 || h.Registers.PC != 0x0400 {
+		t.Fatalf("unexpected progress %v", h)
+	}
+}
+
+func TestEveryCycles(t *testing.T) {
+	c := New()
+	copy(c.memory[0x0400:], []byte{0x4c, 0x00, 0x04}) // jmp *
+	c.pc = 0x0400
+
+	// the count starts over when a condition is used again
+	calls := 0
+	every := everyCycles("count", 30, func() { calls++ })
+	for i := 0; i < 3; i++ {
+		calls = 0
+		c.RunFor(context.Background(), 300, every)
+		if calls != 10 {
+			t.Fatalf("run %v: %v calls", i, calls)
+		}
+	}
+
+	// and is not shared by runs at once
+	var mtx sync.Mutex
+	calls = 0
+	every = everyCycles("count", 30, func() {
+		mtx.Lock()
+		calls++
+		mtx.Unlock()
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		c := New()
+		copy(c.memory[0x0400:], []byte{0x4c, 0x00, 0x04})
+		c.pc = 0x0400
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.RunFor(context.Background(), 300, every)
+		}()
+	}
+	wg.Wait()
+	if calls != 40 {
+		t.Fatalf("%v calls", calls)
+	}
+}
+
+func TestRunFor(t *testing.T) {
+	// two machines counting in zero page, interleaved in slices
+	var machines [2]*CPU
+	for i := range machines {
+		c := New()
+		copy(c.memory[0x0400:], []byte{
+			0xe6, 0x10, //       inc $10
+			0x4c, 0x00, 0x04, // jmp $0400
+		})
+		c.pc = 0x0400
+		machines[i] = c
+	}
+	ctx := context.Background()
+	for slice := 0; slice < 10; slice++ {
+		for _, c := range machines {
+			h := c.RunFor(ctx, 100)
+			if h.Kind != HaltCycles || h.Cycles < 100 ||
+				h.Cycles >= 108 {
+				t.Fatalf("unexpected halt %v", h)
+			}
+		}
+	}
+	if machines[0].cycles != machines[1].cycles ||
+		machines[0].memory[0x10] != machines[1].memory[0x10] ||
+		machines[0].memory[0x10] == 0 {
+		t.Fatalf("machines diverged")
+	}
+
+	// conditions still stop the run before the budget
+	c := machines[0]
+	h := c.RunFor(ctx, 1000, HaltAtPC(0x0402))
+	if h.Kind != HaltPC || h.Cycles >= 1000 {
+		t.Fatalf("unexpected halt %v", h)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import "strings"
+
+// historyEntry is the state of the CPU before an instruction executed.
+type historyEntry struct {
+	pc      uint16
+	a, x, y byte
+	sr, sp  byte
+	cycles  uint64
+	opcode  byte
+	operand [2]byte
+}
+
+// History is an Observer that remembers the last instructions executed in a
+// ring buffer.  It records raw state only and is cheap enough to keep
+// attached for long runs.
+type History struct {
+	entries []historyEntry
+	next    int    // slot of the next entry
+	total   uint64 // instructions seen
+}
+
+// NewHistory returns a History that remembers the last n instructions.
+func NewHistory(n int) *History {
+	if n < 1 {
+		n = 1
+	}
+	return &History{entries: make([]historyEntry, n)}
+}
+
+// Before records the instruction at pc.
+func (h *History) Before(c *CPU) {
+	h.entries[h.next] = historyEntry{
+		pc:      c.pc,
+		a:       c.a,
+		x:       c.x,
+		y:       c.y,
+		sr:      c.sr,
+		sp:      c.sp,
+		cycles:  c.cycles,
+		opcode:  c.memory[c.pc],
+		operand: [2]byte{c.memory[c.pc+1], c.memory[c.pc+2]},
+	}
+	h.next = (h.next + 1) % len(h.entries)
+	h.total++
+}
+
+// After does nothing.
+func (h *History) After(c *CPU) {}
+
+// Len returns the number of remembered instructions.
+func (h *History) Len() int {
+	if h.total < uint64(len(h.entries)) {
+		return int(h.total)
+	}
+	return len(h.entries)
+}
+
+// Records returns the remembered instructions, oldest first, as trace
+// records.  The instruction bytes are the ones that executed; operands are
+// disassembled with the symbols of c and follow the mnemonic after a space,
+// as in nestest.log.
+func (h *History) Records(c *CPU) []TraceRecord {
+	n := h.Len()
+	records := make([]TraceRecord, 0, n)
+	scratch := New()
+	scratch.symbols = c.symbols
+	for i := 0; i < n; i++ {
+		e := h.entries[(h.next-n+i+len(h.entries))%len(h.entries)]
+		size := opcodes[e.opcode].noBytes
+		if size == 0 {
+			size = 1 // invalid opcode
+		}
+		raw := append([]byte{e.opcode}, e.operand[:size-1]...)
+		copy(scratch.memory[e.pc:], raw)
+		d, _ := scratch.disassemble(e.pc)
+		d = strings.Replace(d, "\t", " ", 1)
+		r := TraceRecord{
+			PC:          e.pc,
+			Bytes:       raw,
+			Disassembly: d,
+			A:           e.a,
+			X:           e.x,
+			Y:           e.y,
+			P:           e.sr,
+			SP:          e.sp,
+			Cycles:      e.cycles,
+		}
+		if c.symbols.Len() > 0 {
+			r.Symbol = c.symbols.addressName(e.pc)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// Reset forgets all instructions.
+func (h *History) Reset() {
+	h.next = 0
+	h.total = 0
+}
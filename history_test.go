@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	c := New()
+	copy(c.memory[0x0400:], []byte{
+		0xa9, 0x01, // lda #$01
+		0xaa,             // tax
+		0xe8,             // inx
+		0x8d, 0x00, 0x20, // sta $2000
+	})
+	s := NewSymbols()
+	s.Add("start", 0x0400)
+	c.SetSymbols(s)
+	c.pc = 0x0400
+	h := NewHistory(3)
+	c.Attach(h)
+
+	c.executeInstruction()
+	if h.Len() != 1 {
+		t.Fatalf("unexpected length %v", h.Len())
+	}
+	for i := 0; i < 3; i++ {
+		c.executeInstruction()
+	}
+	// the lda is overwritten afterwards
+	c.memory[0x0400] = 0x00
+
+	r := h.Records(c)
+	if len(r) != 3 {
+		t.Fatalf("unexpected records %v", r)
+	}
+	if r[0].PC != 0x0402 || r[0].Disassembly != "TAX" || r[0].A != 0x01 ||
+		r[0].Symbol != "start+$2" {
+		t.Fatalf("unexpected first record %v", r[0])
+	}
+	if r[2].PC != 0x0404 || r[2].Disassembly != "STA $2000" ||
+		r[2].X != 0x02 || len(r[2].Bytes) != 3 {
+		t.Fatalf("unexpected last record %v", r[2])
+	}
+	// the registers start in the column of nestest.log
+	for _, record := range r {
+		if s := record.String(); strings.Index(s, "A:") != 48 {
+			t.Fatalf("unexpected layout %q", s)
+		}
+	}
+
+	h.Reset()
+	if h.Len() != 0 || len(h.Records(c)) != 0 {
+		t.Fatalf("history not reset")
+	}
+}
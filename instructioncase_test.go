@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// caseStart is the address instruction cases are assembled at.
+const caseStart = 0x0400
+
+// instructionCase is a single instruction test.  The CPU starts at $0400
+// with the registers, flags and memory of Setup.  Once the instruction
+// executed the registers, flags and memory listed in Want must hold their
+// values and everything else must be unchanged.  PC must be at the next
+// instruction unless Want lists it.
+//
+// Setup and Want list NAME=VALUE pairs separated by spaces.  Names are PC,
+// A, X, Y, SP and SR, the flags N, V, B, D, I, Z and C, memory addresses
+// such as $0200, and M, the operand of cases that run every addressing
+// mode.  Values are numbers as accepted by parseAddress.
+type instructionCase struct {
+	Name   string // defaults to Asm
+	Asm    string // instruction, or a mnemonic when All is set
+	All    bool   // run every addressing mode of the mnemonic with M
+	Setup  string // e.g. "A=$7F C=1"
+	Want   string // e.g. "A=$80 N=1 V=1 C=0"
+	Cycles uint64 // cycles taken, 0 to not check
+}
+
+// applySpec sets the registers, flags and memory of spec in s.
+func applySpec(s *State, spec string) error {
+	flags := map[string]byte{
+		"N": Negative, "V": Overflow, "B": Break, "D": BCD,
+		"I": Interrupts, "Z": Zero, "C": Carry,
+	}
+	for _, field := range strings.Fields(spec) {
+		name, value, found := strings.Cut(field, "=")
+		if !found {
+			return fmt.Errorf("expected NAME=VALUE: %v", field)
+		}
+		v, err := parseAddress(value)
+		if err != nil {
+			return err
+		}
+		name = strings.ToUpper(name)
+		switch name {
+		case "PC":
+			s.PC = v
+		case "A":
+			s.A = byte(v)
+		case "X":
+			s.X = byte(v)
+		case "Y":
+			s.Y = byte(v)
+		case "SP":
+			s.SP = byte(v)
+		case "SR":
+			s.SR = byte(v)
+		default:
+			if flag, ok := flags[name]; ok {
+				s.SR &^= flag
+				if v != 0 {
+					s.SR |= flag
+				}
+				break
+			}
+			if !strings.HasPrefix(name, "$") {
+				return fmt.Errorf("invalid name: %v", name)
+			}
+			a, err := parseAddress(name)
+			if err != nil {
+				return err
+			}
+			s.Memory[a] = byte(v)
+		}
+	}
+	s.Flags = DecodeFlags(s.SR)
+	return nil
+}
+
+// cutOperand removes M from spec and returns its value.
+func cutOperand(spec string) (string, string) {
+	var rest []string
+	var m string
+	for _, field := range strings.Fields(spec) {
+		if v, ok := strings.CutPrefix(field, "M="); ok {
+			m = v
+			continue
+		}
+		rest = append(rest, field)
+	}
+	return strings.Join(rest, " "), m
+}
+
+// variants returns a case for every addressing mode of the mnemonic of ic
+// that takes an operand, with M placed where the mode reads it.  Indexed
+// modes use X and Y of Setup.
+func (ic instructionCase) variants() ([]instructionCase, error) {
+	index := New().State(true)
+	setup, _ := cutOperand(ic.Setup)
+	if err := applySpec(&index, setup); err != nil {
+		return nil, err
+	}
+	x, y := uint16(index.X), uint16(index.Y)
+
+	var cases []instructionCase
+	for _, o := range opcodes {
+		if o == invalidOpcode || o.mnemonic != ic.Asm {
+			continue
+		}
+		var operand, pointer string
+		address := -1 // of M, -1 for A
+		switch o.mode {
+		case accumulator:
+		case immediate:
+		case zeroPage:
+			operand, address = "$10", 0x10
+		case zeroPageX:
+			operand, address = "$10,X", int((0x10+x)&0xff)
+		case zeroPageY:
+			operand, address = "$10,Y", int((0x10+y)&0xff)
+		case absolute:
+			operand, address = "$0300", 0x0300
+		case absoluteX:
+			operand, address = "$0300,X", int(0x0300+x)
+		case absoluteY:
+			operand, address = "$0300,Y", int(0x0300+y)
+		case zeroPageIndirectX:
+			p := (0x20 + x) & 0xff
+			operand, address = "($20,X)", 0x0300
+			pointer = fmt.Sprintf("$%04X=$00 $%04X=$03 ", p,
+				(p+1)&0xff)
+		case zeroPageIndirectY:
+			operand, address = "($20),Y", int(0x0300+y)
+			pointer = "$0020=$00 $0021=$03 "
+		default:
+			continue
+		}
+		v := ic
+		v.All = false
+		v.Cycles = 0
+		v.Setup = pointer + ic.Setup
+		switch {
+		case o.mode == immediate:
+			var m string
+			v.Setup, m = cutOperand(v.Setup)
+			v.Want, _ = cutOperand(v.Want)
+			operand = "#" + m
+		case address < 0:
+			v.Setup = strings.ReplaceAll(v.Setup, "M=", "A=")
+			v.Want = strings.ReplaceAll(v.Want, "M=", "A=")
+		default:
+			m := fmt.Sprintf("$%04X=", address)
+			v.Setup = strings.ReplaceAll(v.Setup, "M=", m)
+			v.Want = strings.ReplaceAll(v.Want, "M=", m)
+		}
+		v.Asm = strings.TrimSpace(o.mnemonic + " " + operand)
+		if ic.Name != "" {
+			v.Name = ic.Name + ": " + v.Asm
+		}
+		cases = append(cases, v)
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("no addressing modes: %v", ic.Asm)
+	}
+	return cases, nil
+}
+
+// run runs a case, which must not have All set, and returns how the state
+// the instruction left differs from the one it wants.
+func (ic instructionCase) run() (Changes, error) {
+	code, err := assemble(caseStart, ic.Asm)
+	if err != nil {
+		return nil, err
+	}
+	initial := New().State(true)
+	initial.PC = caseStart
+	copy(initial.Memory[caseStart:], code)
+	if err := applySpec(&initial, ic.Setup); err != nil {
+		return nil, fmt.Errorf("setup: %v", err)
+	}
+	want := initial
+	want.Memory = append([]byte(nil), initial.Memory...)
+	want.PC = caseStart + uint16(len(code))
+	if err := applySpec(&want, ic.Want); err != nil {
+		return nil, fmt.Errorf("want: %v", err)
+	}
+
+	c := New()
+	c.pc, c.a, c.x, c.y = initial.PC, initial.A, initial.X, initial.Y
+	c.sp, c.sr, c.cycles = initial.SP, initial.SR, initial.Cycles
+	copy(c.memory, initial.Memory)
+	c.executeInstruction()
+	got := c.State(true)
+
+	want.Cycles = initial.Cycles + ic.Cycles
+	if ic.Cycles == 0 {
+		want.Cycles = got.Cycles
+	}
+	return want.Diff(got), nil
+}
+
+// runInstructionCases runs cases and reports the registers, flags and
+// memory that differ from what they want.
+func runInstructionCases(t *testing.T, cases []instructionCase) {
+	t.Helper()
+	for _, ic := range cases {
+		if ic.All {
+			vs, err := ic.variants()
+			if err != nil {
+				t.Fatalf("%v: %v", ic.Asm, err)
+			}
+			runInstructionCases(t, vs)
+			continue
+		}
+		name := ic.Name
+		if name == "" {
+			name = ic.Asm
+		}
+		d, err := ic.run()
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if len(d) != 0 {
+			t.Errorf("%v: want -> got\n%v", name, d)
+		}
+	}
+}
+
+func TestInstructionCases(t *testing.T) {
+	runInstructionCases(t, []instructionCase{
+		{Asm: "LDA #$00", Setup: "A=$55", Want: "A=$00 Z=1",
+			Cycles: 2},
+		{Asm: "LDA", All: true, Setup: "X=$03 Y=$04 M=$80 Z=1",
+			Want: "A=$80 N=1 Z=0"},
+		{Asm: "STA", All: true, Setup: "A=$42 X=$FF Y=$01",
+			Want: "M=$42"},
+		{Name: "overflow", Asm: "ADC", All: true,
+			Setup: "A=$7F M=$01 C=0", Want: "A=$80 N=1 V=1"},
+		{Name: "carry", Asm: "ADC", All: true,
+			Setup: "A=$FF M=$01 C=0", Want: "A=$00 Z=1 C=1"},
+		{Name: "decimal", Asm: "ADC #$01", Setup: "A=$09 D=1",
+			Want: "A=$10"},
+		{Name: "borrow", Asm: "SBC", All: true,
+			Setup: "A=$00 M=$01 C=1", Want: "A=$FF N=1 C=0"},
+		{Asm: "CMP", All: true, Setup: "A=$10 M=$10",
+			Want: "Z=1 C=1"},
+		{Asm: "ASL", All: true, Setup: "M=$81 X=$02",
+			Want: "M=$02 C=1"},
+		{Asm: "ROR", All: true, Setup: "M=$01 C=1",
+			Want: "M=$80 N=1 C=1"},
+		{Asm: "INC", All: true, Setup: "M=$FF", Want: "M=$00 Z=1"},
+		{Asm: "BIT $10", Setup: "A=$01 $0010=$C0",
+			Want: "N=1 V=1 Z=1", Cycles: 3},
+		{Name: "taken", Asm: "BNE $0410", Want: "PC=$0410"},
+		{Name: "not taken", Asm: "BNE $0410", Setup: "Z=1"},
+		{Asm: "JSR $1234", Want: "PC=$1234 SP=$FD $01FF=$04 $01FE=$02",
+			Cycles: 6},
+		{Asm: "RTS", Setup: "SP=$FD $01FF=$12 $01FE=$33",
+			Want: "PC=$1234 SP=$FF", Cycles: 6},
+		{Asm: "PHP", Setup: "SR=$C3", Want: "SP=$FE $01FF=$F3"},
+		{Asm: "TXS", Setup: "X=$80", Want: "SP=$80"},
+	})
+}
+
+func TestInstructionCaseDiff(t *testing.T) {
+	ic := instructionCase{Asm: "LDA", All: true, Setup: "M=$01",
+		Want: "A=$02"}
+	vs, err := ic.variants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 8 || vs[0].Asm != "LDA ($20,X)" ||
+		vs[1].Asm != "LDA $10" || vs[2].Asm != "LDA #$01" {
+		t.Fatalf("unexpected variants %+v", vs)
+	}
+	d, err := vs[2].run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.String() != "A: $02 -> $01\n" {
+		t.Fatalf("unexpected diff\n%v", d)
+	}
+
+	ic = instructionCase{Asm: "INC $10", Want: "$0010=$02 Q=1"}
+	if _, err := ic.run(); err == nil ||
+		err.Error() != "want: invalid name: Q" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
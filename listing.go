@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listingLine is a single line of an assembler listing.
+type listingLine struct {
+	text    string // source text without address and bytes
+	address uint16 // valid when hasAddr is set
+	hasAddr bool   // line carries an address
+	bytes   int    // number of object bytes emitted by this line
+	first   byte   // first object byte, the opcode of instructions
+	macro   bool   // line is part of a macro expansion
+	listed  bool   // line is a source or macro line, not a page header
+	depth   int    // ca65 include depth, 0 for AS65
+	file    string // source file of the line, if known
+	source  int    // 1 based line in file, 0 when not a source line
+}
+
+// sourceKey is a line of a source file.
+type sourceKey struct {
+	file string // base name
+	line int
+}
+
+// Listing is a parsed AS65 or ca65 assembler listing.  It maps addresses to
+// listing lines, source lines and back and records the labels that were
+// defined.
+type Listing struct {
+	Path       string
+	lines      []listingLine
+	byAddr     map[uint16]int    // address to first line that emitted code
+	statements map[uint16]int    // address to line of the statement
+	bySource   map[sourceKey]int // source line to listing line
+	symbols    *Symbols          // labels
+}
+
+// parseAS65Line parses a single AS65 listing line.  AS65 uses fixed columns:
+// a 4 digit address, " : " or " = ", the object bytes and a macro expansion
+// marker in column 23 followed by the source text in column 24.
+func parseAS65Line(s string) listingLine {
+	const (
+		markerColumn = 23
+		sourceColumn = 24
+	)
+
+	l := listingLine{listed: true}
+	if len(s) > markerColumn && s[markerColumn] == '>' {
+		l.macro = true
+	}
+	if len(s) > sourceColumn {
+		l.text = s[sourceColumn:]
+	}
+
+	if len(s) < 7 || (s[4:7] != " : " && s[4:7] != " = ") {
+		if len(s) <= markerColumn ||
+			strings.TrimSpace(s[:markerColumn]) != "" {
+			// not a listing line, e.g. a page header
+			l.text = s
+			l.macro = false
+			l.listed = false
+		}
+		return l
+	}
+	a, err := strconv.ParseUint(s[0:4], 16, 16)
+	if err != nil {
+		l.text = s
+		l.listed = false
+		return l
+	}
+	if s[4:7] == " = " {
+		// equates and org statements do not emit code
+		return l
+	}
+	l.address = uint16(a)
+	l.hasAddr = true
+
+	end := len(s)
+	if end > markerColumn {
+		end = markerColumn
+	}
+	b := strings.TrimSpace(s[7:end])
+	b = strings.TrimRight(b, ".") // truncated ds/db output
+	l.bytes = len(b) / 2
+	if l.bytes > 0 {
+		if v, err := strconv.ParseUint(b[:2], 16, 8); err == nil {
+			l.first = byte(v)
+		}
+	}
+
+	return l
+}
+
+// parseCA65Line parses a single ca65 listing line.  ca65 uses fixed columns
+// as well: a 6 digit address, "r" for relocatable addresses, the include
+// depth, up to four object bytes and the source text in column 24.
+// Relocatable addresses are offsets into a segment and are not used.
+func parseCA65Line(s string) listingLine {
+	const sourceColumn = 24
+
+	var l listingLine
+	if len(s) < 10 || s[6] != ' ' && s[6] != 'r' || s[7] != ' ' {
+		l.text = s
+		return l
+	}
+	a, err := strconv.ParseUint(s[0:6], 16, 32)
+	if err != nil || a > 0xffff {
+		l.text = s
+		return l
+	}
+	end := len(s)
+	if end > sourceColumn {
+		end = sourceColumn
+		l.text = s[sourceColumn:]
+	}
+	f := strings.Fields(s[8:end])
+	if len(f) == 0 {
+		l.text = s
+		return l
+	}
+	l.depth, err = strconv.Atoi(f[0])
+	if err != nil {
+		l.text = s
+		return l
+	}
+	l.listed = true
+	l.bytes = len(f) - 1
+	if s[6] == 'r' {
+		return l
+	}
+	l.address = uint16(a)
+	l.hasAddr = true
+	if l.bytes > 0 {
+		if v, err := strconv.ParseUint(f[1], 16, 8); err == nil {
+			l.first = byte(v)
+		}
+	}
+	return l
+}
+
+// label returns the label defined on the line, if any.
+func (l listingLine) label() string {
+	if !l.hasAddr || l.text == "" {
+		return ""
+	}
+	if l.text[0] == ' ' || l.text[0] == '\t' || l.text[0] == ';' {
+		return ""
+	}
+	f := strings.Fields(l.text)
+	if len(f) == 0 {
+		return ""
+	}
+	name := strings.TrimSuffix(f[0], ":")
+	if strings.ContainsAny(name, `\?`) {
+		// macro local label
+		return ""
+	}
+	return name
+}
+
+// mnemonics holds the upper case mnemonics of all valid opcodes.
+var mnemonics = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, o := range opcodes {
+		if o != invalidOpcode {
+			m[o.mnemonic] = true
+		}
+	}
+	return m
+}()
+
+// instruction returns true if the line emitted an instruction, as opposed to
+// data.
+func (l listingLine) instruction() bool {
+	if !l.hasAddr || l.bytes == 0 {
+		return false
+	}
+	text, _, _ := strings.Cut(l.text, ";")
+	f := strings.Fields(text)
+	for i := 0; i < len(f) && i < 2; i++ {
+		if mnemonics[strings.ToUpper(f[i])] {
+			return true
+		}
+	}
+	return false
+}
+
+// as65Banner returns the source file named by an AS65 file banner such as
+// "------ 6502_functional_test.a65 ------".
+func as65Banner(s string) (string, bool) {
+	f := strings.Fields(s)
+	if len(f) != 3 || strings.Trim(f[0], "-") != "" ||
+		strings.Trim(f[2], "-") != "" || f[0] == "" {
+		return "", false
+	}
+	return f[1], true
+}
+
+// as65Sources numbers the source lines of an AS65 listing.  A file banner
+// starts or resumes a source file.  Macro expansions and the blank line
+// that ends them are not source lines.
+func (l *Listing) as65Sources() {
+	var (
+		file  string
+		next  = make(map[string]int)
+		macro bool
+	)
+	for i := range l.lines {
+		ll := &l.lines[i]
+		if name, ok := as65Banner(ll.text); ok && !ll.listed {
+			file = name
+			continue
+		}
+		wasMacro := macro
+		macro = ll.macro
+		if file == "" || !ll.listed || ll.macro ||
+			wasMacro && strings.TrimSpace(ll.text) == "" &&
+				!ll.hasAddr {
+			continue
+		}
+		next[file]++
+		ll.file = file
+		ll.source = next[file]
+	}
+}
+
+// ca65Sources numbers the source lines of a ca65 listing.  Lines of include
+// depth 1 belong to the main file, deeper ones to the file of the .include
+// directive that preceded them.  Lines without source text continue the
+// object bytes of the line before.
+func (l *Listing) ca65Sources() {
+	var (
+		files []string // by include depth
+		next  = make(map[string]int)
+		last  string // text of the previous source line
+	)
+	for i := range l.lines {
+		ll := &l.lines[i]
+		if !ll.listed {
+			if name, ok := strings.CutPrefix(ll.text,
+				"Main file   :"); ok {
+				files = []string{strings.TrimSpace(name)}
+			}
+			continue
+		}
+		if ll.text == "" && ll.bytes > 0 {
+			continue
+		}
+		if ll.depth > len(files) {
+			f := strings.Fields(last)
+			name := ""
+			if len(f) == 2 && strings.EqualFold(f[0], ".include") {
+				name = strings.Trim(f[1], `"`)
+			}
+			files = append(files, name)
+		}
+		if ll.depth < 1 {
+			continue
+		}
+		files = files[:ll.depth]
+		last = ll.text
+		if file := files[ll.depth-1]; file != "" {
+			next[file]++
+			ll.file = file
+			ll.source = next[file]
+		}
+	}
+}
+
+// parseListing reads an AS65 or ca65 listing.
+func parseListing(r io.Reader) (*Listing, error) {
+	l := Listing{
+		byAddr:     make(map[uint16]int),
+		statements: make(map[uint16]int),
+		bySource:   make(map[sourceKey]int),
+		symbols:    NewSymbols(),
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 4096), 1024*1024)
+	parse, ca65 := parseAS65Line, false
+	for s.Scan() {
+		text := strings.TrimRight(s.Text(), "\r")
+		if len(l.lines) == 0 && strings.HasPrefix(text, "ca65 ") {
+			parse, ca65 = parseCA65Line, true
+		}
+		ll := parse(text)
+		i := len(l.lines)
+		l.lines = append(l.lines, ll)
+		if !ll.hasAddr {
+			continue
+		}
+		if ll.bytes > 0 {
+			if _, ok := l.byAddr[ll.address]; !ok {
+				l.byAddr[ll.address] = i
+			}
+		}
+		name := ll.label()
+		if ca65 && !strings.HasPrefix(ll.text, name+":") {
+			// ca65 lists equates with the current address
+			name = ""
+		}
+		if name != "" {
+			l.symbols.Add(name, ll.address)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if ca65 {
+		l.ca65Sources()
+	} else {
+		l.as65Sources()
+	}
+	l.mapStatements(ca65)
+
+	return &l, nil
+}
+
+// mapStatements maps the addresses of the object bytes of every line to the
+// statement that generated them: the line itself or, for macro expansions,
+// the line that invoked the macro.  ca65 lists at most a few bytes per line
+// so its lines extend to the next line with an address.
+func (l *Listing) mapStatements(extend bool) {
+	statement := 0
+	for i, ll := range l.lines {
+		if !ll.macro && ll.listed &&
+			(ll.text != "" || ll.bytes == 0) {
+			statement = i + 1
+		}
+		if ll.source > 0 {
+			key := sourceKey{filepath.Base(ll.file), ll.source}
+			l.bySource[key] = i + 1
+		}
+		if !ll.hasAddr || ll.bytes == 0 {
+			continue
+		}
+		end := int(ll.address) + ll.bytes
+		if extend {
+			for _, n := range l.lines[i+1:] {
+				if n.hasAddr {
+					if int(n.address) > end {
+						end = int(n.address)
+					}
+					break
+				}
+			}
+		}
+		for a := int(ll.address); a < end && a <= 0xffff; a++ {
+			if _, ok := l.statements[uint16(a)]; !ok {
+				l.statements[uint16(a)] = statement
+			}
+		}
+	}
+}
+
+// loadListing reads the AS65 listing at path.
+func loadListing(path string) (*Listing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l, err := parseListing(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	l.Path = path
+
+	return l, nil
+}
+
+// Line returns the 1 based listing line that generated the code at address.
+func (l *Listing) Line(address uint16) (int, bool) {
+	i, ok := l.byAddr[address]
+	if !ok {
+		return 0, false
+	}
+	return i + 1, true
+}
+
+// Origin returns the lowest address the listing emitted code or data at,
+// which is where a binary of just the assembled bytes is loaded.
+func (l *Listing) Origin() (uint16, bool) {
+	origin, ok := uint16(0), false
+	for a := range l.byAddr {
+		if !ok || a < origin {
+			origin, ok = a, true
+		}
+	}
+	return origin, ok
+}
+
+// Text returns the source text of the 1 based listing line.
+func (l *Listing) Text(line int) string {
+	if line < 1 || line > len(l.lines) {
+		return ""
+	}
+	return l.lines[line-1].text
+}
+
+// Address returns the address of the first code emitted at or after the 1
+// based listing line.  The line that emitted the code is returned as well.
+func (l *Listing) Address(line int) (uint16, int, bool) {
+	if line < 1 {
+		line = 1
+	}
+	for i := line - 1; i < len(l.lines); i++ {
+		ll := l.lines[i]
+		if ll.hasAddr && ll.bytes > 0 {
+			return ll.address, i + 1, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Statement returns the 1 based listing line of the statement that
+// generated the code at address.  Code of a macro expansion belongs to the
+// line that invoked the macro.
+func (l *Listing) Statement(address uint16) (int, bool) {
+	line, ok := l.statements[address]
+	return line, ok
+}
+
+// Source returns the source file and line of the statement that generated
+// the code at address.
+func (l *Listing) Source(address uint16) (string, int, bool) {
+	line, ok := l.Statement(address)
+	if !ok || l.lines[line-1].source == 0 {
+		return "", 0, false
+	}
+	ll := l.lines[line-1]
+	return ll.file, ll.source, true
+}
+
+// SourceLine returns the 1 based listing line of line in the source file.
+// Files are matched by base name.
+func (l *Listing) SourceLine(file string, line int) (int, bool) {
+	i, ok := l.bySource[sourceKey{filepath.Base(file), line}]
+	return i, ok
+}
+
+// Location returns the address of the first code at or after file:line.
+// file may be the listing itself or one of its source files.  The listing
+// line that emitted the code is returned as well.
+func (l *Listing) Location(file string, line int) (uint16, int, error) {
+	if !sameFile(file, l.Path) {
+		ll, ok := l.SourceLine(file, line)
+		if !ok {
+			return 0, 0, fmt.Errorf("no line %v in %v", line, file)
+		}
+		line = ll
+	}
+	a, ll, ok := l.Address(line)
+	if !ok {
+		return 0, 0, fmt.Errorf("no code at or after %v:%v", file, line)
+	}
+	return a, ll, nil
+}
+
+// ParseLocation parses a file:line location, see Location.
+func (l *Listing) ParseLocation(s string) (uint16, int, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("expected file:line: %v", s)
+	}
+	line, err := strconv.Atoi(s[i+1:])
+	if err != nil || line < 1 {
+		return 0, 0, fmt.Errorf("invalid line: %v", s)
+	}
+	return l.Location(s[:i], line)
+}
+
+// Context describes the source of the code at address: the file and line
+// of the statement followed by its text, and for macro expansions the
+// expanded line, e.g.
+//
+//	6502_functional_test.a65:1560: set_a 1,$ff     ;push
+//	  > lda #$ff ;allow test to change I-flag (no mask)
+func (l *Listing) Context(address uint16) string {
+	line, ok := l.Statement(address)
+	if !ok {
+		return fmt.Sprintf("$%04X: no source", address)
+	}
+	st := l.lines[line-1]
+	var b strings.Builder
+	if st.source > 0 {
+		fmt.Fprintf(&b, "%v:%v: ", st.file, st.source)
+	} else {
+		fmt.Fprintf(&b, "%v:%v: ", filepath.Base(l.Path), line)
+	}
+	b.WriteString(strings.TrimSpace(st.text))
+	if at, ok := l.Line(address); ok && at != line {
+		fmt.Fprintf(&b, "\n  > %v",
+			strings.TrimSpace(l.lines[at-1].text))
+	}
+	return b.String()
+}
+
+// statementName returns the first word of a statement that is not a label,
+// the mnemonic, directive or macro name.
+func (ll listingLine) statementName() string {
+	text, _, _ := strings.Cut(ll.text, ";")
+	f := strings.Fields(text)
+	if len(f) > 0 && ll.label() != "" {
+		f = f[1:]
+	}
+	if len(f) == 0 {
+		return ""
+	}
+	return f[0]
+}
+
+// MacroAddress returns the address of the code of the first invocation of
+// macro, e.g. the success trap of a test.
+func (l *Listing) MacroAddress(macro string) (uint16, bool) {
+	for i, ll := range l.lines {
+		if ll.macro || !ll.listed || ll.statementName() != macro {
+			continue
+		}
+		if i+1 < len(l.lines) && !l.lines[i+1].macro {
+			continue // the macro definition or an empty macro
+		}
+		a, _, ok := l.Address(i + 2)
+		return a, ok
+	}
+	return 0, false
+}
+
+// Heading returns the comment that names the section of the code at
+// address: the first comment line after the last invocation of marker
+// before the code.  Sections of the functional tests are separated by
+// next_test.
+func (l *Listing) Heading(address uint16, marker string) (string, bool) {
+	line, ok := l.Statement(address)
+	if !ok {
+		return "", false
+	}
+	start := 0
+	for i := line - 1; i >= 0; i-- {
+		ll := l.lines[i]
+		if !ll.macro && ll.listed && ll.statementName() == marker {
+			start = i + 1
+			break
+		}
+	}
+	for _, ll := range l.lines[start : line-1] {
+		if ll.macro || !ll.listed {
+			continue
+		}
+		if text := strings.TrimSpace(ll.text); strings.HasPrefix(
+			ll.text, ";") && strings.Trim(text, "; ") != "" {
+			return text, true
+		}
+	}
+	return "", false
+}
+
+// Label returns the address of label.
+func (l *Listing) Label(name string) (uint16, bool) {
+	return l.symbols.Label(name)
+}
+
+// Symbol returns the closest label at or below address and the offset from
+// it.
+func (l *Listing) Symbol(address uint16) (string, uint16, bool) {
+	return l.symbols.Symbol(address)
+}
+
+// Symbols returns the labels of the listing.
+func (l *Listing) Symbols() *Symbols {
+	if l == nil {
+		return nil
+	}
+	return l.symbols
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestListingKlausDormann(t *testing.T) {
+	l, err := loadListing("test/6502_functional_test.lst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, ok := l.Label("start")
+	if !ok || a != 0x0400 {
+		t.Fatalf("unexpected start label %04x %v", a, ok)
+	}
+
+	line, ok := l.Line(0x3399)
+	if !ok {
+		t.Fatalf("no line for $3399")
+	}
+	if !strings.Contains(l.Text(line), "jmp *") {
+		t.Fatalf("unexpected text %q", l.Text(line))
+	}
+	if !l.lines[line-1].macro {
+		t.Fatalf("expected macro expansion")
+	}
+
+	// line before the jmp * is the success macro invocation
+	a, bl, ok := l.Address(line - 1)
+	if !ok || a != 0x3399 || bl != line {
+		t.Fatalf("unexpected address %04x line %v %v", a, bl, ok)
+	}
+
+	name, offset, ok := l.Symbol(0x0402)
+	if !ok || name != "start" || offset != 2 {
+		t.Fatalf("unexpected symbol %v+%v %v", name, offset, ok)
+	}
+
+	// the zero page is filled from $0000
+	if a, ok := l.Origin(); !ok || a != 0 {
+		t.Fatalf("unexpected origin %04x %v", a, ok)
+	}
+}
+
+func TestListingLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		address uint16
+		hasAddr bool
+		bytes   int
+		macro   bool
+		label   string
+	}{
+		{
+			line:    "0400 : d8               start   cld",
+			address: 0x0400,
+			hasAddr: true,
+			bytes:   1,
+			label:   "start",
+		},
+		{
+			line:    "3399 : 4c9933          >        jmp *           ;test passed",
+			address: 0x3399,
+			hasAddr: true,
+			bytes:   3,
+			macro:   true,
+		},
+		{
+			line: "0001 =                  ROM_vectors = 1",
+		},
+		{
+			line: "                        ; comment",
+		},
+		{
+			line:    "0000 : 00000000000000..         ds  zero_page",
+			hasAddr: true,
+			bytes:   7,
+		},
+		{
+			line: "AS65 Assembler for R6502 [1.42].",
+		},
+	}
+	for _, tt := range tests {
+		l := parseAS65Line(tt.line)
+		if l.address != tt.address || l.hasAddr != tt.hasAddr ||
+			l.bytes != tt.bytes || l.macro != tt.macro ||
+			l.label() != tt.label {
+			t.Fatalf("unexpected parse of %q: %+v label %q", tt.line,
+				l, l.label())
+		}
+	}
+}
+
+func TestListingSource(t *testing.T) {
+	l, err := loadListing("test/6502_functional_test.lst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AS65 counts 5803 source lines, the last one is "end start"
+	line, ok := l.SourceLine("6502_functional_test.a65", 5803)
+	if !ok || !strings.Contains(l.Text(line), "end start") {
+		t.Fatalf("unexpected last line %v %q", line, l.Text(line))
+	}
+
+	// the push test expands set_a 1,$ff
+	file, n, ok := l.Source(0x073b)
+	if !ok || file != "6502_functional_test.a65" || n != 1286 {
+		t.Fatalf("unexpected source %v:%v %v", file, n, ok)
+	}
+	a, _, err := l.ParseLocation("test/6502_functional_test.a65:1286")
+	if err != nil || a != 0x0739 {
+		t.Fatalf("unexpected location $%04X %v", a, err)
+	}
+	s1, _ := l.Statement(0x0739)
+	s2, _ := l.Statement(0x073e)
+	if s1 != s2 || !strings.Contains(l.Text(s1), "set_a 1,$ff") {
+		t.Fatalf("unexpected statements %v %v", s1, s2)
+	}
+
+	want := "6502_functional_test.a65:5133: success         " +
+		";if you get here everything went well\n" +
+		"  > jmp *           ;test passed, no errors"
+	if c := l.Context(0x3399); c != want {
+		t.Fatalf("unexpected context %q", c)
+	}
+	if _, _, err := l.ParseLocation("other.a65:10"); err == nil {
+		t.Fatalf("expected unknown file")
+	}
+}
+
+func TestListingCA65(t *testing.T) {
+	l, err := parseListing(strings.NewReader(
+		"ca65 V2.19 - Git 4a3d5d2\n" +
+			"Main file   : main.s\n" +
+			"Current file: main.s\n" +
+			"\n" +
+			"000400  1               .org $0400\n" +
+			"000400  1  A2 00        start:  ldx #0\n" +
+			"000402  1               count = 3\n" +
+			"000402  1  E8 E8 E8 E8          inc5\n" +
+			"000406  1  E8\n" +
+			"000407  1               .include \"sub.inc\"\n" +
+			"000407  2  60           sub:    rts\n" +
+			"000408  1  4C 08 04     done:   jmp done\n" +
+			"000000r 1  EA           reloc:  nop\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]uint16{
+		"start": 0x0400, "sub": 0x0407, "done": 0x0408,
+	} {
+		if a, ok := l.Label(name); !ok || a != want {
+			t.Fatalf("%v = $%04X %v", name, a, ok)
+		}
+	}
+	if _, ok := l.Label("count"); ok {
+		t.Fatalf("equate defined as label")
+	}
+	if _, ok := l.Label("reloc"); ok {
+		t.Fatalf("relocatable label defined")
+	}
+
+	// the continued macro invocation covers $0402-$0406
+	s1, _ := l.Statement(0x0402)
+	s2, ok := l.Statement(0x0406)
+	if !ok || s1 != s2 || !strings.Contains(l.Text(s1), "inc5") {
+		t.Fatalf("unexpected statements %v %v", s1, s2)
+	}
+	for a, want := range map[uint16]string{
+		0x0400: "main.s:2", 0x0406: "main.s:4", 0x0407: "sub.inc:1",
+		0x0408: "main.s:6",
+	} {
+		file, line, ok := l.Source(a)
+		if got := fmt.Sprintf("%v:%v", file, line); !ok || got != want {
+			t.Fatalf("$%04X: expected %v, got %v", a, want, got)
+		}
+	}
+}
+
+func TestListingSections(t *testing.T) {
+	l, err := loadListing("test/6502_functional_test.lst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, ok := l.MacroAddress("success")
+	if !ok || a != 0x3399 {
+		t.Fatalf("unexpected success $%04X %v", a, ok)
+	}
+	if _, ok := l.MacroAddress("nothere"); ok {
+		t.Fatalf("found unknown macro")
+	}
+	for address, want := range map[uint16]string{
+		0x052a: ";testing relative addressing with BEQ",
+		0x153b: "; LDY / STY - zp / abs / #",
+	} {
+		h, ok := l.Heading(address, "next_test")
+		if !ok || h != want {
+			t.Fatalf("$%04X: unexpected heading %q", address, h)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/marcopeereboom/toy6502/loader"
+)
+
+// StartFrom selects how loading an image sets PC.
+type StartFrom int
+
+const (
+	StartNone   StartFrom = iota // leave PC alone
+	StartRecord                  // start address record of the file
+	StartReset                   // RESET vector after loading
+)
+
+// LoadImage copies img into memory and sets PC as selected by start.
+func (c *CPU) LoadImage(img *loader.Image, start StartFrom) error {
+	if start == StartRecord && !img.HasStart {
+		return fmt.Errorf("no start address")
+	}
+	for _, s := range img.Segments {
+		copy(c.memory[s.Address:], s.Data)
+	}
+	switch start {
+	case StartRecord:
+		c.pc = img.Start
+	case StartReset:
+		c.pc = c.resetVector()
+	}
+	return nil
+}
+
+// LoadFile loads the image in path, see loader.Read and LoadImage.
+func (c *CPU) LoadFile(path string, format loader.Format, address uint16,
+	start StartFrom) error {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	img, err := loader.Read(bytes.NewReader(b), format, address)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	if err := c.LoadImage(img, start); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+// Package loader reads program images in raw, PRG, Intel HEX and
+// Motorola S-record format.
+package loader
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Format is the file format of a program image.
+type Format int
+
+const (
+	FormatRaw      Format = iota // bytes loaded at a given address
+	FormatIntelHex               // Intel HEX
+	FormatSRecord                // Motorola S-record
+	FormatPRG                    // two byte load address, then bytes
+)
+
+// ParseFormat returns the image format named s.
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "raw", "bin":
+		return FormatRaw, nil
+	case "ihex", "hex":
+		return FormatIntelHex, nil
+	case "srec":
+		return FormatSRecord, nil
+	case "prg":
+		return FormatPRG, nil
+	}
+	return 0, fmt.Errorf("invalid image format: %v", s)
+}
+
+// FormatOf returns the image format of path by its extension, raw when
+// unknown.
+func FormatOf(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".hex", ".ihx", ".ihex":
+		return FormatIntelHex
+	case ".srec", ".s19", ".s28", ".s37", ".mot":
+		return FormatSRecord
+	case ".prg":
+		return FormatPRG
+	}
+	return FormatRaw
+}
+
+// Segment is a contiguous run of bytes of an image.
+type Segment struct {
+	Address uint16
+	Data    []byte
+}
+
+// Image is a program read from a file.
+type Image struct {
+	Segments []Segment
+	Start    uint16 // start address, valid if HasStart
+	HasStart bool
+
+	used []bool // bytes covered by segments
+}
+
+// add adds data at address.  Data beyond the 64K address space and data
+// that overlaps earlier segments are errors.
+func (img *Image) add(address uint32, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	end := address + uint32(len(data)) - 1
+	if end > 0xffff {
+		return fmt.Errorf("$%04X-$%X out of range", address, end)
+	}
+	if img.used == nil {
+		img.used = make([]bool, 65536)
+	}
+	for a := address; a <= end; a++ {
+		if img.used[a] {
+			return fmt.Errorf("$%04X-$%04X overlaps at $%04X",
+				address, end, a)
+		}
+		img.used[a] = true
+	}
+	// Contiguous data extends the last segment.
+	if n := len(img.Segments); n > 0 {
+		s := &img.Segments[n-1]
+		if uint32(s.Address)+uint32(len(s.Data)) == address {
+			s.Data = append(s.Data, data...)
+			return nil
+		}
+	}
+	img.Segments = append(img.Segments, Segment{
+		Address: uint16(address),
+		Data:    append([]byte(nil), data...),
+	})
+	return nil
+}
+
+// setStart records start address a.
+func (img *Image) setStart(a uint32) error {
+	if a > 0xffff {
+		return fmt.Errorf("start address $%X out of range", a)
+	}
+	img.Start = uint16(a)
+	img.HasStart = true
+	return nil
+}
+
+// hexRecord decodes the hex digits of a record.
+func hexRecord(s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex digits")
+	}
+	return b, nil
+}
+
+// readIntelHex reads records of type 00 (data), 01 (end of file), 02
+// (extended segment address), 03 (start segment address), 04 (extended
+// linear address) and 05 (start linear address).
+func readIntelHex(r io.Reader) (*Image, error) {
+	img := &Image{}
+	var base uint32
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] != ':' {
+			return nil, fmt.Errorf("line %v: missing start code", n)
+		}
+		b, err := hexRecord(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		if len(b) < 5 || len(b) != int(b[0])+5 {
+			return nil, fmt.Errorf("line %v: invalid length", n)
+		}
+		var sum byte
+		for _, v := range b {
+			sum += v
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("line %v: invalid checksum", n)
+		}
+		address := uint32(b[1])<<8 | uint32(b[2])
+		data := b[4 : len(b)-1]
+		word := func() (uint32, error) {
+			if len(data) != 2 && len(data) != 4 {
+				return 0, fmt.Errorf("line %v: invalid record "+
+					"length", n)
+			}
+			var v uint32
+			for _, d := range data {
+				v = v<<8 | uint32(d)
+			}
+			return v, nil
+		}
+
+		switch b[3] {
+		case 0x00:
+			err = img.add(base+address, data)
+		case 0x01:
+			return img, nil
+		case 0x02, 0x04:
+			var v uint32
+			v, err = word()
+			if b[3] == 0x02 {
+				base = v << 4
+			} else {
+				base = v << 16
+			}
+		case 0x03:
+			var v uint32
+			v, err = word()
+			if err == nil {
+				// CS:IP
+				err = img.setStart(v>>16<<4 + v&0xffff)
+			}
+		case 0x05:
+			var v uint32
+			v, err = word()
+			if err == nil {
+				err = img.setStart(v)
+			}
+		default:
+			err = fmt.Errorf("invalid record type %02X", b[3])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+	}
+	return img, s.Err()
+}
+
+// readSRecord reads S0 (header), S1-S3 (data), S5-S6 (count) and S7-S9
+// (start address) records.
+func readSRecord(r io.Reader) (*Image, error) {
+	img := &Image{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if len(line) < 4 || line[0] != 'S' {
+			return nil, fmt.Errorf("line %v: missing start code", n)
+		}
+		b, err := hexRecord(line[2:])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		if len(b) != int(b[0])+1 {
+			return nil, fmt.Errorf("line %v: invalid length", n)
+		}
+		var sum byte
+		for _, v := range b[:len(b)-1] {
+			sum += v
+		}
+		if ^sum != b[len(b)-1] {
+			return nil, fmt.Errorf("line %v: invalid checksum", n)
+		}
+
+		var size int // address bytes
+		switch line[1] {
+		case '0', '1', '5', '9':
+			size = 2
+		case '2', '6', '8':
+			size = 3
+		case '3', '7':
+			size = 4
+		default:
+			return nil, fmt.Errorf("line %v: invalid record type "+
+				"S%c", n, line[1])
+		}
+		if len(b) < size+2 {
+			return nil, fmt.Errorf("line %v: invalid length", n)
+		}
+		var address uint32
+		for _, v := range b[1 : 1+size] {
+			address = address<<8 | uint32(v)
+		}
+		data := b[1+size : len(b)-1]
+
+		switch line[1] {
+		case '1', '2', '3':
+			err = img.add(address, data)
+		case '7', '8', '9':
+			err = img.setStart(address)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+	}
+	return img, s.Err()
+}
+
+// Read reads a program image in format from r.  Raw images are placed at
+// address.
+func Read(r io.Reader, format Format, address uint16) (*Image, error) {
+	switch format {
+	case FormatIntelHex:
+		return readIntelHex(r)
+	case FormatSRecord:
+		return readSRecord(r)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	a := uint32(address)
+	if format == FormatPRG {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("missing load address")
+		}
+		a = uint32(data[0]) | uint32(data[1])<<8
+		data = data[2:]
+	}
+	img := &Image{}
+	if err := img.add(a, data); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
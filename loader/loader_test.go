@@ -0,0 +1,81 @@
+package loader
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadIntelHex(t *testing.T) {
+	img, err := Read(strings.NewReader(
+		":03040000010203F3\n"+
+			":020403000405EE\n"+
+			":020000040000FA\n"+
+			":0410000500000400E3\n"+
+			":00000001FF\n"), FormatIntelHex, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Segments) != 1 || img.Segments[0].Address != 0x0400 ||
+		!bytes.Equal(img.Segments[0].Data, []byte{1, 2, 3, 4, 5}) {
+		t.Fatalf("segments %+v", img.Segments)
+	}
+	if !img.HasStart || img.Start != 0x0400 {
+		t.Fatalf("start %v %04X", img.HasStart, img.Start)
+	}
+}
+
+func TestReadSRecord(t *testing.T) {
+	img, err := Read(strings.NewReader(
+		"S00600004844521B\n"+
+			"S1060400010203EF\n"+
+			"S1050500AABB90\n"+
+			"S9030400F8\n"), FormatSRecord, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Segments) != 2 || img.Segments[1].Address != 0x0500 ||
+		!bytes.Equal(img.Segments[0].Data, []byte{1, 2, 3}) {
+		t.Fatalf("segments %+v", img.Segments)
+	}
+	if !img.HasStart || img.Start != 0x0400 {
+		t.Fatalf("start %v %04X", img.HasStart, img.Start)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		image  string
+		err    string
+	}{
+		{"ihex checksum", FormatIntelHex, ":03040000010203F4\n",
+			"line 1: invalid checksum"},
+		{"ihex overlap", FormatIntelHex,
+			":03040000010203F3\n:020402000405EF\n",
+			"line 2: $0402-$0403 overlaps at $0402"},
+		{"ihex range", FormatIntelHex,
+			":020000040001F9\n:0100000001FE\n",
+			"line 2: $10000-$10000 out of range"},
+		{"ihex type", FormatIntelHex, ":00000006FA\n",
+			"invalid record type 06"},
+		{"srec checksum", FormatSRecord, "S1060400010203EE\n",
+			"line 1: invalid checksum"},
+		{"srec range", FormatSRecord, "S2060100000102F5\n",
+			"out of range"},
+		{"srec overlap", FormatSRecord,
+			"S1060400010203EF\nS1060402010203ED\n",
+			"line 2: $0402-$0404 overlaps at $0402"},
+		{"prg short", FormatPRG, "\x01", "missing load address"},
+		{"raw range", FormatRaw, "\x01\x02\x03", "out of range"},
+	}
+	for _, test := range tests {
+		_, err := Read(strings.NewReader(test.image), test.format,
+			0xfffe)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%v: expected %q, got %v", test.name, test.err,
+				err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/marcopeereboom/toy6502/loader"
+)
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	prg := filepath.Join(dir, "test.prg")
+	err := os.WriteFile(prg, []byte{0x01, 0x08, 0xea, 0x60}, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New()
+	c.memory[0xfffc] = 0x01
+	c.memory[0xfffd] = 0x08
+	if err := c.load(prg, 0); err != nil {
+		t.Fatal(err)
+	}
+	if c.memory[0x0801] != 0xea || c.memory[0x0802] != 0x60 {
+		t.Fatalf("prg not loaded")
+	}
+	err = c.LoadFile(prg, loader.FormatPRG, 0, StartRecord)
+	if err == nil {
+		t.Fatalf("expected missing start address")
+	}
+	err = c.LoadFile(prg, loader.FormatPRG, 0, StartReset)
+	if err != nil || c.pc != 0x0801 {
+		t.Fatalf("pc $%04X: %v", c.pc, err)
+	}
+
+	hex := filepath.Join(dir, "test.hex")
+	err = os.WriteFile(hex, []byte(":03040000010203F3\n"+
+		":0400000500000400F3\n:00000001FF\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.LoadFile(hex, loader.FormatOf(hex), 0, StartRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.pc != 0x0400 || c.memory[0x0402] != 0x03 {
+		t.Fatalf("pc $%04X", c.pc)
+	}
+
+	raw := filepath.Join(dir, "test.bin")
+	if err := os.WriteFile(raw, []byte{0xa9}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.load(raw, 0x2000); err != nil || c.memory[0x2000] != 0xa9 {
+		t.Fatalf("raw not loaded: %v", err)
+	}
+}
@@ -0,0 +1,783 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/marcopeereboom/toy6502/loader"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: toy6502 <command> [arguments]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "  cfg\twrite control flow graphs\n")
+	fmt.Fprintf(os.Stderr, "  clobbers\treport subroutine inputs and "+
+		"clobbers\n")
+	fmt.Fprintf(os.Stderr, "  cover\tmeasure code coverage\n")
+	fmt.Fprintf(os.Stderr, "  dap\tserve the Debug Adapter Protocol\n")
+	fmt.Fprintf(os.Stderr, "  diff\tcompare execution with a reference trace\n")
+	fmt.Fprintf(os.Stderr, "  profile\tprofile cycles per address and "+
+		"subroutine\n")
+	fmt.Fprintf(os.Stderr, "  run\trun a program until it stops\n")
+	fmt.Fprintf(os.Stderr, "  state\trun a program and save its state\n")
+	fmt.Fprintf(os.Stderr, "  timing\tcompute best and worst case cycles\n")
+	fmt.Fprintf(os.Stderr, "  vice\tserve the VICE binary monitor protocol\n")
+}
+
+func dapMain(args []string) error {
+	fs := flag.NewFlagSet("dap", flag.ExitOnError)
+	listen := fs.String("listen", "",
+		"serve on TCP address instead of stdin/stdout")
+	fs.Parse(args)
+
+	if *listen != "" {
+		return listenDAP(*listen)
+	}
+	return serveDAP(os.Stdin, os.Stdout)
+}
+
+func diffMain(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	load := fs.Uint("load", 0, "load address of raw binaries")
+	context := fs.Int("context", 5, "records shown around a divergence")
+	noCycles := fs.Bool("nocycles", false, "do not compare cycle counts")
+	mask := fs.Uint("pmask", uint(^Break),
+		"status register bits compared, B is ignored by default")
+	noSync := fs.Bool("nosync", false,
+		"do not load registers from the first reference record")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: toy6502 diff [flags] program reference")
+	}
+
+	c := New()
+	if err := c.load(fs.Arg(0), uint16(*load)); err != nil {
+		return err
+	}
+	c.pc = c.resetVector()
+
+	f, err := os.Open(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr, err := NewTraceReader(f)
+	if err != nil {
+		return err
+	}
+
+	d := TraceDiff{
+		Context:      *context,
+		IgnoreCycles: *noCycles,
+		IgnoreFlags:  ^byte(*mask),
+		CompareBreak: byte(*mask)&Break != 0,
+		Sync:         !*noSync,
+	}
+	dv, n, err := d.Run(c, tr)
+	if err != nil {
+		return fmt.Errorf("record %v: %v", n, err)
+	}
+	if dv != nil {
+		dv.Write(os.Stdout)
+		return fmt.Errorf("traces diverge")
+	}
+	fmt.Printf("%v records match\n", n)
+	return nil
+}
+
+// runInstructions executes up to n instructions and stops early on an
+// invalid opcode or a trap.
+func runInstructions(c *CPU, n uint64) {
+	h := c.Run(context.Background(), HaltAfterInstructions(n),
+		HaltOnJumpToSelf(), HaltOnBranchToSelf())
+	switch h.Kind {
+	case HaltInvalidOpcode:
+		fmt.Printf("invalid opcode $%02X at %v\n", c.memory[h.PC],
+			c.location(h.PC))
+	case HaltJumpToSelf, HaltBranchToSelf:
+		fmt.Printf("trap at %v\n", c.location(h.PC))
+	}
+}
+
+// writeFile creates path and writes it with write.
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// setSymbols names addresses of c with the labels of l and the comma
+// separated symbol files.
+func setSymbols(c *CPU, l *Listing, files string) error {
+	s := NewSymbols()
+	s.Merge(l.Symbols())
+	if files != "" {
+		for _, path := range strings.Split(files, ",") {
+			st, err := LoadSymbols(path)
+			if err != nil {
+				return err
+			}
+			s.Merge(st)
+		}
+	}
+	c.SetSymbols(s)
+	return nil
+}
+
+func cfgMain(args []string) error {
+	fs := flag.NewFlagSet("cfg", flag.ExitOnError)
+	load := fs.Uint("load", 0, "load address of raw binaries")
+	entry := fs.String("entry", "", "comma separated entry points, "+
+		"defaults to RESET vector")
+	listing := fs.String("listing", "", "AS65 listing with labels")
+	format := fs.String("format", "dot", "output format, dot or json")
+	callgraph := fs.Bool("callgraph", false,
+		"write the call graph instead of the control flow graphs")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: toy6502 cfg [flags] program")
+	}
+
+	c := New()
+	if err := c.load(fs.Arg(0), uint16(*load)); err != nil {
+		return err
+	}
+	entries := []uint16{c.resetVector()}
+	if *entry != "" {
+		entries = nil
+		for _, e := range strings.Split(*entry, ",") {
+			a, err := parseAddress(e)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, a)
+		}
+	}
+	var l *Listing
+	if *listing != "" {
+		var err error
+		l, err = loadListing(*listing)
+		if err != nil {
+			return err
+		}
+	}
+	g := BuildCFG(c, l, entries)
+
+	switch {
+	case *format == "json":
+		return g.WriteJSON(os.Stdout)
+	case *format != "dot":
+		return fmt.Errorf("unknown format: %v", *format)
+	case *callgraph:
+		return g.WriteCallGraphDOT(os.Stdout)
+	}
+	return g.WriteDOT(os.Stdout)
+}
+
+func clobbersMain(args []string) error {
+	fs := flag.NewFlagSet("clobbers", flag.ExitOnError)
+	load := fs.Uint("load", 0, "load address of raw binaries")
+	entry := fs.String("entry", "", "comma separated entry points, "+
+		"defaults to RESET vector")
+	start := fs.Int("start", -1, "start address with -run, defaults to "+
+		"RESET vector")
+	run := fs.Bool("run", false, "observe a run instead of analyzing "+
+		"statically")
+	instructions := fs.Uint64("instructions", 100000000,
+		"instructions to execute with -run, stops early on a trap")
+	listing := fs.String("listing", "", "AS65 listing with labels")
+	contractsFile := fs.String("contracts", "", "check declared inputs "+
+		"and clobbers from file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: toy6502 clobbers [flags] program")
+	}
+
+	c := New()
+	if err := c.load(fs.Arg(0), uint16(*load)); err != nil {
+		return err
+	}
+	var l *Listing
+	if *listing != "" {
+		var err error
+		l, err = loadListing(*listing)
+		if err != nil {
+			return err
+		}
+	}
+	var contracts []Contract
+	if *contractsFile != "" {
+		f, err := os.Open(*contractsFile)
+		if err != nil {
+			return err
+		}
+		contracts, err = parseContracts(f, l)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	var effects map[uint16]*Effects
+	if *run {
+		c.pc = c.resetVector()
+		if *start >= 0 {
+			c.pc = uint16(*start)
+		}
+		m := NewEffectMonitor()
+		c.Attach(m)
+		runInstructions(c, *instructions)
+		effects = m.All()
+	} else {
+		entries := []uint16{c.resetVector()}
+		if *entry != "" {
+			entries = nil
+			for _, e := range strings.Split(*entry, ",") {
+				a, err := parseAddress(e)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, a)
+			}
+		}
+		var err error
+		effects, err = AnalyzeEffects(BuildCFG(c, l, entries))
+		if err != nil {
+			return err
+		}
+	}
+	n, err := WriteEffects(os.Stdout, effects, l, contracts)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%v contracts violated", n)
+	}
+	return nil
+}
+
+func coverMain(args []string) error {
+	fs := flag.NewFlagSet("cover", flag.ExitOnError)
+	load := fs.Uint("load", 0, "load address of raw binaries")
+	start := fs.Int("start", -1, "start address, defaults to RESET vector")
+	instructions := fs.Uint64("instructions", 100000000,
+		"instructions to execute, stops early on a trap")
+	listing := fs.String("listing", "", "AS65 listing of the program")
+	symbols := fs.String("symbols", "", "comma separated symbol files")
+	lcov := fs.String("lcov", "", "write lcov tracefile to file")
+	annotate := fs.String("annotate", "",
+		"write the listing annotated with execution counts to file")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *listing == "" {
+		return fmt.Errorf("usage: toy6502 cover [flags] -listing file " +
+			"program")
+	}
+
+	l, err := loadListing(*listing)
+	if err != nil {
+		return err
+	}
+	c := New()
+	if err := c.load(fs.Arg(0), uint16(*load)); err != nil {
+		return err
+	}
+	if err := setSymbols(c, l, *symbols); err != nil {
+		return err
+	}
+	c.pc = c.resetVector()
+	if *start >= 0 {
+		c.pc = uint16(*start)
+	}
+	cv := NewCoverage()
+	c.Attach(cv)
+	runInstructions(c, *instructions)
+
+	if *lcov != "" {
+		err := writeFile(*lcov, func(w io.Writer) error {
+			return cv.WriteLcov(w, l, "toy6502")
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if *annotate != "" {
+		err := writeFile(*annotate, func(w io.Writer) error {
+			return cv.WriteAnnotated(w, l)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	s := cv.Summary(l)
+	fmt.Printf("lines: %v/%v (%.1f%%) branches: %v/%v (%.1f%%)\n",
+		s.LinesHit, s.Lines, percent(uint64(s.LinesHit), uint64(s.Lines)),
+		s.BranchesHit, s.Branches,
+		percent(uint64(s.BranchesHit), uint64(s.Branches)))
+	return nil
+}
+
+func profileMain(args []string) error {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	load := fs.Uint("load", 0, "load address of raw binaries")
+	start := fs.Int("start", -1, "start address, defaults to RESET vector")
+	instructions := fs.Uint64("instructions", 100000000,
+		"instructions to execute, stops early on a trap")
+	listing := fs.String("listing", "", "AS65 listing with labels")
+	symbols := fs.String("symbols", "", "comma separated symbol files")
+	top := fs.Int("top", 20, "hottest addresses shown, 0 for all")
+	pprof := fs.String("pprof", "", "write a pprof profile to file")
+	folded := fs.String("folded", "", "write folded stacks to file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: toy6502 profile [flags] program")
+	}
+
+	c := New()
+	if err := c.load(fs.Arg(0), uint16(*load)); err != nil {
+		return err
+	}
+	c.pc = c.resetVector()
+	if *start >= 0 {
+		c.pc = uint16(*start)
+	}
+	p := NewProfiler()
+	if *listing != "" {
+		l, err := loadListing(*listing)
+		if err != nil {
+			return err
+		}
+		p.Listing = l
+	}
+	if err := setSymbols(c, p.Listing, *symbols); err != nil {
+		return err
+	}
+	c.Attach(p)
+	runInstructions(c, *instructions)
+
+	if *pprof != "" {
+		if err := writeFile(*pprof, p.WritePprof); err != nil {
+			return err
+		}
+	}
+	if *folded != "" {
+		if err := writeFile(*folded, p.WriteFolded); err != nil {
+			return err
+		}
+	}
+	return p.WriteReport(os.Stdout, c, *top)
+}
+
+func stateMain(args []string) error {
+	fs := flag.NewFlagSet("state", flag.ExitOnError)
+	load := fs.Uint("load", 0, "load address of raw binaries")
+	start := fs.Int("start", -1, "start address, defaults to RESET vector")
+	restore := fs.String("restore", "",
+		"continue from a save state instead of loading a program")
+	instructions := fs.Uint64("instructions", 100000000,
+		"instructions to execute, stops early on a trap")
+	out := fs.String("o", "", "write the final state to file")
+	symbols := fs.String("symbols", "", "comma separated symbol files")
+	fs.Parse(args)
+
+	c := New()
+	switch {
+	case *restore != "" && fs.NArg() == 0:
+		f, err := os.Open(*restore)
+		if err != nil {
+			return err
+		}
+		err = c.LoadState(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %v", *restore, err)
+		}
+	case *restore == "" && fs.NArg() == 1:
+		if err := c.load(fs.Arg(0), uint16(*load)); err != nil {
+			return err
+		}
+		c.pc = c.resetVector()
+		if *start >= 0 {
+			c.pc = uint16(*start)
+		}
+	default:
+		return fmt.Errorf("usage: toy6502 state [flags] " +
+			"[-restore state | program]")
+	}
+	if err := setSymbols(c, nil, *symbols); err != nil {
+		return err
+	}
+
+	runInstructions(c, *instructions)
+
+	if *out != "" {
+		if err := writeFile(*out, c.SaveState); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%v cycles: %v\n", c.snapshot(), c.cycles)
+	return nil
+}
+
+// parseLoopBounds parses comma separated header=max or header=min:max loop
+// bounds.
+func parseLoopBounds(s string) (map[uint16]LoopBound, error) {
+	bounds := make(map[uint16]LoopBound)
+	if s == "" {
+		return bounds, nil
+	}
+	for _, b := range strings.Split(s, ",") {
+		header, n, ok := strings.Cut(b, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid loop bound: %v", b)
+		}
+		a, err := parseAddress(header)
+		if err != nil {
+			return nil, err
+		}
+		var lb LoopBound
+		if _, err := fmt.Sscanf(n, "%d:%d", &lb.Min, &lb.Max); err != nil {
+			if _, err := fmt.Sscanf(n, "%d", &lb.Max); err != nil {
+				return nil, fmt.Errorf("invalid loop bound: %v", b)
+			}
+			lb.Min = 1
+		}
+		bounds[a] = lb
+	}
+	return bounds, nil
+}
+
+func timingMain(args []string) error {
+	fs := flag.NewFlagSet("timing", flag.ExitOnError)
+	load := fs.Uint("load", 0, "load address of raw binaries")
+	entry := fs.String("entry", "", "subroutine entry point, defaults to "+
+		"RESET vector")
+	listing := fs.String("listing", "", "AS65 listing with labels")
+	loops := fs.String("loop", "", "comma separated loop bounds, "+
+		"header=max or header=min:max")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: toy6502 timing [flags] program")
+	}
+
+	c := New()
+	if err := c.load(fs.Arg(0), uint16(*load)); err != nil {
+		return err
+	}
+	start := c.resetVector()
+	if *entry != "" {
+		var err error
+		start, err = parseAddress(*entry)
+		if err != nil {
+			return err
+		}
+	}
+	bounds, err := parseLoopBounds(*loops)
+	if err != nil {
+		return err
+	}
+	var l *Listing
+	if *listing != "" {
+		l, err = loadListing(*listing)
+		if err != nil {
+			return err
+		}
+	}
+	t, err := AnalyzeTiming(BuildCFG(c, l, []uint16{start}), start, bounds)
+	if err != nil {
+		return err
+	}
+	return t.WriteReport(os.Stdout, l)
+}
+
+// Exit statuses of toy6502 run.  Stops listed with -ok exit with exitOK.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitTrap  = 3
+	exitBRK   = 4
+	exitJAM   = 5
+	exitLimit = 6
+)
+
+// exitStatus is an error that makes toy6502 exit with status.  Its message
+// has already been printed.
+type exitStatus struct {
+	status int
+}
+
+func (e *exitStatus) Error() string {
+	return fmt.Sprintf("exit status %v", e.status)
+}
+
+// haltStop returns the name of the stop of kind, as used by -ok, and its exit
+// status.
+func haltStop(kind HaltKind) (string, int) {
+	switch kind {
+	case HaltJumpToSelf, HaltBranchToSelf:
+		return "trap", exitTrap
+	case HaltBRK:
+		return "brk", exitBRK
+	case HaltInvalidOpcode:
+		return "jam", exitJAM
+	case HaltCycles, HaltInstructions:
+		return "limit", exitLimit
+	case HaltCanceled:
+		return "interrupted", exitError
+	}
+	return "pc", exitOK
+}
+
+// dumpMemory writes memory from start to end, inclusive, 16 bytes a line.
+func dumpMemory(w io.Writer, c *CPU, start, end uint16) {
+	for row := int(start) &^ 15; row <= int(end); row += 16 {
+		fmt.Fprintf(w, "%04X:", row)
+		for a := row; a < row+16 && a <= int(end); a++ {
+			if a < int(start) {
+				fmt.Fprintf(w, "   ")
+				continue
+			}
+			fmt.Fprintf(w, " %02X", c.memory[a])
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func runMain(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	format := fs.String("format", "", "image format raw, ihex, srec or "+
+		"prg, defaults to the file extension")
+	load := fs.Uint("load", 0, "load address of raw binaries")
+	start := fs.String("start", "", "start address, symbol or reset, "+
+		"defaults to the image start address or RESET vector")
+	instructions := fs.Uint64("instructions", 0,
+		"stop after instructions, 0 for no limit")
+	cycles := fs.Uint64("cycles", 0, "stop after cycles, 0 for no limit")
+	stop := fs.String("stop", "trap", "comma separated stop conditions, "+
+		"trap and brk; invalid opcodes (jam) always stop")
+	pcs := fs.String("pc", "", "comma separated addresses or symbols "+
+		"to stop at")
+	ok := fs.String("ok", "pc", "comma separated stops that exit with "+
+		"status 0: pc, trap, brk, jam or limit")
+	listing := fs.String("listing", "", "AS65 or ca65 listing with labels")
+	symbols := fs.String("symbols", "", "comma separated symbol files")
+	dump := fs.Bool("dump", false, "print the registers when stopped")
+	memory := fs.String("memory", "", "comma separated start-end memory "+
+		"ranges printed when stopped")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: toy6502 run [flags] program")
+	}
+
+	f := loader.FormatOf(fs.Arg(0))
+	if *format != "" {
+		var err error
+		f, err = loader.ParseFormat(*format)
+		if err != nil {
+			return err
+		}
+	}
+	r, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	img, err := loader.Read(r, f, uint16(*load))
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("%v: %v", fs.Arg(0), err)
+	}
+	c := New()
+	from := StartReset
+	if img.HasStart {
+		from = StartRecord
+	}
+	if err := c.LoadImage(img, from); err != nil {
+		return err
+	}
+
+	var l *Listing
+	if *listing != "" {
+		l, err = loadListing(*listing)
+		if err != nil {
+			return err
+		}
+	}
+	if err := setSymbols(c, l, *symbols); err != nil {
+		return err
+	}
+	switch *start {
+	case "":
+	case "reset":
+		c.pc = c.resetVector()
+	default:
+		c.pc, err = c.symbols.Resolve(*start)
+		if err != nil {
+			return err
+		}
+	}
+
+	var conditions []HaltCondition
+	if *instructions > 0 {
+		conditions = append(conditions,
+			HaltAfterInstructions(*instructions))
+	}
+	if *cycles > 0 {
+		conditions = append(conditions, HaltAfterCycles(*cycles))
+	}
+	for _, s := range strings.Split(*stop, ",") {
+		switch s {
+		case "trap":
+			conditions = append(conditions, HaltOnJumpToSelf(),
+				HaltOnBranchToSelf())
+		case "brk":
+			conditions = append(conditions, HaltOnBRK())
+		case "jam", "":
+		default:
+			return fmt.Errorf("invalid stop condition: %v", s)
+		}
+	}
+	if *pcs != "" {
+		var addresses []uint16
+		for _, s := range strings.Split(*pcs, ",") {
+			a, err := c.symbols.Resolve(s)
+			if err != nil {
+				return err
+			}
+			addresses = append(addresses, a)
+		}
+		conditions = append(conditions, HaltAtPC(addresses...))
+	}
+	success := make(map[string]bool)
+	for _, s := range strings.Split(*ok, ",") {
+		switch s {
+		case "pc", "trap", "brk", "jam", "limit":
+			success[s] = true
+		case "":
+		default:
+			return fmt.Errorf("invalid stop: %v", s)
+		}
+	}
+	type memoryRange struct{ start, end uint16 }
+	var ranges []memoryRange
+	if *memory != "" {
+		for _, s := range strings.Split(*memory, ",") {
+			from, to, found := strings.Cut(s, "-")
+			if !found {
+				to = from
+			}
+			a, err := c.symbols.Resolve(from)
+			if err != nil {
+				return err
+			}
+			b, err := c.symbols.Resolve(to)
+			if err != nil {
+				return err
+			}
+			if b < a {
+				return fmt.Errorf("invalid memory range: %v", s)
+			}
+			ranges = append(ranges, memoryRange{a, b})
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	h := c.Run(ctx, conditions...)
+	name, status := haltStop(h.Kind)
+	switch h.Kind {
+	case HaltInvalidOpcode:
+		fmt.Printf("invalid opcode $%02X", c.memory[h.PC])
+	case HaltCycles, HaltInstructions:
+		fmt.Printf("%v limit reached", h.Kind)
+	default:
+		fmt.Printf("%v", name)
+	}
+	fmt.Printf(" at %v after %v instructions, %v cycles\n",
+		c.location(h.PC), h.Instructions, c.cycles)
+	if *dump {
+		fmt.Println(c.snapshot())
+	}
+	for _, r := range ranges {
+		dumpMemory(os.Stdout, c, r.start, r.end)
+	}
+
+	if success[name] {
+		return nil
+	}
+	return &exitStatus{status: status}
+}
+
+func viceMain(args []string) error {
+	fs := flag.NewFlagSet("vice", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:6502", "TCP address")
+	load := fs.Uint("load", 0, "load address of raw binaries")
+	start := fs.Int("start", -1, "start address, defaults to RESET vector")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: toy6502 vice [flags] program")
+	}
+
+	c := New()
+	if err := c.load(fs.Arg(0), uint16(*load)); err != nil {
+		return err
+	}
+	c.pc = c.resetVector()
+	if *start >= 0 {
+		c.pc = uint16(*start)
+	}
+	return listenVICE(*listen, c, c.pc)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "cfg":
+		err = cfgMain(os.Args[2:])
+	case "clobbers":
+		err = clobbersMain(os.Args[2:])
+	case "cover":
+		err = coverMain(os.Args[2:])
+	case "dap":
+		err = dapMain(os.Args[2:])
+	case "diff":
+		err = diffMain(os.Args[2:])
+	case "profile":
+		err = profileMain(os.Args[2:])
+	case "run":
+		err = runMain(os.Args[2:])
+	case "state":
+		err = stateMain(os.Args[2:])
+	case "timing":
+		err = timingMain(os.Args[2:])
+	case "vice":
+		err = viceMain(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	var status *exitStatus
+	switch {
+	case errors.As(err, &status):
+		os.Exit(status.status)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitError)
+	}
+}
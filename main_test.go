@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHaltStop(t *testing.T) {
+	for kind, want := range map[HaltKind]string{
+		HaltJumpToSelf:    "trap",
+		HaltBranchToSelf:  "trap",
+		HaltBRK:           "brk",
+		HaltInvalidOpcode: "jam",
+		HaltCycles:        "limit",
+		HaltPC:            "pc",
+	} {
+		if name, _ := haltStop(kind); name != want {
+			t.Fatalf("%v: expected %v, got %v", kind, want, name)
+		}
+	}
+	if _, status := haltStop(HaltInstructions); status != exitLimit {
+		t.Fatalf("unexpected status %v", status)
+	}
+}
+
+func TestDumpMemory(t *testing.T) {
+	c := New()
+	for i := range 0x20 {
+		c.memory[0x0200+i] = byte(i)
+	}
+	var b bytes.Buffer
+	dumpMemory(&b, c, 0x020e, 0x0211)
+	want := "0200:" + string(bytes.Repeat([]byte("   "), 14)) +
+		" 0E 0F\n0210: 10 11\n"
+	if b.String() != want {
+		t.Fatalf("expected %q, got %q", want, b.String())
+	}
+}
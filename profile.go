@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Profiler is an Observer that accumulates instruction counts and cycles per
+// PC and per subroutine.  Subroutines are entered through JSR, BRK and
+// interrupts and end when their return address is pulled off the stack.
+type Profiler struct {
+	Listing *Listing // names subroutines without CPU symbols, optional
+
+	count  []uint64 // instructions executed by address
+	cycles []uint64 // cycles spent by address
+	calls  map[uint16]uint64
+
+	// Samples are kept per call stack and address.  A stack key holds
+	// the entry and call site of every frame, 2 bytes each.
+	frames  []profileFrame
+	samples map[profileSample]*[2]uint64
+
+	started bool
+	symbols *Symbols // of the profiled CPU
+	pc      uint16   // instruction being executed
+	opcode  byte
+	sp      byte   // stack pointer before the instruction
+	last    uint64 // cycle count after the previous instruction
+}
+
+// profileFrame is a subroutine on the profiler call stack.
+type profileFrame struct {
+	sp  byte   // stack pointer before the call
+	key string // stack key from the root to this frame
+}
+
+type profileSample struct {
+	stack string
+	pc    uint16
+}
+
+// profileCall is a decoded stack key entry.
+type profileCall struct {
+	entry uint16
+	site  uint16 // calling or interrupted instruction
+}
+
+// NewProfiler returns an empty profiler.
+func NewProfiler() *Profiler {
+	return &Profiler{
+		count:   make([]uint64, 65536),
+		cycles:  make([]uint64, 65536),
+		calls:   make(map[uint16]uint64),
+		samples: make(map[profileSample]*[2]uint64),
+	}
+}
+
+func (p *Profiler) push(entry, site uint16, sp byte) {
+	key := string([]byte{byte(entry >> 8), byte(entry), byte(site >> 8),
+		byte(site)})
+	if len(p.frames) > 0 {
+		key = p.frames[len(p.frames)-1].key + key
+	}
+	p.frames = append(p.frames, profileFrame{sp: sp, key: key})
+	p.calls[entry]++
+}
+
+// Interrupt enters the interrupt handler.
+func (p *Profiler) Interrupt(c *CPU, vector uint16) {
+	if !p.started {
+		return
+	}
+	handler := uint16(c.memory[vector]) | uint16(c.memory[vector+1])<<8
+	p.push(handler, c.pc, c.sp)
+}
+
+// Before notes the instruction that is about to execute.
+func (p *Profiler) Before(c *CPU) {
+	switch {
+	case !p.started:
+		p.push(c.pc, c.pc, c.sp)
+		p.last = c.cycles
+		p.started = true
+	}
+	p.symbols = c.symbols
+	p.pc = c.pc
+	p.opcode = c.memory[c.pc]
+	p.sp = c.sp
+}
+
+// After accounts the instruction that just executed.  Cycles spent on
+// interrupt entry are accounted to the first instruction of the handler.
+func (p *Profiler) After(c *CPU) {
+	cycles := c.cycles - p.last
+	p.last = c.cycles
+	p.count[p.pc]++
+	p.cycles[p.pc] += cycles
+
+	k := profileSample{stack: p.frames[len(p.frames)-1].key, pc: p.pc}
+	v, ok := p.samples[k]
+	if !ok {
+		v = new([2]uint64)
+		p.samples[k] = v
+	}
+	v[0]++
+	v[1] += cycles
+
+	// Drop frames whose return address was pulled off the stack but keep
+	// the root.
+	for len(p.frames) > 1 && p.frames[len(p.frames)-1].sp <= c.sp {
+		p.frames = p.frames[:len(p.frames)-1]
+	}
+	switch p.opcode {
+	case 0x00, 0x20: // BRK, JSR
+		p.push(c.pc, p.pc, p.sp)
+	}
+	p.sp = c.sp
+}
+
+// name returns the label of address or its hex form.  Labels come from
+// the symbols of the profiled CPU, or from Listing when it has none.
+func (p *Profiler) name(address uint16) string {
+	names := p.symbols
+	if names.Len() == 0 && p.Listing != nil {
+		names = p.Listing.symbols
+	}
+	if name, ok := names.Name(address); ok {
+		return name
+	}
+	return fmt.Sprintf("$%04X", address)
+}
+
+// profileStack decodes a stack key, root first.
+func profileStack(key string) []profileCall {
+	calls := make([]profileCall, 0, len(key)/4)
+	for i := 0; i+3 < len(key); i += 4 {
+		calls = append(calls, profileCall{
+			entry: uint16(key[i])<<8 | uint16(key[i+1]),
+			site:  uint16(key[i+2])<<8 | uint16(key[i+3]),
+		})
+	}
+	return calls
+}
+
+// ProfileLine is a line of the per address report.
+type ProfileLine struct {
+	Address uint16
+	Count   uint64
+	Cycles  uint64
+}
+
+// ProfileSubroutine is a line of the per subroutine report.  Inclusive cycles
+// include the cycles of called subroutines, recursion is counted once.
+type ProfileSubroutine struct {
+	Entry     uint16
+	Name      string
+	Calls     uint64
+	Inclusive uint64
+	Exclusive uint64
+}
+
+// Total returns the number of cycles profiled.
+func (p *Profiler) Total() uint64 {
+	var total uint64
+	for _, v := range p.cycles {
+		total += v
+	}
+	return total
+}
+
+// Addresses returns the executed addresses sorted by cycles, most first.
+func (p *Profiler) Addresses() []ProfileLine {
+	var lines []ProfileLine
+	for a, n := range p.count {
+		if n == 0 {
+			continue
+		}
+		lines = append(lines, ProfileLine{
+			Address: uint16(a),
+			Count:   n,
+			Cycles:  p.cycles[a],
+		})
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].Cycles > lines[j].Cycles
+	})
+	return lines
+}
+
+// stacks returns the cycles spent per call stack.
+func (p *Profiler) stacks() map[string]uint64 {
+	stacks := make(map[string]uint64)
+	for k, v := range p.samples {
+		stacks[k.stack] += v[1]
+	}
+	return stacks
+}
+
+// Subroutines returns the subroutines sorted by inclusive cycles, most first.
+func (p *Profiler) Subroutines() []ProfileSubroutine {
+	subs := make(map[uint16]*ProfileSubroutine)
+	get := func(entry uint16) *ProfileSubroutine {
+		s, ok := subs[entry]
+		if !ok {
+			s = &ProfileSubroutine{
+				Entry: entry,
+				Name:  p.name(entry),
+				Calls: p.calls[entry],
+			}
+			subs[entry] = s
+		}
+		return s
+	}
+	for key, v := range p.stacks() {
+		calls := profileStack(key)
+		get(calls[len(calls)-1].entry).Exclusive += v
+		seen := make(map[uint16]bool, len(calls))
+		for _, call := range calls {
+			if !seen[call.entry] {
+				get(call.entry).Inclusive += v
+				seen[call.entry] = true
+			}
+		}
+	}
+
+	r := make([]ProfileSubroutine, 0, len(subs))
+	for _, s := range subs {
+		r = append(r, *s)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Inclusive != r[j].Inclusive {
+			return r[i].Inclusive > r[j].Inclusive
+		}
+		return r[i].Entry < r[j].Entry
+	})
+	return r
+}
+
+func percent(v, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(v) / float64(total)
+}
+
+// WriteReport writes the n hottest addresses, with their disassembly, and
+// all subroutines.  All addresses are written when n is 0.
+func (p *Profiler) WriteReport(w io.Writer, c *CPU, n int) error {
+	bw := bufio.NewWriter(w)
+	total := p.Total()
+
+	fmt.Fprintf(bw, "total cycles: %v\n\n", total)
+	fmt.Fprintf(bw, "%12s %6s %10s  %-5s  %v\n", "cycles", "%", "count",
+		"addr", "instruction")
+	lines := p.Addresses()
+	if n > 0 && len(lines) > n {
+		lines = lines[:n]
+	}
+	for _, l := range lines {
+		d, _ := c.disassemble(l.Address)
+		fmt.Fprintf(bw, "%12v %6.2f %10v  $%04X  %v\n", l.Cycles,
+			percent(l.Cycles, total), l.Count, l.Address,
+			strings.ReplaceAll(d, "\t", " "))
+	}
+
+	fmt.Fprintf(bw, "\n%12s %6s %12s %6s %10s  %v\n", "inclusive", "%",
+		"exclusive", "%", "calls", "subroutine")
+	for _, s := range p.Subroutines() {
+		fmt.Fprintf(bw, "%12v %6.2f %12v %6.2f %10v  %v\n", s.Inclusive,
+			percent(s.Inclusive, total), s.Exclusive,
+			percent(s.Exclusive, total), s.Calls, s.Name)
+	}
+	return bw.Flush()
+}
+
+// WriteFolded writes exclusive cycles per call stack in the folded stack
+// format read by flamegraph.pl and similar tools.
+func (p *Profiler) WriteFolded(w io.Writer) error {
+	// Stacks that only differ in call sites are merged.
+	folded := make(map[string]uint64)
+	for key, v := range p.stacks() {
+		calls := profileStack(key)
+		names := make([]string, 0, len(calls))
+		for _, call := range calls {
+			names = append(names, p.name(call.entry))
+		}
+		folded[strings.Join(names, ";")] += v
+	}
+	lines := make([]string, 0, len(folded))
+	for stack, v := range folded {
+		if v != 0 {
+			lines = append(lines, fmt.Sprintf("%v %v", stack, v))
+		}
+	}
+	sort.Strings(lines)
+	bw := bufio.NewWriter(w)
+	for _, l := range lines {
+		fmt.Fprintln(bw, l)
+	}
+	return bw.Flush()
+}
+
+// protobuf is a minimal protocol buffer encoder for the pprof format.
+type protobuf struct {
+	b []byte
+}
+
+func (pb *protobuf) varint(v uint64) {
+	for v >= 0x80 {
+		pb.b = append(pb.b, byte(v)|0x80)
+		v >>= 7
+	}
+	pb.b = append(pb.b, byte(v))
+}
+
+func (pb *protobuf) uint64(field int, v uint64) {
+	pb.varint(uint64(field) << 3)
+	pb.varint(v)
+}
+
+func (pb *protobuf) bytes(field int, b []byte) {
+	pb.varint(uint64(field)<<3 | 2)
+	pb.varint(uint64(len(b)))
+	pb.b = append(pb.b, b...)
+}
+
+func (pb *protobuf) packed(field int, vs []uint64) {
+	var p protobuf
+	for _, v := range vs {
+		p.varint(v)
+	}
+	pb.bytes(field, p.b)
+}
+
+// WritePprof writes the profile in gzipped pprof protobuf format with
+// instruction and cycle counts.  Every subroutine is a function and, with a
+// listing, addresses map to source lines.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	strs := []string{""}
+	index := map[string]uint64{"": 0}
+	str := func(s string) uint64 {
+		i, ok := index[s]
+		if !ok {
+			i = uint64(len(strs))
+			strs = append(strs, s)
+			index[s] = i
+		}
+		return i
+	}
+	valueType := func(typ, unit string) []byte {
+		var vt protobuf
+		vt.uint64(1, str(typ))
+		vt.uint64(2, str(unit))
+		return vt.b
+	}
+
+	// Profile fields: 1 sample_type, 2 sample, 4 location, 5 function,
+	// 6 string_table.
+	var pb protobuf
+	pb.bytes(1, valueType("instructions", "count"))
+	pb.bytes(1, valueType("cycles", "count"))
+
+	functions := make(map[uint16]uint64)      // id by entry
+	locations := make(map[profileCall]uint64) // id by address and entry
+	function := func(entry uint16) uint64 {
+		if id, ok := functions[entry]; ok {
+			return id
+		}
+		id := uint64(len(functions) + 1)
+		functions[entry] = id
+		var f protobuf
+		f.uint64(1, id)
+		f.uint64(2, str(p.name(entry)))
+		f.uint64(3, str(fmt.Sprintf("$%04X", entry)))
+		if p.Listing != nil {
+			f.uint64(4, str(p.Listing.Path))
+			if line, ok := p.Listing.Line(entry); ok {
+				f.uint64(5, uint64(line))
+			}
+		}
+		pb.bytes(5, f.b)
+		return id
+	}
+	location := func(address, entry uint16) uint64 {
+		k := profileCall{entry: entry, site: address}
+		if id, ok := locations[k]; ok {
+			return id
+		}
+		id := uint64(len(locations) + 1)
+		locations[k] = id
+		var line protobuf
+		line.uint64(1, function(entry))
+		if p.Listing != nil {
+			if n, ok := p.Listing.Line(address); ok {
+				line.uint64(2, uint64(n))
+			}
+		}
+		var l protobuf
+		l.uint64(1, id)
+		l.uint64(3, uint64(address))
+		l.bytes(4, line.b)
+		pb.bytes(4, l.b)
+		return id
+	}
+
+	keys := make([]profileSample, 0, len(p.samples))
+	for k := range p.samples {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stack != keys[j].stack {
+			return keys[i].stack < keys[j].stack
+		}
+		return keys[i].pc < keys[j].pc
+	})
+	for _, k := range keys {
+		// Locations are leaf first: the executed address, then the
+		// call site of every frame in its caller.
+		calls := profileStack(k.stack)
+		ids := []uint64{location(k.pc, calls[len(calls)-1].entry)}
+		for i := len(calls) - 1; i > 0; i-- {
+			ids = append(ids, location(calls[i].site,
+				calls[i-1].entry))
+		}
+		v := p.samples[k]
+		var s protobuf
+		s.packed(1, ids)
+		s.packed(2, v[:])
+		pb.bytes(2, s.b)
+	}
+
+	for _, s := range strs {
+		pb.bytes(6, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(pb.b); err != nil {
+		return err
+	}
+	return gz.Close()
+}
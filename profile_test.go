@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+// profileProgram calls outer twice, outer calls inner.
+func profileProgram(t *testing.T) (*CPU, *Listing) {
+	bin, lst := writeTestListing(t, []string{
+		"0400 201004|start   jsr outer",
+		"0403 201004|        jsr outer",
+		"0406 4c0604|done    jmp done",
+		"0410 ea|outer   nop",
+		"0411 202004|        jsr inner",
+		"0414 60|        rts",
+		"0420 ea|inner   nop",
+		"0421 60|        rts",
+	})
+	c := New()
+	if err := c.load(bin, 0); err != nil {
+		t.Fatal(err)
+	}
+	c.pc = 0x0400
+	l, err := loadListing(lst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, l
+}
+
+func TestProfiler(t *testing.T) {
+	c, l := profileProgram(t)
+	p := NewProfiler()
+	p.Listing = l
+	c.Attach(p)
+	for i := 0; i < 12; i++ {
+		c.executeInstruction()
+	}
+
+	if p.Total() != c.cycles {
+		t.Fatalf("total %v, expected %v", p.Total(), c.cycles)
+	}
+	lines := p.Addresses()
+	if lines[0].Cycles < lines[len(lines)-1].Cycles {
+		t.Fatalf("addresses not sorted %v", lines)
+	}
+	for _, line := range lines {
+		if line.Address == 0x0420 &&
+			(line.Count != 2 || line.Cycles != 4) {
+			t.Fatalf("unexpected inner nop %+v", line)
+		}
+	}
+
+	// jsr 6, nop 2, rts 6
+	expected := map[string]ProfileSubroutine{
+		"start": {Calls: 1, Inclusive: 56, Exclusive: 12},
+		"outer": {Calls: 2, Inclusive: 44, Exclusive: 28},
+		"inner": {Calls: 2, Inclusive: 16, Exclusive: 16},
+	}
+	subs := p.Subroutines()
+	if len(subs) != 3 || subs[0].Name != "start" {
+		t.Fatalf("unexpected subroutines %+v", subs)
+	}
+	for _, s := range subs {
+		e := expected[s.Name]
+		if s.Calls != e.Calls || s.Inclusive != e.Inclusive ||
+			s.Exclusive != e.Exclusive {
+			t.Fatalf("unexpected subroutine %+v", s)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := p.WriteFolded(&b); err != nil {
+		t.Fatal(err)
+	}
+	folded := "start 12\nstart;outer 28\nstart;outer;inner 16\n"
+	if b.String() != folded {
+		t.Fatalf("unexpected folded stacks:\n%v", b.String())
+	}
+
+	b.Reset()
+	if err := p.WriteReport(&b, c, 3); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "total cycles: 56") ||
+		!strings.Contains(b.String(), "JSR $0420") {
+		t.Fatalf("unexpected report:\n%v", b.String())
+	}
+}
+
+func TestProfilerSymbols(t *testing.T) {
+	// the symbols of the CPU name subroutines without a listing
+	c, l := profileProgram(t)
+	c.SetSymbols(l.Symbols())
+	p := NewProfiler()
+	c.Attach(p)
+	for i := 0; i < 12; i++ {
+		c.executeInstruction()
+	}
+	var names []string
+	for _, s := range p.Subroutines() {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, " ") != "start outer inner" {
+		t.Fatalf("unexpected subroutines %v", names)
+	}
+}
+
+func TestProfilerPprof(t *testing.T) {
+	c, l := profileProgram(t)
+	p := NewProfiler()
+	p.Listing = l
+	c.Attach(p)
+	for i := 0; i < 12; i++ {
+		c.executeInstruction()
+	}
+
+	var b bytes.Buffer
+	if err := p.WritePprof(&b); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The string table holds the value types and function names.
+	for _, s := range []string{"cycles", "instructions", "start",
+		"outer", "inner", "$0420"} {
+		if !bytes.Contains(raw, []byte(s)) {
+			t.Fatalf("%v missing from profile", s)
+		}
+	}
+}
+
+func TestProfilerInterrupt(t *testing.T) {
+	c := New()
+	c.pc = 0x0400
+	c.sr &^= Interrupts
+	c.memory[0x0400] = 0xea // nop
+	c.memory[0x0401] = 0xea // nop
+	c.memory[0x0500] = 0x40 // rti
+	c.memory[0xfffe] = 0x00
+	c.memory[0xffff] = 0x05
+
+	p := NewProfiler()
+	c.Attach(p)
+	c.executeInstruction()
+	c.IRQ(true)
+	c.executeInstruction() // rti
+	c.IRQ(false)
+	c.executeInstruction() // nop
+
+	var b bytes.Buffer
+	if err := p.WriteFolded(&b); err != nil {
+		t.Fatal(err)
+	}
+	// interrupt entry is accounted to the handler
+	if b.String() != "$0400 4\n$0400;$0500 13\n" {
+		t.Fatalf("unexpected folded stacks:\n%v", b.String())
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WriteRecord describes a single memory write.
+type WriteRecord struct {
+	PC        uint16 // instruction, or interrupted instruction, that wrote
+	Cycle     uint64 // cycle count when the instruction started
+	Old       byte   // value before the write
+	Value     byte   // value written
+	Interrupt bool   // written by interrupt entry, e.g. a stack push
+}
+
+// String returns the record in human readable form.
+func (w WriteRecord) String() string {
+	s := fmt.Sprintf("$%02X -> $%02X by $%04X at cycle %v", w.Old, w.Value,
+		w.PC, w.Cycle)
+	if w.Interrupt {
+		s += " (interrupt)"
+	}
+	return s
+}
+
+// WriteTracker is an Observer that remembers the last writes to every
+// address, which answers "who last wrote this byte?".
+type WriteTracker struct {
+	Depth  int            // writes remembered per address
+	Ranges []AddressRange // track only these addresses, all when empty
+	Undo   int            // instructions Unwind can undo, none by default
+
+	writes  [][]WriteRecord // newest last, by address
+	pc      uint16
+	cycle   uint64
+	running bool // an instruction is executing
+
+	journal []writeUndo
+	marks   undoMarks
+}
+
+// writeUndo undoes a recorded write.
+type writeUndo struct {
+	address    uint16
+	hasDropped bool
+	dropped    WriteRecord // oldest write forgotten to make room
+}
+
+// NewWriteTracker returns a tracker that remembers depth writes per address.
+func NewWriteTracker(depth int) *WriteTracker {
+	if depth < 1 {
+		depth = 1
+	}
+	return &WriteTracker{
+		Depth:  depth,
+		writes: make([][]WriteRecord, 65536),
+	}
+}
+
+// Before notes the instruction that is about to execute.
+func (t *WriteTracker) Before(c *CPU) {
+	t.pc = c.pc
+	t.cycle = c.cycles
+	t.running = true
+	if t.Undo > 0 && len(t.marks.marks) == 0 {
+		t.mark()
+	}
+}
+
+// After ends the instruction.  Writes until the next instruction are done by
+// interrupt entry.
+func (t *WriteTracker) After(c *CPU) {
+	t.running = false
+	if t.Undo > 0 {
+		t.mark()
+	}
+}
+
+// mark starts the journal of the next instruction.
+func (t *WriteTracker) mark() {
+	t.marks.limit = t.Undo
+	t.journal = t.journal[t.marks.start(len(t.journal)):]
+}
+
+// tracked returns true if writes to address are recorded.
+func (t *WriteTracker) tracked(address uint16) bool {
+	if len(t.Ranges) == 0 {
+		return true
+	}
+	for _, r := range t.Ranges {
+		if r.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryWrite records a write.
+func (t *WriteTracker) MemoryWrite(c *CPU, address uint16, old, value byte) {
+	if !t.tracked(address) {
+		return
+	}
+	w := WriteRecord{
+		PC:        t.pc,
+		Cycle:     t.cycle,
+		Old:       old,
+		Value:     value,
+		Interrupt: !t.running,
+	}
+	if !t.running {
+		// interrupt entry pushes before pc is loaded from the vector
+		w.PC = c.pc
+		w.Cycle = c.cycles
+	}
+	ws := t.writes[address]
+	u := writeUndo{address: address}
+	if len(ws) >= t.Depth {
+		u.hasDropped, u.dropped = true, ws[len(ws)-t.Depth]
+		ws = append(ws[:0], ws[len(ws)-t.Depth+1:]...)
+	}
+	t.writes[address] = append(ws, w)
+	if t.Undo > 0 {
+		t.journal = append(t.journal, u)
+	}
+}
+
+// Unwind forgets the writes of the last n instructions, and of the next one,
+// and remembers the writes they pushed out again.
+func (t *WriteTracker) Unwind(c *CPU, n int) {
+	first := t.marks.undo(n)
+	for i := len(t.journal) - 1; i >= first; i-- {
+		u := t.journal[i]
+		ws := t.writes[u.address]
+		if len(ws) == 0 {
+			continue
+		}
+		ws = ws[:len(ws)-1]
+		if u.hasDropped {
+			ws = append([]WriteRecord{u.dropped}, ws...)
+		}
+		t.writes[u.address] = ws
+	}
+	t.journal = t.journal[:first]
+}
+
+// LastWrite returns the most recent write to address.
+func (t *WriteTracker) LastWrite(address uint16) (WriteRecord, bool) {
+	ws := t.writes[address]
+	if len(ws) == 0 {
+		return WriteRecord{}, false
+	}
+	return ws[len(ws)-1], true
+}
+
+// Writes returns the remembered writes to address, newest first.
+func (t *WriteTracker) Writes(address uint16) []WriteRecord {
+	ws := t.writes[address]
+	r := make([]WriteRecord, 0, len(ws))
+	for i := len(ws) - 1; i >= 0; i-- {
+		r = append(r, ws[i])
+	}
+	return r
+}
+
+// Reset forgets all writes.
+func (t *WriteTracker) Reset() {
+	for i := range t.writes {
+		t.writes[i] = nil
+	}
+	t.journal = nil
+	t.marks.marks = nil
+}
+
+// Restored forgets all writes, which made the memory that was replaced.
+func (t *WriteTracker) Restored(c *CPU) {
+	t.Reset()
+}
+
+// Report returns the writes to address, newest first, one per line.
+func (t *WriteTracker) Report(address uint16) string {
+	ws := t.Writes(address)
+	if len(ws) == 0 {
+		return fmt.Sprintf("$%04X: no writes recorded", address)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "$%04X:", address)
+	for _, w := range ws {
+		fmt.Fprintf(&b, "\n  %v", w)
+	}
+	return b.String()
+}
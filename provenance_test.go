@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestWriteTracker(t *testing.T) {
+	c := New()
+	c.pc = 0x0400
+	copy(c.memory[0x0400:], []byte{
+		0xa9, 0x11, // lda #$11
+		0x85, 0x10, // sta $10
+		0xe6, 0x10, // inc $10
+		0x48,             // pha
+		0x20, 0x00, 0x05, // jsr $0500
+	})
+	c.memory[0x0500] = 0x00 // brk
+	c.memory[0xfffe] = 0x00
+	c.memory[0xffff] = 0x06
+	c.memory[0x0600] = 0xea // nop
+
+	w := NewWriteTracker(2)
+	c.Attach(w)
+	for i := 0; i < 6; i++ {
+		c.executeInstruction()
+	}
+
+	ws := w.Writes(0x10)
+	if len(ws) != 2 {
+		t.Fatalf("unexpected writes %v", ws)
+	}
+	if ws[0].PC != 0x0404 || ws[0].Old != 0x11 || ws[0].Value != 0x12 ||
+		ws[0].Cycle != 5 {
+		t.Fatalf("unexpected inc write %v", ws[0])
+	}
+	if ws[1].PC != 0x0402 || ws[1].Value != 0x11 {
+		t.Fatalf("unexpected sta write %v", ws[1])
+	}
+
+	checks := []struct {
+		address uint16
+		pc      uint16
+	}{
+		{0x01ff, 0x0406}, // pha
+		{0x01fe, 0x0407}, // jsr
+		{0x01fd, 0x0407},
+		{0x01fc, 0x0500}, // brk
+		{0x01fb, 0x0500},
+		{0x01fa, 0x0500},
+	}
+	for _, check := range checks {
+		last, ok := w.LastWrite(check.address)
+		if !ok || last.PC != check.pc || last.Interrupt {
+			t.Fatalf("$%04x: unexpected write %v", check.address, last)
+		}
+	}
+
+	// interrupt entry is attributed to the interrupted instruction
+	c.sr &^= Interrupts
+	c.IRQ(true)
+	c.executeInstruction()
+	last, ok := w.LastWrite(0x01f9)
+	if !ok || last.PC != 0x0600 || !last.Interrupt {
+		t.Fatalf("unexpected interrupt write %v", last)
+	}
+
+	// depth is bounded
+	for i := 0; i < 3; i++ {
+		c.write(0x10, byte(i))
+	}
+	if ws := w.Writes(0x10); len(ws) != 2 || ws[0].Value != 2 ||
+		ws[1].Value != 1 {
+		t.Fatalf("unexpected writes %v", ws)
+	}
+}
+
+func TestWriteTrackerRanges(t *testing.T) {
+	c := New()
+	w := NewWriteTracker(4)
+	w.Ranges = []AddressRange{{Start: 0x00, End: 0xff}}
+	c.Attach(w)
+	c.write(0x0080, 1)
+	c.write(0x0200, 1)
+	if _, ok := w.LastWrite(0x0080); !ok {
+		t.Fatalf("zero page write not tracked")
+	}
+	if _, ok := w.LastWrite(0x0200); ok {
+		t.Fatalf("write outside range tracked")
+	}
+	w.Reset()
+	if _, ok := w.LastWrite(0x0080); ok {
+		t.Fatalf("write not forgotten")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+// Rewinder records execution so that it can be undone.  Every instruction
+// gets an undo record with the registers before it executed and the old value
+// of every byte it wrote.  History is split in segments of Interval
+// instructions that start with a keyframe, a full copy of the machine state,
+// which lets long jumps back skip whole segments.  Only the last Keyframes
+// segments are kept, which bounds memory use.
+//
+// Attached observers that implement Unwinder are told how many instructions
+// were undone so that they can undo their own records.  Changes made outside
+// of instruction execution, e.g. by a debugger writing memory, are not
+// recorded.
+type Rewinder struct {
+	Interval  int // instructions per segment
+	Keyframes int // segments kept
+
+	segments []*rewindSegment // oldest first
+	started  bool
+	undo     rewindStep // record of the executing instruction
+}
+
+// rewindState is the complete machine state at an instruction boundary.
+type rewindState struct {
+	pc     uint16
+	sp     byte
+	sr     byte
+	a      byte
+	x      byte
+	y      byte
+	cycles uint64
+	irq    bool
+	nmi    bool
+}
+
+// rewindWrite is the old value of a written byte.
+type rewindWrite struct {
+	address uint16
+	old     byte
+}
+
+// rewindStep undoes one instruction.  Its writes are stored in the segment
+// starting at index first.
+type rewindStep struct {
+	rewindState
+	first int
+}
+
+type rewindSegment struct {
+	keyframe rewindState
+	memory   []byte
+	steps    []rewindStep
+	writes   []rewindWrite
+}
+
+// Unwinder is implemented by observers whose records follow the CPU back in
+// time.  Unwind is called once a Rewinder undid the last n instructions, and
+// whatever ran of the next one, e.g. interrupt entry.
+type Unwinder interface {
+	Unwind(c *CPU, n int)
+}
+
+// undoMarks splits the undo journal of an Unwinder into instructions.  It
+// holds the index of the first journal entry of every instruction, oldest
+// first; the last one is the instruction that executes next.  Only the last
+// limit instructions are kept.
+type undoMarks struct {
+	limit int
+	marks []int
+}
+
+// start starts an instruction at entry n.  It returns the number of entries
+// at the start of the journal that are no longer needed; the caller drops
+// them.
+func (u *undoMarks) start(n int) int {
+	u.marks = append(u.marks, n)
+	if len(u.marks) <= 2*(u.limit+1) {
+		return 0
+	}
+	keep := u.marks[len(u.marks)-u.limit-1:]
+	drop := keep[0]
+	for i := range keep {
+		keep[i] -= drop
+	}
+	u.marks = append(u.marks[:0], keep...)
+	return drop
+}
+
+// undo forgets the last n instructions and the next one.  It returns the
+// first entry to undo.  Without enough history everything is undone.
+func (u *undoMarks) undo(n int) int {
+	if n >= len(u.marks) {
+		u.marks = u.marks[:0]
+		return 0
+	}
+	u.marks = u.marks[:len(u.marks)-n]
+	return u.marks[len(u.marks)-1]
+}
+
+// NewRewinder returns a rewinder that can go back up to about
+// interval*keyframes instructions.
+func NewRewinder(interval, keyframes int) *Rewinder {
+	if interval < 1 {
+		interval = 1
+	}
+	if keyframes < 1 {
+		keyframes = 1
+	}
+	return &Rewinder{Interval: interval, Keyframes: keyframes}
+}
+
+func (c *CPU) rewindState() rewindState {
+	return rewindState{
+		pc:     c.pc,
+		sp:     c.sp,
+		sr:     c.sr,
+		a:      c.a,
+		x:      c.x,
+		y:      c.y,
+		cycles: c.cycles,
+		irq:    c.irq,
+		nmi:    c.nmi,
+	}
+}
+
+func (c *CPU) setRewindState(s rewindState) {
+	c.pc = s.pc
+	c.sp = s.sp
+	c.sr = s.sr
+	c.a = s.a
+	c.x = s.x
+	c.y = s.y
+	c.cycles = s.cycles
+	c.irq = s.irq
+	c.nmi = s.nmi
+}
+
+// keyframe starts a new segment at the current state and drops the oldest
+// segments.
+func (r *Rewinder) keyframe(c *CPU) {
+	s := &rewindSegment{
+		keyframe: c.rewindState(),
+		memory:   make([]byte, len(c.memory)),
+	}
+	// Reuse the memory of a dropped segment.
+	if len(r.segments) >= r.Keyframes {
+		s.memory = r.segments[0].memory
+		r.segments[0] = nil
+		r.segments = r.segments[1:]
+	}
+	copy(s.memory, c.memory)
+	r.segments = append(r.segments, s)
+}
+
+// Before starts the undo record of the instruction at pc.  The state is taken
+// after the previous instruction so that interrupt entry is undone with the
+// instruction that follows it.
+func (r *Rewinder) Before(c *CPU) {
+	if !r.started {
+		r.keyframe(c)
+		r.undo = rewindStep{rewindState: c.rewindState()}
+		r.started = true
+	}
+}
+
+// After stores the undo record of the instruction that just executed.
+func (r *Rewinder) After(c *CPU) {
+	s := r.segments[len(r.segments)-1]
+	s.steps = append(s.steps, r.undo)
+	if len(s.steps) >= r.Interval {
+		r.keyframe(c)
+		s = r.segments[len(r.segments)-1]
+	}
+	r.undo = rewindStep{
+		rewindState: c.rewindState(),
+		first:       len(s.writes),
+	}
+}
+
+// MemoryWrite records the old value of a byte written by an instruction.
+func (r *Rewinder) MemoryWrite(c *CPU, address uint16, old, value byte) {
+	if !r.started {
+		return
+	}
+	s := r.segments[len(r.segments)-1]
+	s.writes = append(s.writes, rewindWrite{address: address, old: old})
+}
+
+// Restored drops all history, which cannot be undone into a loaded state.
+func (r *Rewinder) Restored(c *CPU) {
+	r.segments = nil
+	r.started = false
+}
+
+// Len returns the number of instructions that can be undone.
+func (r *Rewinder) Len() int {
+	n := 0
+	for _, s := range r.segments {
+		n += len(s.steps)
+	}
+	return n
+}
+
+// StepBack undoes the last instruction.  It returns false when there is no
+// history left.
+func (r *Rewinder) StepBack(c *CPU) bool {
+	for len(r.segments) > 0 {
+		s := r.segments[len(r.segments)-1]
+		if len(s.steps) == 0 {
+			if len(r.segments) == 1 {
+				return false
+			}
+			// the previous segment ended where this one starts
+			r.segments = r.segments[:len(r.segments)-1]
+			continue
+		}
+		step := s.steps[len(s.steps)-1]
+		for i := len(s.writes) - 1; i >= step.first; i-- {
+			c.memory[s.writes[i].address] = s.writes[i].old
+		}
+		s.writes = s.writes[:step.first]
+		s.steps = s.steps[:len(s.steps)-1]
+		c.setRewindState(step.rewindState)
+		r.undo = rewindStep{
+			rewindState: step.rewindState,
+			first:       step.first,
+		}
+		unwind(c, 1)
+		return true
+	}
+	return false
+}
+
+// ReverseContinue steps back until stop returns true for the current state or
+// the history is exhausted.  It returns the number of instructions undone and
+// whether stop returned true.
+func (r *Rewinder) ReverseContinue(c *CPU, stop func(c *CPU) bool) (int,
+	bool) {
+
+	n := 0
+	for r.StepBack(c) {
+		n++
+		if stop(c) {
+			return n, true
+		}
+	}
+	return n, false
+}
+
+// BackCycles goes back to the last instruction boundary at least cycles
+// cycles ago.  Whole segments are skipped by restoring keyframes.  It returns
+// false, after going back as far as possible, if the history is too short.
+func (r *Rewinder) BackCycles(c *CPU, cycles uint64) bool {
+	short := cycles > c.cycles
+	var target uint64
+	if !short {
+		target = c.cycles - cycles
+	}
+
+	// Restoring the keyframe of a segment goes back to the end of the
+	// previous segment.
+	for len(r.segments) > 1 {
+		s := r.segments[len(r.segments)-1]
+		if s.keyframe.cycles <= target {
+			break
+		}
+		r.restoreKeyframe(c, s)
+		r.segments = r.segments[:len(r.segments)-1]
+	}
+	for c.cycles > target {
+		if !r.StepBack(c) {
+			return false
+		}
+	}
+	return !short
+}
+
+// restoreKeyframe sets the machine to the state at the start of s.
+func (r *Rewinder) restoreKeyframe(c *CPU, s *rewindSegment) {
+	copy(c.memory, s.memory)
+	c.setRewindState(s.keyframe)
+	prev := r.segments[len(r.segments)-2]
+	r.undo = rewindStep{rewindState: s.keyframe, first: len(prev.writes)}
+	unwind(c, len(s.steps))
+}
+
+// unwind tells the Unwinders attached to c that n instructions were undone.
+func unwind(c *CPU, n int) {
+	for _, o := range c.observers {
+		if u, ok := o.(Unwinder); ok {
+			u.Unwind(c, n)
+		}
+	}
+}
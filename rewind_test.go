@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// rewindProgram returns a CPU running a loop that writes memory, pushes to
+// the stack and calls a subroutine.
+func rewindProgram() *CPU {
+	c := New()
+	c.pc = 0x0400
+	copy(c.memory[0x0400:], []byte{
+		0xe8,       // loop: inx
+		0x96, 0x10, // stx $10,y
+		0xf6, 0x80, // inc $80,x
+		0x48,             // pha
+		0x20, 0x10, 0x04, // jsr sub
+		0x68,             // pla
+		0xc8,             // iny
+		0x4c, 0x00, 0x04, // jmp loop
+	})
+	copy(c.memory[0x0410:], []byte{
+		0x0e, 0x00, 0x02, // sub: asl $0200
+		0x69, 0x03, // adc #$03
+		0x60, // rts
+	})
+	c.memory[0x0200] = 0x01
+	return c
+}
+
+type rewindSnapshot struct {
+	state  rewindState
+	memory []byte
+}
+
+func takeRewindSnapshot(c *CPU) rewindSnapshot {
+	return rewindSnapshot{
+		state:  c.rewindState(),
+		memory: append([]byte(nil), c.memory...),
+	}
+}
+
+func (s rewindSnapshot) check(t *testing.T, c *CPU, i int) {
+	t.Helper()
+	if c.rewindState() != s.state {
+		t.Fatalf("%v: state %+v, expected %+v", i, c.rewindState(),
+			s.state)
+	}
+	if !bytes.Equal(c.memory, s.memory) {
+		t.Fatalf("%v: memory differs", i)
+	}
+}
+
+func TestRewindStepBack(t *testing.T) {
+	c := rewindProgram()
+	r := NewRewinder(7, 100)
+	c.Attach(r)
+
+	var snapshots []rewindSnapshot
+	for i := 0; i < 100; i++ {
+		snapshots = append(snapshots, takeRewindSnapshot(c))
+		c.executeInstruction()
+	}
+	if r.Len() != 100 {
+		t.Fatalf("unexpected history %v", r.Len())
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !r.StepBack(c) {
+			t.Fatalf("%v: no history", i)
+		}
+		snapshots[i].check(t, c, i)
+	}
+	if r.StepBack(c) {
+		t.Fatalf("stepped back past the start")
+	}
+
+	// execution continues and is recorded again
+	for i := 0; i < 10; i++ {
+		c.executeInstruction()
+	}
+	for r.StepBack(c) {
+	}
+	snapshots[0].check(t, c, 0)
+}
+
+func TestRewindBounded(t *testing.T) {
+	c := rewindProgram()
+	r := NewRewinder(10, 3)
+	c.Attach(r)
+	for i := 0; i < 1000; i++ {
+		c.executeInstruction()
+	}
+	if r.Len() > 30 {
+		t.Fatalf("history not bounded: %v", r.Len())
+	}
+	n := 0
+	for r.StepBack(c) {
+		n++
+	}
+	if n < 20 || n > 30 {
+		t.Fatalf("unexpected history %v", n)
+	}
+}
+
+func TestRewindBackCycles(t *testing.T) {
+	c := rewindProgram()
+	r := NewRewinder(5, 100)
+	c.Attach(r)
+
+	var snapshots []rewindSnapshot
+	for i := 0; i < 200; i++ {
+		snapshots = append(snapshots, takeRewindSnapshot(c))
+		c.executeInstruction()
+	}
+	end := c.cycles
+
+	// the last boundary at or before the target cycle
+	target := end - 301
+	var expected rewindSnapshot
+	for _, s := range snapshots {
+		if s.state.cycles <= target {
+			expected = s
+		}
+	}
+	if !r.BackCycles(c, 301) {
+		t.Fatalf("history too short")
+	}
+	expected.check(t, c, 0)
+
+	// keyframes are left alone when stepping forward again
+	c.executeInstruction()
+	if !r.StepBack(c) {
+		t.Fatalf("no history")
+	}
+	expected.check(t, c, 0)
+
+	if !r.BackCycles(c, c.cycles) {
+		t.Fatalf("history too short")
+	}
+	snapshots[0].check(t, c, 0)
+	if r.BackCycles(c, 1) {
+		t.Fatalf("went back before the start")
+	}
+}
+
+func TestRewindReverseContinue(t *testing.T) {
+	c := rewindProgram()
+	r := NewRewinder(64, 4)
+	c.Attach(r)
+	for i := 0; i < 50; i++ {
+		c.executeInstruction()
+	}
+	n, ok := r.ReverseContinue(c, func(c *CPU) bool {
+		return c.pc == 0x0410
+	})
+	if !ok || c.pc != 0x0410 || n == 0 {
+		t.Fatalf("unexpected stop at $%04x after %v", c.pc, n)
+	}
+}
+
+// unwindSnapshot is what the Unwinders of a CPU recorded.
+type unwindSnapshot struct {
+	frames []CallFrame
+	writes [][]WriteRecord
+}
+
+func takeUnwindSnapshot(cs *CallStack, t *WriteTracker) unwindSnapshot {
+	s := unwindSnapshot{frames: cs.Frames()}
+	for a := 0; a < 0x0300; a++ {
+		s.writes = append(s.writes, t.Writes(uint16(a)))
+	}
+	return s
+}
+
+func TestRewindUnwinders(t *testing.T) {
+	c := rewindProgram()
+	copy(c.memory[0x0500:], []byte{0x40}) // nmi: rti
+	c.memory[0xfffa], c.memory[0xfffb] = 0x00, 0x05
+	r := NewRewinder(5, 100)
+	cs := NewCallStack()
+	cs.Undo = 100
+	w := NewWriteTracker(2)
+	w.Undo = 100
+	c.Attach(r)
+	c.Attach(cs)
+	c.Attach(w)
+
+	var snapshots []unwindSnapshot
+	var cycles []uint64
+	for i := 0; i < 400; i++ {
+		snapshots = append(snapshots, takeUnwindSnapshot(cs, w))
+		cycles = append(cycles, c.cycles)
+		if i == 350 {
+			c.NMI()
+		}
+		c.executeInstruction()
+	}
+
+	// back across keyframes, then one instruction at a time, as far as
+	// the unwinders keep their journals
+	n := len(cycles) - 1
+	for n > 0 && cycles[n] > c.cycles-301 {
+		n--
+	}
+	if !r.BackCycles(c, 301) {
+		t.Fatalf("history too short")
+	}
+	for i := n; i >= len(cycles)-100; i-- {
+		got := takeUnwindSnapshot(cs, w)
+		if !reflect.DeepEqual(got.frames, snapshots[i].frames) {
+			t.Fatalf("%v: frames %v, expected %v", i, got.frames,
+				snapshots[i].frames)
+		}
+		for a, want := range snapshots[i].writes {
+			if !reflect.DeepEqual(got.writes[a], want) {
+				t.Fatalf("%v: writes to $%04X %v, expected %v",
+					i, a, got.writes[a], want)
+			}
+		}
+		if !r.StepBack(c) {
+			t.Fatalf("%v: no history", i)
+		}
+	}
+}
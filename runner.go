@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// runnerYield is the number of cycles after which a running Runner lets
+// the goroutines that send it commands in.
+const runnerYield = 1000
+
+// RunnerStatus is a copy of the state of a CPU owned by a Runner.
+type RunnerStatus struct {
+	Running   bool
+	Registers Registers
+	Halt      *Halt // why the CPU stopped last, nil if it never did
+}
+
+// Runner owns a CPU and runs it in its own goroutine.  Other goroutines
+// control the CPU through the methods of the Runner, which send commands to
+// that goroutine and wait for their result, so the CPU is never touched by
+// two goroutines at once.  A running CPU executes commands between
+// instructions.  The CPU must not be used directly until the Runner is
+// closed.
+type Runner struct {
+	commands chan func()
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{} // closed when the goroutine exits
+
+	// owned by the goroutine
+	cpu         *CPU
+	user        []HaltCondition // conditions of NewRunner
+	conditions  []HaltCondition // of runs
+	breakpoints map[uint16]bool
+	running     bool
+	halt        *Halt
+	waiters     []chan RunnerStatus
+}
+
+// NewRunner starts a paused Runner for c.  Runs stop on breakpoints, invalid
+// opcodes and conditions.
+func NewRunner(c *CPU, conditions ...HaltCondition) *Runner {
+	r := &Runner{
+		commands:    make(chan func()),
+		done:        make(chan struct{}),
+		cpu:         c,
+		user:        conditions,
+		breakpoints: make(map[uint16]bool),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	commands := HaltCondition{
+		Kind: HaltCustom,
+		Name: "command",
+		Before: func(c *CPU, pc uint16, p Progress) bool {
+			select {
+			case f := <-r.commands:
+				f()
+			default:
+			}
+			return !r.running
+		},
+	}
+	breakpoint := HaltCondition{
+		Kind: HaltPC,
+		Name: "breakpoint",
+		Before: func(c *CPU, pc uint16, p Progress) bool {
+			return p.Instructions > 0 && r.breakpoints[pc]
+		},
+	}
+	r.conditions = append([]HaltCondition{commands, breakpoint,
+		YieldEvery(runnerYield)}, conditions...)
+	go r.loop()
+	return r
+}
+
+// loop executes commands and runs the CPU while it is running.
+func (r *Runner) loop() {
+	defer close(r.done)
+	for {
+		select {
+		case f := <-r.commands:
+			f()
+		case <-r.ctx.Done():
+			return
+		}
+		for r.running {
+			h := r.cpu.Run(r.ctx, r.conditions...)
+			if h.Kind == HaltCanceled {
+				return
+			}
+			if r.running {
+				r.stop(&h)
+			}
+		}
+	}
+}
+
+// stop pauses the CPU and tells waiters why.  It runs in the goroutine.
+func (r *Runner) stop(h *Halt) {
+	r.running = false
+	if h != nil {
+		r.halt = h
+	}
+	s := r.status()
+	for _, w := range r.waiters {
+		w <- s
+	}
+	r.waiters = nil
+}
+
+// status returns the status of the CPU.  It runs in the goroutine.
+func (r *Runner) status() RunnerStatus {
+	s := RunnerStatus{Running: r.running, Registers: r.cpu.registers()}
+	if r.halt != nil {
+		h := *r.halt
+		s.Halt = &h
+	}
+	return s
+}
+
+// do executes f in the goroutine and waits for it.  It returns false once
+// the Runner is closed.
+func (r *Runner) do(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case r.commands <- func() { f(); close(done) }:
+	case <-r.done:
+		return false
+	}
+	<-done
+	return true
+}
+
+// Status returns the status of the CPU.
+func (r *Runner) Status() RunnerStatus {
+	var s RunnerStatus
+	r.do(func() { s = r.status() })
+	return s
+}
+
+// State returns the state of the CPU, with a copy of memory if memory is
+// set.
+func (r *Runner) State(memory bool) State {
+	var s State
+	r.do(func() { s = r.cpu.State(memory) })
+	return s
+}
+
+// Resume runs the CPU until it stops or is paused.
+func (r *Runner) Resume() {
+	r.do(func() {
+		r.running = true
+	})
+}
+
+// Pause stops a running CPU between instructions and returns its status.
+func (r *Runner) Pause() RunnerStatus {
+	var s RunnerStatus
+	r.do(func() {
+		if r.running {
+			r.stop(nil)
+		}
+		s = r.status()
+	})
+	return s
+}
+
+// Step executes a single instruction, or takes a pending interrupt and
+// executes the first instruction of its handler, on a paused CPU.  It
+// returns the halt of a condition or invalid opcode that stopped the step,
+// nil otherwise.  Step does nothing on a running CPU.
+func (r *Runner) Step() *Halt {
+	var halt *Halt
+	r.do(func() {
+		if r.running {
+			return
+		}
+		conditions := append(r.user[:len(r.user):len(r.user)],
+			HaltAfterInstructions(1))
+		h := r.cpu.Run(r.ctx, conditions...)
+		if h.Kind != HaltInstructions {
+			r.halt = &h
+			halt = &h
+		}
+	})
+	return halt
+}
+
+// Wait waits until the CPU stops and returns its status.  It returns at once
+// when the CPU is paused.
+func (r *Runner) Wait(ctx context.Context) (RunnerStatus, error) {
+	w := make(chan RunnerStatus, 1)
+	r.do(func() {
+		if !r.running {
+			w <- r.status()
+			return
+		}
+		r.waiters = append(r.waiters, w)
+	})
+	select {
+	case s := <-w:
+		return s, nil
+	case <-ctx.Done():
+		return RunnerStatus{}, ctx.Err()
+	case <-r.done:
+		return RunnerStatus{}, fmt.Errorf("runner closed")
+	}
+}
+
+// ReadMemory returns a copy of n bytes of memory at address.  Reads wrap
+// around at the end of memory.
+func (r *Runner) ReadMemory(address uint16, n int) []byte {
+	b := make([]byte, n)
+	r.do(func() {
+		for i := range b {
+			b[i] = r.cpu.memory[address+uint16(i)]
+		}
+	})
+	return b
+}
+
+// WriteMemory copies b to memory at address.  Observers are not told about
+// the writes.
+func (r *Runner) WriteMemory(address uint16, b []byte) {
+	r.do(func() {
+		for i, v := range b {
+			r.cpu.memory[address+uint16(i)] = v
+		}
+	})
+}
+
+// SetBreakpoint sets or clears a breakpoint at address.  A run stops before
+// it executes the instruction at a breakpoint, except for the first
+// instruction after Resume.
+func (r *Runner) SetBreakpoint(address uint16, set bool) {
+	r.do(func() {
+		if set {
+			r.breakpoints[address] = true
+		} else {
+			delete(r.breakpoints, address)
+		}
+	})
+}
+
+// IRQ sets the state of the IRQ line.
+func (r *Runner) IRQ(asserted bool) {
+	r.do(func() { r.cpu.IRQ(asserted) })
+}
+
+// NMI signals a non maskable interrupt.
+func (r *Runner) NMI() {
+	r.do(func() { r.cpu.NMI() })
+}
+
+// Close stops the goroutine.  The CPU may be used directly afterwards.
+func (r *Runner) Close() {
+	r.cancel()
+	<-r.done
+}
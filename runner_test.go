@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runnerCPU returns a CPU counting in $10 with an IRQ handler counting in
+// $11.
+func runnerCPU() *CPU {
+	c := New()
+	copy(c.memory[0x0400:], []byte{
+		0xe6, 0x10, //       loop: inc $10
+		0x4c, 0x00, 0x04, //       jmp loop
+	})
+	copy(c.memory[0x0500:], []byte{
+		0xe6, 0x11, //       irq:  inc $11
+		0x40, //                   rti
+	})
+	c.memory[0xfffe], c.memory[0xffff] = 0x00, 0x05
+	c.pc = 0x0400
+	c.sr &^= Interrupts
+	return c
+}
+
+func TestRunner(t *testing.T) {
+	c := runnerCPU()
+	r := NewRunner(c)
+	defer r.Close()
+
+	r.Resume()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if s := r.Status(); !s.Running {
+					t.Errorf("paused: %+v", s)
+					return
+				}
+				r.ReadMemory(0x10, 2)
+			}
+		}()
+	}
+	wg.Wait()
+	s := r.Pause()
+	if s.Running || s.Halt != nil || s.Registers.Cycles == 0 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	if r.Status().Registers != s.Registers {
+		t.Fatalf("paused CPU ran")
+	}
+	if st := r.State(true); st.Registers != s.Registers ||
+		!st.Equal(r.State(true)) {
+		t.Fatalf("unexpected state %+v", st.Registers)
+	}
+
+	// breakpoints stop runs but not the first instruction of a run
+	r.SetBreakpoint(0x0402, true)
+	for i := 0; i < 2; i++ {
+		r.Resume()
+		s, err := r.Wait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Running || s.Halt == nil || s.Halt.Kind != HaltPC ||
+			s.Registers.PC != 0x0402 {
+			t.Fatalf("unexpected status %+v", s)
+		}
+		if i == 1 && s.Halt.Instructions != 2 {
+			t.Fatalf("unexpected halt %v", s.Halt)
+		}
+	}
+	r.SetBreakpoint(0x0402, false)
+
+	// the interrupt is taken by the next step
+	r.IRQ(true)
+	if h := r.Step(); h != nil {
+		t.Fatalf("unexpected halt %v", h)
+	}
+	r.IRQ(false)
+	if s := r.Status(); s.Registers.PC != 0x0502 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	if b := r.ReadMemory(0x11, 1); b[0] != 1 {
+		t.Fatalf("unexpected count %v", b[0])
+	}
+
+	r.WriteMemory(0x0400, []byte{0x02}) // jam
+	r.Resume()
+	s, err := r.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Halt.Kind != HaltInvalidOpcode || s.Halt.PC != 0x0400 {
+		t.Fatalf("unexpected halt %v", s.Halt)
+	}
+	if h := r.Step(); h == nil || h.Kind != HaltInvalidOpcode {
+		t.Fatalf("unexpected step %v", h)
+	}
+
+	r.Close()
+	if c.memory[0x0400] != 0x02 || c.pc != 0x0400 {
+		t.Fatalf("CPU not released")
+	}
+	if _, err := r.Wait(context.Background()); err == nil {
+		t.Fatalf("waited on a closed runner")
+	}
+}
+
+func TestRunnerConditions(t *testing.T) {
+	c := runnerCPU()
+	r := NewRunner(c, HaltOnMemory(0x10, 0x80, 0xff))
+	defer r.Close()
+
+	r.Resume()
+	s, err := r.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Halt.Kind != HaltMemory || s.Halt.Instructions != 255 {
+		t.Fatalf("unexpected halt %v", s.Halt)
+	}
+	if b := r.ReadMemory(0x10, 1); b[0] != 0x80 {
+		t.Fatalf("unexpected count $%02X", b[0])
+	}
+
+	// a run without an end is stopped by an interrupt handler that
+	// breaks out of the loop
+	r.WriteMemory(0x0010, []byte{0x00})
+	r.WriteMemory(0x0401, []byte{0x12})             // inc $12
+	r.WriteMemory(0x0500, []byte{0x4c, 0x00, 0x06}) // jmp $0600
+	r.WriteMemory(0x0600, []byte{0x02})             // jam
+	r.Resume()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	if _, err := r.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+	r.IRQ(true)
+	s, err = r.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Halt.Kind != HaltInvalidOpcode || s.Halt.PC != 0x0600 {
+		t.Fatalf("unexpected halt %v", s.Halt)
+	}
+}
+
+// TestRunnerCommandsMoveExecution checks that a command that raises an
+// interrupt on a running CPU is seen by breakpoints and the invalid opcode
+// check of the handler.
+func TestRunnerCommandsMoveExecution(t *testing.T) {
+	c := runnerCPU()
+	r := NewRunner(c)
+	defer r.Close()
+
+	r.SetBreakpoint(0x0500, true)
+	r.Resume()
+	r.IRQ(true)
+	s, err := r.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Halt.Kind != HaltPC || s.Halt.PC != 0x0500 ||
+		s.Registers.PC != 0x0400 && s.Registers.PC != 0x0402 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	if b := r.ReadMemory(0x11, 1); b[0] != 0 {
+		t.Fatalf("handler ran")
+	}
+	r.IRQ(false)
+	r.SetBreakpoint(0x0500, false)
+
+	r.WriteMemory(0x0500, []byte{0x02}) // jam
+	r.Resume()
+	r.IRQ(true)
+	s, err = r.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Halt.Kind != HaltInvalidOpcode || s.Halt.PC != 0x0500 {
+		t.Fatalf("unexpected halt %v", s.Halt)
+	}
+}
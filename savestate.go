@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A save state is a header followed by chunks.  Every chunk is a 4 byte id, a
+// little endian 32 bit payload length and the payload.  Readers skip chunks
+// they do not know and ignore trailing payload bytes added by newer versions
+// so that old binaries can load newer save states.
+//
+//	"CPU " pc(2) sp sr a x y cycles(8)
+//	"MEM " 65536 bytes of memory
+//	"INT " irq nmi
+//	"DEV " id length, id, device state
+
+const (
+	stateVersion = 1
+
+	stateCPUSize = 15
+)
+
+var (
+	stateMagic = []byte{'T', '6', '5', 'S'}
+
+	stateCPU        = [4]byte{'C', 'P', 'U', ' '}
+	stateMemory     = [4]byte{'M', 'E', 'M', ' '}
+	stateInterrupts = [4]byte{'I', 'N', 'T', ' '}
+	stateDevice     = [4]byte{'D', 'E', 'V', ' '}
+)
+
+// StateSaver is implemented by observers, e.g. devices, whose state is
+// included in save states.  StateID must be unique among the observers
+// attached to a CPU.
+type StateSaver interface {
+	StateID() string
+	MarshalState() ([]byte, error)
+	UnmarshalState([]byte) error
+}
+
+// Restorer is implemented by observers that keep records of past
+// execution.  LoadState calls Restored once the CPU holds the loaded state
+// so that they drop the records that no longer apply.
+type Restorer interface {
+	Restored(c *CPU)
+}
+
+func writeChunk(w io.Writer, id [4]byte, payload []byte) error {
+	var h [8]byte
+	copy(h[:], id[:])
+	binary.LittleEndian.PutUint32(h[4:], uint32(len(payload)))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// SaveState writes the complete machine state, including the state of
+// attached observers that implement StateSaver, to w.
+func (c *CPU) SaveState(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	var h [6]byte
+	copy(h[:], stateMagic)
+	binary.LittleEndian.PutUint16(h[4:], stateVersion)
+	if _, err := bw.Write(h[:]); err != nil {
+		return err
+	}
+
+	regs := make([]byte, stateCPUSize)
+	binary.LittleEndian.PutUint16(regs[0:], c.pc)
+	regs[2] = c.sp
+	regs[3] = c.sr
+	regs[4] = c.a
+	regs[5] = c.x
+	regs[6] = c.y
+	binary.LittleEndian.PutUint64(regs[7:], c.cycles)
+	if err := writeChunk(bw, stateCPU, regs); err != nil {
+		return err
+	}
+	if err := writeChunk(bw, stateMemory, c.memory); err != nil {
+		return err
+	}
+	interrupts := make([]byte, 2)
+	if c.irq {
+		interrupts[0] = 1
+	}
+	if c.nmi {
+		interrupts[1] = 1
+	}
+	if err := writeChunk(bw, stateInterrupts, interrupts); err != nil {
+		return err
+	}
+
+	for _, o := range c.observers {
+		s, ok := o.(StateSaver)
+		if !ok {
+			continue
+		}
+		id := s.StateID()
+		if len(id) > 255 {
+			return fmt.Errorf("state id too long: %v", id)
+		}
+		data, err := s.MarshalState()
+		if err != nil {
+			return fmt.Errorf("%v: %v", id, err)
+		}
+		payload := make([]byte, 0, 1+len(id)+len(data))
+		payload = append(payload, byte(len(id)))
+		payload = append(payload, id...)
+		payload = append(payload, data...)
+		if err := writeChunk(bw, stateDevice, payload); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// LoadState restores a state written by SaveState.  The CPU and its devices
+// are not modified when the save state is malformed or a device rejects its
+// state.  Device state is handed to the attached observer with the same
+// StateID; state of devices that are not attached is ignored.  Attached
+// Restorers are told once the state is loaded.
+func (c *CPU) LoadState(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	var h [6]byte
+	if _, err := io.ReadFull(br, h[:]); err != nil {
+		return fmt.Errorf("invalid save state header: %v", err)
+	}
+	if !bytes.Equal(h[:4], stateMagic) {
+		return fmt.Errorf("not a save state")
+	}
+	if v := binary.LittleEndian.Uint16(h[4:]); v == 0 {
+		return fmt.Errorf("invalid save state version: %v", v)
+	}
+
+	var (
+		regs       []byte
+		memory     []byte
+		interrupts []byte
+		devices    = make(map[string][]byte)
+	)
+	for {
+		var ch [8]byte
+		_, err := io.ReadFull(br, ch[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("truncated save state: %v", err)
+		}
+		var id [4]byte
+		copy(id[:], ch[:4])
+		length := binary.LittleEndian.Uint32(ch[4:])
+		if length > 16*1024*1024 {
+			return fmt.Errorf("chunk %q too large: %v", id, length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return fmt.Errorf("truncated chunk %q: %v", id, err)
+		}
+
+		switch id {
+		case stateCPU:
+			if len(payload) < stateCPUSize {
+				return fmt.Errorf("cpu chunk too short")
+			}
+			regs = payload
+		case stateMemory:
+			if len(payload) < len(c.memory) {
+				return fmt.Errorf("memory chunk too short")
+			}
+			memory = payload
+		case stateInterrupts:
+			if len(payload) < 2 {
+				return fmt.Errorf("interrupt chunk too short")
+			}
+			interrupts = payload
+		case stateDevice:
+			if len(payload) == 0 ||
+				len(payload) < 1+int(payload[0]) {
+				return fmt.Errorf("device chunk too short")
+			}
+			n := int(payload[0])
+			devices[string(payload[1:1+n])] = payload[1+n:]
+		}
+	}
+	if regs == nil || memory == nil {
+		return fmt.Errorf("save state lacks cpu or memory")
+	}
+
+	if err := c.loadDevices(devices); err != nil {
+		return err
+	}
+
+	c.pc = binary.LittleEndian.Uint16(regs[0:])
+	c.sp = regs[2]
+	c.sr = regs[3]
+	c.a = regs[4]
+	c.x = regs[5]
+	c.y = regs[6]
+	c.cycles = binary.LittleEndian.Uint64(regs[7:])
+	copy(c.memory, memory)
+	c.irq = false
+	c.nmi = false
+	if interrupts != nil {
+		c.irq = interrupts[0] != 0
+		c.nmi = interrupts[1] != 0
+	}
+	for _, o := range c.observers {
+		if r, ok := o.(Restorer); ok {
+			r.Restored(c)
+		}
+	}
+
+	return nil
+}
+
+// loadDevices hands the device states to the attached observers.  When a
+// device rejects its state the devices already loaded get their previous
+// state back.
+func (c *CPU) loadDevices(devices map[string][]byte) error {
+	type saved struct {
+		s    StateSaver
+		data []byte
+	}
+	var loaded []saved
+	rollback := func() {
+		for i := len(loaded) - 1; i >= 0; i-- {
+			loaded[i].s.UnmarshalState(loaded[i].data)
+		}
+	}
+	for _, o := range c.observers {
+		s, ok := o.(StateSaver)
+		if !ok {
+			continue
+		}
+		data, ok := devices[s.StateID()]
+		if !ok {
+			continue
+		}
+		old, err := s.MarshalState()
+		if err != nil {
+			rollback()
+			return fmt.Errorf("%v: %v", s.StateID(), err)
+		}
+		if err := s.UnmarshalState(data); err != nil {
+			rollback()
+			return fmt.Errorf("%v: %v", s.StateID(), err)
+		}
+		loaded = append(loaded, saved{s, old})
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+type testDevice struct {
+	id    string
+	value byte
+}
+
+func (d *testDevice) Before(c *CPU) {}
+func (d *testDevice) After(c *CPU)  {}
+
+func (d *testDevice) StateID() string { return d.id }
+
+func (d *testDevice) MarshalState() ([]byte, error) {
+	return []byte{d.value}, nil
+}
+
+func (d *testDevice) UnmarshalState(b []byte) error {
+	if len(b) != 1 {
+		return fmt.Errorf("invalid state")
+	}
+	d.value = b[0]
+	return nil
+}
+
+func TestSaveState(t *testing.T) {
+	c := traceProgram()
+	d := &testDevice{id: "dev", value: 0x42}
+	c.Attach(d)
+	for i := 0; i < 3; i++ {
+		c.executeInstruction()
+	}
+	c.IRQ(true)
+	c.NMI()
+
+	var b bytes.Buffer
+	if err := c.SaveState(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New()
+	rd := &testDevice{id: "dev"}
+	r.Attach(rd)
+	if err := r.LoadState(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if r.pc != c.pc || r.sp != c.sp || r.sr != c.sr || r.a != c.a ||
+		r.x != c.x || r.y != c.y || r.cycles != c.cycles {
+		t.Fatalf("registers differ: %v %v", r.snapshot(), c.snapshot())
+	}
+	if !bytes.Equal(r.memory, c.memory) {
+		t.Fatalf("memory differs")
+	}
+	if !r.irq || !r.nmi {
+		t.Fatalf("interrupt lines not restored")
+	}
+	if rd.value != 0x42 {
+		t.Fatalf("device state not restored: %v", rd.value)
+	}
+}
+
+func TestSaveStateForwardCompatible(t *testing.T) {
+	c := traceProgram()
+	c.a = 0x55
+	var b bytes.Buffer
+	if err := c.SaveState(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	// pretend a newer version wrote an additional chunk
+	s := b.Bytes()
+	binary.LittleEndian.PutUint16(s[4:], stateVersion+1)
+	var extra bytes.Buffer
+	if err := writeChunk(&extra, [4]byte{'N', 'E', 'W', ' '},
+		[]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	s = append(s, extra.Bytes()...)
+
+	r := New()
+	if err := r.LoadState(bytes.NewReader(s)); err != nil {
+		t.Fatal(err)
+	}
+	if r.a != 0x55 || r.pc != 0x0400 {
+		t.Fatalf("unexpected registers %v", r.snapshot())
+	}
+}
+
+func TestLoadStateInvalid(t *testing.T) {
+	c := New()
+	c.a = 0x11
+	bad := []byte("T65X\x01\x00")
+	if err := c.LoadState(bytes.NewReader(bad)); err == nil {
+		t.Fatalf("expected invalid magic")
+	}
+
+	var b bytes.Buffer
+	if err := New().SaveState(&b); err != nil {
+		t.Fatal(err)
+	}
+	truncated := b.Bytes()[:b.Len()-5]
+	if err := c.LoadState(bytes.NewReader(truncated)); err == nil {
+		t.Fatalf("expected truncated save state")
+	}
+	if c.a != 0x11 {
+		t.Fatalf("cpu modified by invalid save state")
+	}
+}
+
+func TestLoadStateInvalidDevice(t *testing.T) {
+	c := traceProgram()
+	c.a = 0x22
+	c.Attach(&testDevice{id: "a", value: 1})
+	c.Attach(&testDevice{id: "b", value: 2})
+	var b bytes.Buffer
+	if err := c.SaveState(&b); err != nil {
+		t.Fatal(err)
+	}
+	// replace the last chunk, the state of b, with two bytes of state
+	s := bytes.NewBuffer(b.Bytes()[:b.Len()-11])
+	if err := writeChunk(s, stateDevice, []byte{1, 'b', 2, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New()
+	r.a = 0x11
+	r.memory[0x0400] = 0xea
+	ra := &testDevice{id: "a", value: 3}
+	rb := &testDevice{id: "b", value: 4}
+	r.Attach(ra)
+	r.Attach(rb)
+	if err := r.LoadState(s); err == nil {
+		t.Fatalf("expected invalid device state")
+	}
+	if r.a != 0x11 || r.pc != 0 || r.memory[0x0400] != 0xea {
+		t.Fatalf("cpu modified by invalid save state %v", r.snapshot())
+	}
+	if ra.value != 3 || rb.value != 4 {
+		t.Fatalf("devices modified by invalid save state: %v %v",
+			ra.value, rb.value)
+	}
+}
+
+func TestLoadStateRestorers(t *testing.T) {
+	c := New()
+	copy(c.memory[0x0400:], []byte{
+		0x20, 0x10, 0x04, // jsr $0410
+	})
+	copy(c.memory[0x0410:], []byte{
+		0x85, 0x20, //       sta $20
+		0x4c, 0x12, 0x04, // jmp *
+	})
+	c.pc = 0x0400
+	var b bytes.Buffer
+	if err := c.SaveState(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := NewRewinder(10, 2)
+	cs := NewCallStack()
+	wt := NewWriteTracker(2)
+	em := NewEffectMonitor()
+	c.Attach(rw)
+	c.Attach(cs)
+	c.Attach(wt)
+	c.Attach(em)
+	for i := 0; i < 2; i++ {
+		c.executeInstruction()
+	}
+	if rw.Len() != 2 || cs.Depth() != 1 || len(wt.Writes(0x0020)) != 1 ||
+		len(em.frames) != 1 {
+		t.Fatalf("nothing recorded")
+	}
+
+	if err := c.LoadState(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Len() != 0 || cs.Depth() != 0 || len(wt.Writes(0x0020)) != 0 ||
+		len(em.frames) != 0 {
+		t.Fatalf("records kept: %v %v %v %v", rw.Len(), cs.Depth(),
+			wt.Writes(0x0020), len(em.frames))
+	}
+
+	// history starts over at the loaded state
+	c.executeInstruction()
+	if !rw.StepBack(c) || c.pc != 0x0400 || rw.StepBack(c) {
+		t.Fatalf("unexpected rewind to $%04X", c.pc)
+	}
+}
+
+func TestInterrupts(t *testing.T) {
+	c := New()
+	c.pc = 0x0400
+	c.sp = 0xff
+	c.sr = Unused
+	copy(c.memory[0x0400:], []byte{0xea, 0xea, 0xea}) // nop
+	c.memory[0x0600] = 0x40                           // rti
+	c.memory[0x0700] = 0x40                           // rti
+	c.memory[0xfffa] = 0x00
+	c.memory[0xfffb] = 0x07
+	c.memory[0xfffe] = 0x00
+	c.memory[0xffff] = 0x06
+
+	c.NMI()
+	c.executeInstruction() // nmi, then rti
+	if c.pc != 0x0400 || c.sp != 0xff || c.nmi {
+		t.Fatalf("nmi not serviced: %v", c.snapshot())
+	}
+
+	c.sr |= Interrupts
+	c.IRQ(true)
+	c.executeInstruction() // masked, nop
+	if c.pc != 0x0401 {
+		t.Fatalf("masked irq serviced: %v", c.snapshot())
+	}
+
+	c.sr &^= Interrupts
+	c.Attach(observerFunc(func(c *CPU) {
+		if c.pc != 0x0600 {
+			t.Fatalf("irq not taken: %v", c.snapshot())
+		}
+		if c.memory[0x01fd]&Break != 0 {
+			t.Fatalf("break set on irq")
+		}
+	}))
+	c.executeInstruction()
+}
+
+// observerFunc calls itself before every instruction.
+type observerFunc func(c *CPU)
+
+func (f observerFunc) Before(c *CPU) { f(c) }
+func (f observerFunc) After(c *CPU)  {}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Flags is the status register decoded.
+type Flags struct {
+	N bool `json:"n"` // negative
+	V bool `json:"v"` // overflow
+	B bool `json:"b"` // break
+	D bool `json:"d"` // decimal
+	I bool `json:"i"` // interrupts disabled
+	Z bool `json:"z"` // zero
+	C bool `json:"c"` // carry
+}
+
+// DecodeFlags decodes the status register sr.
+func DecodeFlags(sr byte) Flags {
+	return Flags{
+		N: sr&Negative != 0,
+		V: sr&Overflow != 0,
+		B: sr&Break != 0,
+		D: sr&BCD != 0,
+		I: sr&Interrupts != 0,
+		Z: sr&Zero != 0,
+		C: sr&Carry != 0,
+	}
+}
+
+// String returns the flags as "NV-BDIZC" with clear flags shown as '.'.
+func (f Flags) String() string {
+	flags := []byte("NV-BDIZC")
+	for i, set := range []bool{f.N, f.V, true, f.B, f.D, f.I, f.Z, f.C} {
+		if !set {
+			flags[i] = '.'
+		}
+	}
+	return string(flags)
+}
+
+// State is a copy of the state of a CPU.  Memory is nil unless it was
+// asked for.
+type State struct {
+	Registers
+	Flags  Flags
+	Memory []byte
+}
+
+// State returns the state of c, with a copy of memory if memory is set.
+func (c *CPU) State(memory bool) State {
+	s := State{Registers: c.registers(), Flags: DecodeFlags(c.sr)}
+	if memory {
+		s.Memory = append([]byte(nil), c.memory...)
+	}
+	return s
+}
+
+// Equal returns true if s and t have the same registers and memory.
+func (s State) Equal(t State) bool {
+	return s.Registers == t.Registers && bytes.Equal(s.Memory, t.Memory)
+}
+
+// Change is a register, flag or memory byte that differs between two
+// states.
+type Change struct {
+	Name string // register, flag or $address
+	Old  uint64
+	New  uint64
+}
+
+// String returns the change, e.g. "A: $00 -> $7F".
+func (c Change) String() string {
+	switch {
+	case len(c.Name) == 1 && strings.Contains("NVBDIZC", c.Name),
+		c.Name == "Cycles":
+		return fmt.Sprintf("%v: %v -> %v", c.Name, c.Old, c.New)
+	case c.Name == "PC":
+		return fmt.Sprintf("%v: $%04X -> $%04X", c.Name, c.Old, c.New)
+	}
+	return fmt.Sprintf("%v: $%02X -> $%02X", c.Name, c.Old, c.New)
+}
+
+// Changes are the differences between two states.
+type Changes []Change
+
+// Names returns the names of the changes.
+func (cs Changes) Names() []string {
+	names := make([]string, 0, len(cs))
+	for _, c := range cs {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// String returns the changes one per line.
+func (cs Changes) String() string {
+	var b strings.Builder
+	for _, c := range cs {
+		fmt.Fprintln(&b, c)
+	}
+	return b.String()
+}
+
+// Diff returns what changed from s to t: the registers, the flags instead of
+// the status register, the cycles and, when both states have memory, the
+// memory bytes in address order.
+func (s State) Diff(t State) Changes {
+	var cs Changes
+	add := func(name string, from, to uint64) {
+		if from != to {
+			cs = append(cs, Change{Name: name, Old: from, New: to})
+		}
+	}
+	add("PC", uint64(s.PC), uint64(t.PC))
+	add("A", uint64(s.A), uint64(t.A))
+	add("X", uint64(s.X), uint64(t.X))
+	add("Y", uint64(s.Y), uint64(t.Y))
+	add("SP", uint64(s.SP), uint64(t.SP))
+	for i, flag := range "NV-BDIZC" {
+		if flag == '-' {
+			continue
+		}
+		add(string(flag), uint64(s.SR>>(7-i)&1), uint64(t.SR>>(7-i)&1))
+	}
+	add("Cycles", s.Cycles, t.Cycles)
+	if s.Memory != nil && t.Memory != nil {
+		for a := 0; a < len(s.Memory) && a < len(t.Memory); a++ {
+			from, to := s.Memory[a], t.Memory[a]
+			if from != to {
+				add(fmt.Sprintf("$%04X", a), uint64(from),
+					uint64(to))
+			}
+		}
+	}
+	return cs
+}
+
+type stateJSON struct {
+	PC     uint16 `json:"pc"`
+	A      byte   `json:"a"`
+	X      byte   `json:"x"`
+	Y      byte   `json:"y"`
+	SP     byte   `json:"sp"`
+	SR     byte   `json:"sr"`
+	Cycles uint64 `json:"cycles"`
+	Flags  Flags  `json:"flags"`
+	Memory string `json:"memory,omitempty"`
+}
+
+// MarshalJSON encodes the state with memory in hex.
+func (s State) MarshalJSON() ([]byte, error) {
+	return json.Marshal(stateJSON{
+		PC:     s.PC,
+		A:      s.A,
+		X:      s.X,
+		Y:      s.Y,
+		SP:     s.SP,
+		SR:     s.SR,
+		Cycles: s.Cycles,
+		Flags:  s.Flags,
+		Memory: strings.ToUpper(hex.EncodeToString(s.Memory)),
+	})
+}
+
+// UnmarshalJSON decodes a state written by MarshalJSON.  The flags are
+// decoded from the status register.
+func (s *State) UnmarshalJSON(b []byte) error {
+	var t stateJSON
+	if err := json.Unmarshal(b, &t); err != nil {
+		return err
+	}
+	var memory []byte
+	if t.Memory != "" {
+		var err error
+		memory, err = hex.DecodeString(t.Memory)
+		if err != nil {
+			return err
+		}
+	}
+	*s = State{
+		Registers: Registers{
+			PC:     t.PC,
+			A:      t.A,
+			X:      t.X,
+			Y:      t.Y,
+			SP:     t.SP,
+			SR:     t.SR,
+			Cycles: t.Cycles,
+		},
+		Flags:  DecodeFlags(t.SR),
+		Memory: memory,
+	}
+	return nil
+}
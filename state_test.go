@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestStateDiff(t *testing.T) {
+	c := New()
+	copy(c.memory[0x0400:], []byte{
+		0xa9, 0x00, //       lda #$00
+		0x8d, 0x00, 0x02, // sta $0200
+	})
+	c.pc = 0x0400
+	c.a = 0x55
+	c.memory[0x0200] = 0xff
+
+	before := c.State(true)
+	c.executeInstruction()
+	after := c.State(true)
+	d := before.Diff(after)
+	if !reflect.DeepEqual(d.Names(), []string{"PC", "A", "Z", "Cycles"}) {
+		t.Fatalf("unexpected changes\n%v", d)
+	}
+	if d.String() != "PC: $0400 -> $0402\nA: $55 -> $00\nZ: 0 -> 1\n"+
+		"Cycles: 0 -> 2\n" {
+		t.Fatalf("unexpected changes\n%v", d)
+	}
+	if before.Equal(after) || !after.Equal(c.State(true)) {
+		t.Fatalf("unexpected equality")
+	}
+
+	c.executeInstruction()
+	d = after.Diff(c.State(true))
+	if !reflect.DeepEqual(d.Names(), []string{"PC", "Cycles", "$0200"}) {
+		t.Fatalf("unexpected changes\n%v", d)
+	}
+	if d[2].String() != "$0200: $FF -> $00" {
+		t.Fatalf("unexpected change %v", d[2])
+	}
+
+	// memory is only compared when both states have it
+	d = c.State(false).Diff(before)
+	if !reflect.DeepEqual(d.Names(), []string{"PC", "A", "Z", "Cycles"}) {
+		t.Fatalf("unexpected changes\n%v", d)
+	}
+}
+
+func TestStateFlags(t *testing.T) {
+	f := DecodeFlags(Negative | Unused | Zero | Carry)
+	if f != (Flags{N: true, Z: true, C: true}) {
+		t.Fatalf("unexpected flags %+v", f)
+	}
+	if f.String() != "N.-...ZC" {
+		t.Fatalf("unexpected flags %v", f)
+	}
+}
+
+func TestStateJSON(t *testing.T) {
+	c := New()
+	c.pc = 0x1234
+	c.a = 0x80
+	c.sr = Negative | Unused
+	c.cycles = 7
+	for _, memory := range []bool{false, true} {
+		s := c.State(memory)
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got State
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(s) || got.Flags != s.Flags {
+			t.Fatalf("unexpected state %+v", got)
+		}
+	}
+	b, err := json.Marshal(c.State(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"pc":4660,"a":128,"x":0,"y":0,"sp":255,"sr":160,` +
+		`"cycles":7,"flags":{"n":true,"v":false,"b":false,"d":false,` +
+		`"i":false,"z":false,"c":false}}`
+	if string(b) != want {
+		t.Fatalf("unexpected json %s", b)
+	}
+	if err := json.Unmarshal([]byte(`{"memory":"zz"}`),
+		new(State)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
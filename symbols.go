@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxSymbolOffset is the farthest an address may be past a symbol to be
+// named after it.
+const maxSymbolOffset = 0xff
+
+// symbol is a name at an address.
+type symbol struct {
+	address uint16
+	name    string
+}
+
+// Symbols maps names to addresses and addresses to the closest name at or
+// below them.  A nil *Symbols has no symbols.
+type Symbols struct {
+	names  map[string]uint16
+	sorted []symbol // by address, then name
+}
+
+// NewSymbols returns an empty symbol table.
+func NewSymbols() *Symbols {
+	return &Symbols{names: make(map[string]uint16)}
+}
+
+// Add defines name at address.  Names that are already defined keep their
+// first address.
+func (s *Symbols) Add(name string, address uint16) {
+	if _, ok := s.names[name]; ok {
+		return
+	}
+	s.names[name] = address
+	i := sort.Search(len(s.sorted), func(i int) bool {
+		if s.sorted[i].address != address {
+			return s.sorted[i].address > address
+		}
+		return s.sorted[i].name > name
+	})
+	s.sorted = append(s.sorted, symbol{})
+	copy(s.sorted[i+1:], s.sorted[i:])
+	s.sorted[i] = symbol{address: address, name: name}
+}
+
+// Merge adds all symbols of o.
+func (s *Symbols) Merge(o *Symbols) {
+	if o == nil {
+		return
+	}
+	for _, sym := range o.sorted {
+		s.Add(sym.name, sym.address)
+	}
+}
+
+// Len returns the number of symbols.
+func (s *Symbols) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.sorted)
+}
+
+// Label returns the address of name.
+func (s *Symbols) Label(name string) (uint16, bool) {
+	if s == nil {
+		return 0, false
+	}
+	a, ok := s.names[name]
+	return a, ok
+}
+
+// Symbol returns the closest name at or below address and the offset from
+// it.  Addresses more than maxSymbolOffset past the name, or outside the
+// zero page for a zero page name, have no symbol.
+func (s *Symbols) Symbol(address uint16) (string, uint16, bool) {
+	if s == nil {
+		return "", 0, false
+	}
+	i := sort.Search(len(s.sorted), func(i int) bool {
+		return s.sorted[i].address > address
+	})
+	if i == 0 {
+		return "", 0, false
+	}
+	a := s.sorted[i-1].address
+	if address-a > maxSymbolOffset || a < 0x100 && address >= 0x100 {
+		return "", 0, false
+	}
+	// the first name at that address
+	for i > 1 && s.sorted[i-2].address == a {
+		i--
+	}
+	return s.sorted[i-1].name, address - a, true
+}
+
+// Name returns the name at exactly address.
+func (s *Symbols) Name(address uint16) (string, bool) {
+	name, offset, ok := s.Symbol(address)
+	if !ok || offset != 0 {
+		return "", false
+	}
+	return name, true
+}
+
+// Resolve returns the address of a symbol or of an address in the format of
+// parseAddress.
+func (s *Symbols) Resolve(name string) (uint16, error) {
+	if a, ok := s.Label(name); ok {
+		return a, nil
+	}
+	a, err := parseAddress(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown symbol: %v", name)
+	}
+	return a, nil
+}
+
+// SymbolFormat is the file format of a symbol table.
+type SymbolFormat int
+
+const (
+	SymbolsAssignments SymbolFormat = iota // NAME = $ADDR lines
+	SymbolsAS65                            // AS65 listing
+	SymbolsCA65Debug                       // ca65/ld65 debug info
+	SymbolsVICE                            // VICE monitor labels
+)
+
+// ParseSymbolFormat returns the symbol format named s.
+func ParseSymbolFormat(s string) (SymbolFormat, error) {
+	switch s {
+	case "assignments":
+		return SymbolsAssignments, nil
+	case "as65":
+		return SymbolsAS65, nil
+	case "dbg":
+		return SymbolsCA65Debug, nil
+	case "vice":
+		return SymbolsVICE, nil
+	}
+	return 0, fmt.Errorf("invalid symbol format: %v", s)
+}
+
+// symbolFormat returns the symbol format of path by its extension.
+func symbolFormat(path string) SymbolFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".lst":
+		return SymbolsAS65
+	case ".dbg":
+		return SymbolsCA65Debug
+	case ".lbl", ".vs", ".labels":
+		return SymbolsVICE
+	}
+	return SymbolsAssignments
+}
+
+// parseNumber parses $hex, 0xhex, %binary and decimal numbers.  Numbers
+// with leading zeros are decimal.
+func parseNumber(s string) (uint64, error) {
+	switch {
+	case strings.HasPrefix(s, "$"):
+		return strconv.ParseUint(s[1:], 16, 32)
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		return strconv.ParseUint(s[2:], 16, 32)
+	case strings.HasPrefix(s, "%"):
+		return strconv.ParseUint(s[1:], 2, 32)
+	}
+	return strconv.ParseUint(s, 10, 32)
+}
+
+// readAssignments reads "NAME = $ADDR" lines.  Comments start with ; or #.
+func readAssignments(r io.Reader, s *Symbols) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexAny(line, ";#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("line %v: expected NAME = $ADDR", n)
+		}
+		a, err := parseNumber(strings.TrimSpace(value))
+		if err != nil || a > 0xffff {
+			return fmt.Errorf("line %v: invalid address: %v", n,
+				strings.TrimSpace(value))
+		}
+		s.Add(name, uint16(a))
+	}
+	return sc.Err()
+}
+
+// readVICELabels reads "al C:0400 .name" lines as written by ld65 -Ln and
+// the VICE monitor.
+func readVICELabels(r io.Reader, s *Symbols) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 {
+			continue
+		}
+		if f[0] != "al" || len(f) != 3 {
+			return fmt.Errorf("line %v: expected al address .label",
+				n)
+		}
+		a, err := strconv.ParseUint(strings.TrimPrefix(f[1], "C:"), 16,
+			16)
+		if err != nil {
+			return fmt.Errorf("line %v: invalid address: %v", n,
+				f[1])
+		}
+		s.Add(strings.TrimPrefix(f[2], "."), uint16(a))
+	}
+	return sc.Err()
+}
+
+// readCA65Debug reads the labels and equates of sym lines of a ca65/ld65
+// debug info file, e.g.
+//
+//	sym	id=0,name="start",addrsize=absolute,...,val=0x400,type=lab
+func readCA65Debug(r io.Reader, s *Symbols) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		kind, rest, _ := strings.Cut(sc.Text(), "\t")
+		if kind != "sym" {
+			continue
+		}
+		attrs := make(map[string]string)
+		for _, kv := range strings.Split(rest, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			attrs[k] = strings.Trim(v, `"`)
+		}
+		if attrs["type"] != "lab" && attrs["type"] != "equ" {
+			continue
+		}
+		v, ok := attrs["val"]
+		if !ok {
+			continue // imports have no value
+		}
+		a, err := parseNumber(v)
+		if err != nil || a > 0xffff || attrs["name"] == "" {
+			return fmt.Errorf("line %v: invalid symbol", n)
+		}
+		s.Add(attrs["name"], uint16(a))
+	}
+	return sc.Err()
+}
+
+// ReadSymbols reads a symbol table in format from r.
+func ReadSymbols(r io.Reader, format SymbolFormat) (*Symbols, error) {
+	s := NewSymbols()
+	var err error
+	switch format {
+	case SymbolsAS65:
+		var l *Listing
+		l, err = parseListing(r)
+		if err == nil {
+			s = l.symbols
+		}
+	case SymbolsCA65Debug:
+		err = readCA65Debug(r, s)
+	case SymbolsVICE:
+		err = readVICELabels(r, s)
+	default:
+		err = readAssignments(r, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadSymbols reads the symbol table at path in the format of its
+// extension.
+func LoadSymbols(path string) (*Symbols, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := ReadSymbols(f, symbolFormat(path))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return s, nil
+}
+
+// SetSymbols names addresses in disassembly, traces and trap reports.
+func (c *CPU) SetSymbols(s *Symbols) {
+	c.symbols = s
+}
+
+// addressName returns address as the symbol at or below it plus offset, or
+// in hex when there is none.
+func (s *Symbols) addressName(address uint16) string {
+	if name, offset, ok := s.Symbol(address); ok {
+		if offset == 0 {
+			return name
+		}
+		return fmt.Sprintf("%v+$%X", name, offset)
+	}
+	return fmt.Sprintf("$%04X", address)
+}
+
+// location returns address in hex followed by the symbol at or below it, if
+// any, e.g. "$3399 (success)".
+func (c *CPU) location(address uint16) string {
+	if _, _, ok := c.symbols.Symbol(address); ok {
+		return fmt.Sprintf("$%04X (%v)", address,
+			c.symbols.addressName(address))
+	}
+	return fmt.Sprintf("$%04X", address)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSymbols(t *testing.T) {
+	tests := []struct {
+		name   string
+		format SymbolFormat
+		table  string
+	}{
+		{"assignments", SymbolsAssignments,
+			"; comment\nstart = $0400\nptr = %10000 # zero page\n" +
+				"main=0x0410\n"},
+		{"vice", SymbolsVICE,
+			"al C:0400 .start\nal C:0010 .ptr\nal C:0410 .main\n"},
+		{"dbg", SymbolsCA65Debug, "version\tmajor=2,minor=0\n" +
+			"sym\tid=0,name=\"start\",addrsize=absolute," +
+			"def=1,val=0x400,seg=0,type=lab\n" +
+			"sym\tid=1,name=\"ptr\",addrsize=zeropage," +
+			"def=2,val=0x10,type=equ\n" +
+			"sym\tid=2,name=\"main\",addrsize=absolute," +
+			"def=3,val=0x410,seg=0,type=lab\n" +
+			"sym\tid=3,name=\"extern\",addrsize=absolute," +
+			"ref=4,type=imp\n"},
+	}
+	for _, test := range tests {
+		s, err := ReadSymbols(strings.NewReader(test.table),
+			test.format)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if s.Len() != 3 {
+			t.Fatalf("%v: %v symbols", test.name, s.Len())
+		}
+		for name, want := range map[string]uint16{
+			"start": 0x0400, "ptr": 0x0010, "main": 0x0410,
+		} {
+			if a, ok := s.Label(name); !ok || a != want {
+				t.Fatalf("%v: %v = $%04X", test.name, name, a)
+			}
+		}
+	}
+
+	_, err := ReadSymbols(strings.NewReader("start $0400\n"),
+		SymbolsAssignments)
+	if err == nil || err.Error() != "line 1: expected NAME = $ADDR" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, err = ReadSymbols(strings.NewReader("al C:zz .x\n"), SymbolsVICE)
+	if err == nil || !strings.Contains(err.Error(), "invalid address") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestSymbolLookup(t *testing.T) {
+	s := NewSymbols()
+	s.Add("start", 0x0400)
+	s.Add("begin", 0x0400)
+	s.Add("loop", 0x0408)
+	s.Add("start", 0x0500) // first definition wins
+
+	if name, offset, ok := s.Symbol(0x0403); !ok || name != "begin" ||
+		offset != 3 {
+		t.Fatalf("unexpected symbol %v+%v", name, offset)
+	}
+	if _, _, ok := s.Symbol(0x03ff); ok {
+		t.Fatalf("symbol below the first")
+	}
+	if name := s.addressName(0x040a); name != "loop+$2" {
+		t.Fatalf("unexpected name %v", name)
+	}
+	if name := s.addressName(0x0010); name != "$0010" {
+		t.Fatalf("unexpected name %v", name)
+	}
+	// names do not reach far past their address or out of the zero page
+	s.Add("ERROR", 0x000b)
+	for address, want := range map[uint16]string{
+		0x0507: "loop+$FF", 0x0508: "$0508", 0x00ff: "ERROR+$F4",
+		0x0100: "$0100",
+	} {
+		if name := s.addressName(address); name != want {
+			t.Fatalf("$%04X: expected %v, got %v", address, want,
+				name)
+		}
+	}
+	for expr, want := range map[string]uint16{
+		"start": 0x0400, "loop": 0x0408, "$1234": 0x1234, "0x10": 0x10,
+		"0X10": 0x10, "1024": 0x0400, "0400": 400, "0755": 755,
+		"%101": 5,
+	} {
+		if a, err := s.Resolve(expr); err != nil || a != want {
+			t.Fatalf("resolve %v: $%04X %v", expr, a, err)
+		}
+	}
+	for _, expr := range []string{"nothere", "0b11", "0o17", "$10000",
+		"65536", "0x"} {
+		if a, err := s.Resolve(expr); err == nil {
+			t.Fatalf("resolved %v to $%04X", expr, a)
+		}
+	}
+
+	var none *Symbols
+	if none.Len() != 0 || none.addressName(0x0400) != "$0400" {
+		t.Fatalf("nil symbols")
+	}
+}
+
+func TestSymbolsCPU(t *testing.T) {
+	s := NewSymbols()
+	s.Add("main", 0x0400)
+	s.Add("ptr", 0x0010)
+	s.Add("sub", 0x0410)
+
+	c := New()
+	copy(c.memory[0x0400:], []byte{
+		0xb1, 0x10, // lda (ptr),y
+		0x20, 0x10, 0x04, // jsr sub
+		0xad, 0x00, 0x20, // lda $2000
+	})
+	c.SetSymbols(s)
+	c.pc = 0x0400
+
+	for _, want := range []string{"LDA\t(ptr),Y", "JSR\tsub",
+		"LDA\t$2000"} {
+		d, n := c.disassemble(c.pc)
+		if d != want {
+			t.Fatalf("expected %q, got %q", want, d)
+		}
+		c.pc += uint16(n)
+	}
+
+	c.pc = 0x0402
+	r := c.traceRecord()
+	if r.Symbol != "main+$2" ||
+		!strings.HasSuffix(r.String(), " ; main+$2") {
+		t.Fatalf("unexpected trace %v", r)
+	}
+	if l := c.location(0x0410); l != "$0410 (sub)" {
+		t.Fatalf("unexpected location %v", l)
+	}
+	if l := c.location(0x0008); l != "$0008" {
+		t.Fatalf("unexpected location %v", l)
+	}
+}
+
+func TestLoadSymbols(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lbl")
+	err := os.WriteFile(path, []byte("al C:0400 .start\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadSymbols(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := s.Label("start"); !ok || a != 0x0400 {
+		t.Fatalf("start = $%04X", a)
+	}
+	_, err = LoadSymbols(filepath.Join(t.TempDir(), "x.sym"))
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// LoopBound limits the iterations of a loop, counted as executions of its
+// header block each time the loop is entered.
+type LoopBound struct {
+	Min, Max int
+}
+
+// PathStep is a basic block, or a loop, on a path through a subroutine.
+type PathStep struct {
+	Block      uint16     // block, or loop header
+	Cycles     uint64     // cycles of the block, or of one iteration
+	Iterations int        // times Body repeats, loops only
+	Body       []PathStep // one iteration, loops only
+}
+
+// Timing is the static cycle count of a subroutine, including the
+// subroutines it calls, from its first instruction through its return.
+type Timing struct {
+	Entry    uint16
+	Min, Max uint64
+	MinPath  []PathStep         // best case path
+	MaxPath  []PathStep         // worst case path
+	Calls    map[uint16]*Timing // direct callees
+}
+
+// instructionCycles returns the best and worst case cycles of the
+// instruction at address, which is not a branch.  Indexed modes take
+// extraCycles when they cross a page, which absolute indexing from a page
+// aligned base can not.
+func instructionCycles(c *CPU, address uint16) (uint64, uint64) {
+	o := opcodes[c.memory[address]]
+	switch o.mode {
+	case absoluteX, absoluteY:
+		if c.memory[address+1] == 0 {
+			return o.noCycles, o.noCycles
+		}
+		return o.noCycles, o.noCycles + o.extraCycles
+	case zeroPageIndirectY:
+		return o.noCycles, o.noCycles + o.extraCycles
+	}
+	return o.noCycles, o.noCycles
+}
+
+// branchCycles returns the cycles of the branch at address.  A taken branch
+// takes one cycle more, two when it lands in another page.
+func branchCycles(c *CPU, address uint16, taken bool) uint64 {
+	o := opcodes[c.memory[address]]
+	if !taken {
+		return o.noCycles
+	}
+	next := address + uint16(o.noBytes)
+	if c.relative(address)&0xff00 != next&0xff00 {
+		return o.noCycles + 2
+	}
+	return o.noCycles + 1
+}
+
+// timingEdge is control flow between nodes of the timing graph, with the
+// cycles of the node it leaves.  Nodes are blocks or collapsed loops.
+type timingEdge struct {
+	to               uint16
+	exit             bool // returns from the subroutine
+	min, max         uint64
+	minPath, maxPath []PathStep
+}
+
+// timingPath is the best and worst path to a terminal edge.
+type timingPath struct {
+	min, max         uint64
+	minPath, maxPath []PathStep
+}
+
+// Terminal keys other than loop exit targets.
+const (
+	terminalBack = -1 // back to the loop header
+	terminalExit = -2 // return from the subroutine
+)
+
+func concatPath(a, b []PathStep) []PathStep {
+	return append(append([]PathStep(nil), a...), b...)
+}
+
+func mergePath(r map[int]timingPath, k int, p timingPath) {
+	q, ok := r[k]
+	if !ok {
+		r[k] = p
+		return
+	}
+	if p.min < q.min {
+		q.min, q.minPath = p.min, p.minPath
+	}
+	if p.max > q.max {
+		q.max, q.maxPath = p.max, p.maxPath
+	}
+	r[k] = q
+}
+
+// timingPaths returns the best and worst paths from node from through the
+// acyclic graph to the edges terminal selects, by terminal key.
+func timingPaths(graph map[uint16][]timingEdge, from uint16,
+	terminal func(timingEdge) (int, bool)) (map[int]timingPath, error) {
+
+	memo := make(map[uint16]map[int]timingPath)
+	visiting := make(map[uint16]bool)
+	var walk func(n uint16) (map[int]timingPath, error)
+	walk = func(n uint16) (map[int]timingPath, error) {
+		if r, ok := memo[n]; ok {
+			return r, nil
+		}
+		if visiting[n] {
+			return nil, fmt.Errorf("irreducible loop at $%04X", n)
+		}
+		visiting[n] = true
+		r := make(map[int]timingPath)
+		for _, e := range graph[n] {
+			if k, ok := terminal(e); ok {
+				mergePath(r, k, timingPath{e.min, e.max,
+					e.minPath, e.maxPath})
+				continue
+			}
+			next, err := walk(e.to)
+			if err != nil {
+				return nil, err
+			}
+			for k, p := range next {
+				mergePath(r, k, timingPath{
+					min:     e.min + p.min,
+					max:     e.max + p.max,
+					minPath: concatPath(e.minPath, p.minPath),
+					maxPath: concatPath(e.maxPath, p.maxPath),
+				})
+			}
+		}
+		delete(visiting, n)
+		memo[n] = r
+		return r, nil
+	}
+	return walk(from)
+}
+
+// timingLoop is a natural loop of the timing graph.
+type timingLoop struct {
+	header uint16
+	body   map[uint16]bool // including the header
+}
+
+// findLoops returns the loops of graph reachable from entry, innermost
+// first.
+func findLoops(graph map[uint16][]timingEdge, entry uint16) ([]timingLoop,
+	error) {
+
+	preds := make(map[uint16][]uint16)
+	for n, edges := range graph {
+		for _, e := range edges {
+			if !e.exit {
+				preds[e.to] = append(preds[e.to], n)
+			}
+		}
+	}
+
+	// Edges to blocks on the depth first search stack close loops.
+	latches := make(map[uint16][]uint16)
+	state := make(map[uint16]int) // 1 on stack, 2 done
+	var dfs func(n uint16)
+	dfs = func(n uint16) {
+		state[n] = 1
+		for _, e := range graph[n] {
+			if e.exit {
+				continue
+			}
+			switch state[e.to] {
+			case 0:
+				dfs(e.to)
+			case 1:
+				latches[e.to] = append(latches[e.to], n)
+			}
+		}
+		state[n] = 2
+	}
+	dfs(entry)
+
+	loops := make([]timingLoop, 0, len(latches))
+	for h, ls := range latches {
+		body := map[uint16]bool{h: true}
+		todo := append([]uint16(nil), ls...)
+		for len(todo) > 0 {
+			n := todo[len(todo)-1]
+			todo = todo[:len(todo)-1]
+			if body[n] {
+				continue
+			}
+			// Only loops whose header dominates the latches
+			// are reducible.
+			if n == entry {
+				return nil, fmt.Errorf("irreducible loop at "+
+					"$%04X", h)
+			}
+			body[n] = true
+			todo = append(todo, preds[n]...)
+		}
+		loops = append(loops, timingLoop{header: h, body: body})
+	}
+	sort.Slice(loops, func(i, j int) bool {
+		if len(loops[i].body) != len(loops[j].body) {
+			return len(loops[i].body) < len(loops[j].body)
+		}
+		return loops[i].header < loops[j].header
+	})
+	return loops, nil
+}
+
+// loopPath returns iterations of body followed by the exit path.
+func loopPath(header uint16, iterations int, cycles uint64,
+	body, exit []PathStep) []PathStep {
+
+	if iterations == 0 {
+		return exit
+	}
+	return concatPath([]PathStep{{
+		Block:      header,
+		Cycles:     cycles,
+		Iterations: iterations,
+		Body:       body,
+	}}, exit)
+}
+
+// collapseLoop replaces the loop in graph by its header with edges for
+// every way out of the loop.
+func collapseLoop(graph map[uint16][]timingEdge, lp timingLoop,
+	bound LoopBound) error {
+
+	h := lp.header
+	if bound.Min < 1 {
+		bound.Min = 1
+	}
+	if bound.Max < bound.Min {
+		return fmt.Errorf("invalid bound %v:%v for loop at $%04X",
+			bound.Min, bound.Max, h)
+	}
+	r, err := timingPaths(graph, h, func(e timingEdge) (int, bool) {
+		switch {
+		case e.exit:
+			return terminalExit, true
+		case e.to == h:
+			return terminalBack, true
+		case !lp.body[e.to]:
+			return int(e.to), true
+		}
+		return 0, false
+	})
+	if err != nil {
+		return err
+	}
+	iter := r[terminalBack]
+	delete(r, terminalBack)
+
+	keys := make([]int, 0, len(r))
+	for k := range r {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	edges := make([]timingEdge, 0, len(keys))
+	for _, k := range keys {
+		p := r[k]
+		edges = append(edges, timingEdge{
+			to:   uint16(k),
+			exit: k == terminalExit,
+			min:  uint64(bound.Min-1)*iter.min + p.min,
+			max:  uint64(bound.Max-1)*iter.max + p.max,
+			minPath: loopPath(h, bound.Min-1, iter.min, iter.minPath,
+				p.minPath),
+			maxPath: loopPath(h, bound.Max-1, iter.max, iter.maxPath,
+				p.maxPath),
+		})
+	}
+	for n := range lp.body {
+		delete(graph, n)
+	}
+	graph[h] = edges
+	return nil
+}
+
+// timingAnalyzer computes the timing of subroutines of a CFG and their
+// callees.
+type timingAnalyzer struct {
+	g      *CFG
+	bounds map[uint16]LoopBound
+	done   map[uint16]*Timing
+	active map[uint16]bool
+}
+
+// AnalyzeTiming statically computes the best and worst case cycles of the
+// subroutine at entry in g.  Every loop needs a bound, keyed by the address
+// of its header block.  Paths end at RTS, RTI and BRK; calls add the cycles
+// of the callee.
+//
+// Unlike the emulator, which always adds extraCycles, page crossings and
+// taken branches are counted the way the hardware does.
+func AnalyzeTiming(g *CFG, entry uint16, bounds map[uint16]LoopBound) (*Timing,
+	error) {
+
+	ta := &timingAnalyzer{
+		g:      g,
+		bounds: bounds,
+		done:   make(map[uint16]*Timing),
+		active: make(map[uint16]bool),
+	}
+	return ta.subroutine(entry)
+}
+
+// blockEdges returns the timing edges out of block b.
+func (ta *timingAnalyzer) blockEdges(b *BasicBlock, t *Timing) ([]timingEdge,
+	error) {
+
+	c := ta.g.cpu
+	if b.Exit == "invalid" {
+		return nil, fmt.Errorf("invalid opcode $%02X at $%04X",
+			c.memory[b.Last()], b.Last())
+	}
+	var min, max uint64
+	branch := opcodes[c.memory[b.Last()]].mode == relative
+	for _, a := range b.Instructions {
+		if branch && a == b.Last() {
+			break
+		}
+		lo, hi := instructionCycles(c, a)
+		min += lo
+		max += hi
+	}
+	for _, call := range b.Calls {
+		ct, err := ta.subroutine(call.Callee)
+		if err != nil {
+			return nil, err
+		}
+		t.Calls[call.Callee] = ct
+		min += ct.Min
+		max += ct.Max
+	}
+
+	edge := func(e timingEdge) timingEdge {
+		e.minPath = []PathStep{{Block: b.Start, Cycles: e.min}}
+		e.maxPath = []PathStep{{Block: b.Start, Cycles: e.max}}
+		return e
+	}
+	if b.Exit != "" {
+		return []timingEdge{edge(timingEdge{exit: true, min: min,
+			max: max})}, nil
+	}
+	edges := make([]timingEdge, 0, len(b.Edges))
+	for _, e := range b.Edges {
+		var extra uint64
+		if branch {
+			extra = branchCycles(c, b.Last(), e.Kind == EdgeTaken)
+		}
+		edges = append(edges, edge(timingEdge{to: e.To,
+			min: min + extra, max: max + extra}))
+	}
+	return edges, nil
+}
+
+func (ta *timingAnalyzer) subroutine(entry uint16) (*Timing, error) {
+	if t, ok := ta.done[entry]; ok {
+		return t, nil
+	}
+	if ta.active[entry] {
+		return nil, fmt.Errorf("recursive call to $%04X", entry)
+	}
+	s, ok := ta.g.Subroutines[entry]
+	if !ok {
+		return nil, fmt.Errorf("no subroutine at $%04X", entry)
+	}
+	ta.active[entry] = true
+	defer delete(ta.active, entry)
+
+	t := &Timing{Entry: entry, Calls: make(map[uint16]*Timing)}
+	graph := make(map[uint16][]timingEdge)
+	for _, b := range s.sortedBlocks() {
+		edges, err := ta.blockEdges(b, t)
+		if err != nil {
+			return nil, err
+		}
+		graph[b.Start] = edges
+	}
+	loops, err := findLoops(graph, entry)
+	if err != nil {
+		return nil, err
+	}
+	for _, lp := range loops {
+		bound, ok := ta.bounds[lp.header]
+		if !ok {
+			return nil, fmt.Errorf("loop at $%04X needs a bound",
+				lp.header)
+		}
+		if err := collapseLoop(graph, lp, bound); err != nil {
+			return nil, err
+		}
+	}
+	r, err := timingPaths(graph, entry, func(e timingEdge) (int, bool) {
+		return terminalExit, e.exit
+	})
+	if err != nil {
+		return nil, err
+	}
+	p, ok := r[terminalExit]
+	if !ok {
+		return nil, fmt.Errorf("$%04X does not return", entry)
+	}
+	t.Min, t.Max = p.min, p.max
+	t.MinPath, t.MaxPath = p.minPath, p.maxPath
+	ta.done[entry] = t
+	return t, nil
+}
+
+// timingName returns address in hex followed by its name in listing l, if
+// any.
+func timingName(l *Listing, address uint16) string {
+	s := fmt.Sprintf("$%04X", address)
+	if name := symbolName(l, address); name != s {
+		s += " " + name
+	}
+	return s
+}
+
+// writePath writes steps, loops indented under their iteration count.
+func writePath(w io.Writer, l *Listing, steps []PathStep, indent int) {
+	pad := strings.Repeat("  ", indent)
+	for _, s := range steps {
+		if s.Body == nil {
+			fmt.Fprintf(w, "%v%-30v %6v\n", pad,
+				timingName(l, s.Block), s.Cycles)
+			continue
+		}
+		fmt.Fprintf(w, "%v%v iterations of loop %v, %v cycles each\n",
+			pad, s.Iterations, timingName(l, s.Block), s.Cycles)
+		writePath(w, l, s.Body, indent+1)
+	}
+}
+
+// WriteReport writes the best and worst case cycles of the subroutine and
+// its callees and the worst case path through each.  Names come from listing
+// l when not nil.
+func (t *Timing) WriteReport(w io.Writer, l *Listing) error {
+	bw := bufio.NewWriter(w)
+	seen := make(map[uint16]bool)
+	todo := []*Timing{t}
+	for len(todo) > 0 {
+		t := todo[0]
+		todo = todo[1:]
+		if seen[t.Entry] {
+			continue
+		}
+		seen[t.Entry] = true
+		if len(seen) > 1 {
+			fmt.Fprintf(bw, "\n")
+		}
+		fmt.Fprintf(bw, "%v: %v to %v cycles\n",
+			timingName(l, t.Entry), t.Min, t.Max)
+		fmt.Fprintf(bw, "worst case path:\n")
+		writePath(bw, l, t.MaxPath, 1)
+
+		callees := make([]uint16, 0, len(t.Calls))
+		for a := range t.Calls {
+			callees = append(callees, a)
+		}
+		sort.Slice(callees, func(i, j int) bool {
+			return callees[i] < callees[j]
+		})
+		for _, a := range callees {
+			todo = append(todo, t.Calls[a])
+		}
+	}
+	return bw.Flush()
+}
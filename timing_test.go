@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func timingProgram(t *testing.T, lines []string) (*CPU, *Listing) {
+	bin, lst := writeTestListing(t, lines)
+	l, err := loadListing(lst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New()
+	if err := c.load(bin, 0); err != nil {
+		t.Fatal(err)
+	}
+	return c, l
+}
+
+func TestInstructionCycles(t *testing.T) {
+	c := New()
+	copy(c.memory[0x0200:], []byte{
+		0xbd, 0x00, 0x05, // lda $0500,x
+		0xbd, 0x01, 0x05, // lda $0501,x
+		0xb1, 0x10, // lda ($10),y
+		0x8d, 0x01, 0x05, // sta $0501
+	})
+	tests := []struct {
+		address  uint16
+		min, max uint64
+	}{
+		{0x0200, 4, 4},
+		{0x0203, 4, 5},
+		{0x0206, 5, 6},
+		{0x0208, 4, 4},
+	}
+	for _, test := range tests {
+		min, max := instructionCycles(c, test.address)
+		if min != test.min || max != test.max {
+			t.Fatalf("$%04X: %v %v", test.address, min, max)
+		}
+	}
+
+	copy(c.memory[0x04fc:], []byte{0xd0, 0x02, 0xd0, 0x02})
+	if n := branchCycles(c, 0x04fc, false); n != 2 {
+		t.Fatalf("not taken %v", n)
+	}
+	if n := branchCycles(c, 0x04fc, true); n != 4 {
+		t.Fatalf("taken across page %v", n)
+	}
+	if n := branchCycles(c, 0x04fe, true); n != 3 {
+		t.Fatalf("taken %v", n)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	c, l := timingProgram(t, []string{
+		"0400 a203|start   ldx #3",
+		"0402 201004|loop    jsr sub",
+		"0405 ca|        dex",
+		"0406 d0fa|        bne loop",
+		"0408 60|        rts",
+		"0410 bd0005|sub     lda $0500,x",
+		"0413 b9ff04|        lda $04ff,y",
+		"0416 60|        rts",
+	})
+	g := BuildCFG(c, l, []uint16{0x0400})
+
+	if _, err := AnalyzeTiming(g, 0x0400, nil); err == nil ||
+		!strings.Contains(err.Error(), "$0402 needs a bound") {
+		t.Fatalf("expected missing bound, got %v", err)
+	}
+
+	tm, err := AnalyzeTiming(g, 0x0400,
+		map[uint16]LoopBound{0x0402: {3, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm.Min != 82 || tm.Max != 85 {
+		t.Fatalf("cycles %v to %v", tm.Min, tm.Max)
+	}
+	sub := tm.Calls[0x0410]
+	if sub == nil || sub.Min != 14 || sub.Max != 15 {
+		t.Fatalf("sub %+v", sub)
+	}
+	want := []PathStep{
+		{Block: 0x0400, Cycles: 2},
+		{Block: 0x0402, Cycles: 26, Iterations: 2,
+			Body: []PathStep{{Block: 0x0402, Cycles: 26}}},
+		{Block: 0x0402, Cycles: 25},
+		{Block: 0x0408, Cycles: 6},
+	}
+	if !reflect.DeepEqual(tm.MaxPath, want) {
+		t.Fatalf("worst case path %+v", tm.MaxPath)
+	}
+
+	tm, err = AnalyzeTiming(g, 0x0400,
+		map[uint16]LoopBound{0x0402: {1, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm.Min != 32 || tm.Max != 85 {
+		t.Fatalf("cycles %v to %v", tm.Min, tm.Max)
+	}
+
+	var b bytes.Buffer
+	if err := tm.WriteReport(&b, l); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"$0400 start: 32 to 85 cycles",
+		"2 iterations of loop $0402 loop, 26 cycles each",
+		"$0410 sub: 14 to 15 cycles",
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Fatalf("missing %q in\n%v", s, b.String())
+		}
+	}
+}
+
+func TestTimingNestedLoops(t *testing.T) {
+	c, l := timingProgram(t, []string{
+		"0400 a002|start   ldy #2",
+		"0402 a203|outer   ldx #3",
+		"0404 ca|inner   dex",
+		"0405 d0fd|        bne inner",
+		"0407 88|        dey",
+		"0408 d0f8|        bne outer",
+		"040a 60|        rts",
+	})
+	g := BuildCFG(c, l, []uint16{0x0400})
+	tm, err := AnalyzeTiming(g, 0x0400, map[uint16]LoopBound{
+		0x0402: {2, 2},
+		0x0404: {3, 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm.Min != 49 || tm.Max != 49 {
+		t.Fatalf("cycles %v to %v", tm.Min, tm.Max)
+	}
+}
+
+func TestTimingErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		err   string
+	}{
+		{
+			name: "recursion",
+			lines: []string{
+				"0400 200004|start   jsr start",
+				"0403 60|        rts",
+			},
+			err: "recursive call to $0400",
+		},
+		{
+			name: "no return",
+			lines: []string{
+				"0400 4c0004|start   jmp start",
+			},
+			err: "$0400 does not return",
+		},
+		{
+			name: "invalid",
+			lines: []string{
+				"0400 ea|start   nop",
+				"0401 02|        .byte 2",
+			},
+			err: "invalid opcode $02 at $0401",
+		},
+		{
+			name: "irreducible",
+			lines: []string{
+				"0400 f003|start   beq b",
+				"0402 e8|a       inx",
+				"0403 d0fd|        bne a",
+				"0405 ca|b       dex",
+				"0406 d0fa|        bne a",
+				"0408 60|        rts",
+			},
+			err: "irreducible loop",
+		},
+	}
+	for _, test := range tests {
+		c, l := timingProgram(t, test.lines)
+		g := BuildCFG(c, l, []uint16{0x0400})
+		_, err := AnalyzeTiming(g, 0x0400, map[uint16]LoopBound{
+			0x0400: {1, 1},
+			0x0402: {1, 1},
+			0x0405: {1, 1},
+		})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%v: expected %q, got %v", test.name, test.err,
+				err)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// TraceFormat selects the output format of a Tracer.
+type TraceFormat int
+
+const (
+	TraceNestest TraceFormat = iota // nestest.log compatible text
+	TraceBinary                     // fixed size binary records
+	TraceJSON                       // JSON lines
+)
+
+// traceMagic starts a binary trace.  The last byte is the format version.
+var traceMagic = []byte{'T', '6', '5', 1}
+
+const traceBinarySize = 19 // size of a binary trace record
+
+// ParseTraceFormat returns the trace format named s.
+func ParseTraceFormat(s string) (TraceFormat, error) {
+	switch s {
+	case "nestest":
+		return TraceNestest, nil
+	case "binary":
+		return TraceBinary, nil
+	case "json":
+		return TraceJSON, nil
+	}
+	return 0, fmt.Errorf("invalid trace format: %v", s)
+}
+
+// AddressRange is an inclusive range of addresses.
+type AddressRange struct {
+	Start uint16
+	End   uint16
+}
+
+// Contains returns true if address lies within the range.
+func (r AddressRange) Contains(address uint16) bool {
+	return address >= r.Start && address <= r.End
+}
+
+// TraceRecord is the machine state before an instruction executes.
+type TraceRecord struct {
+	PC          uint16
+	Bytes       []byte // raw instruction bytes
+	Disassembly string
+	A           byte
+	X           byte
+	Y           byte
+	P           byte
+	SP          byte
+	Cycles      uint64
+	Symbol      string // symbol and offset of PC, when symbols are set
+}
+
+type traceJSON struct {
+	PC          uint16 `json:"pc"`
+	Bytes       string `json:"bytes"`
+	Disassembly string `json:"disasm"`
+	A           byte   `json:"a"`
+	X           byte   `json:"x"`
+	Y           byte   `json:"y"`
+	P           byte   `json:"p"`
+	SP          byte   `json:"sp"`
+	Cycles      uint64 `json:"cycles"`
+	Symbol      string `json:"symbol,omitempty"`
+}
+
+// MarshalJSON encodes the record with the instruction bytes in hex.
+func (r TraceRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(traceJSON{
+		PC:          r.PC,
+		Bytes:       strings.ToUpper(hex.EncodeToString(r.Bytes)),
+		Disassembly: r.Disassembly,
+		A:           r.A,
+		X:           r.X,
+		Y:           r.Y,
+		P:           r.P,
+		SP:          r.SP,
+		Cycles:      r.Cycles,
+		Symbol:      r.Symbol,
+	})
+}
+
+// UnmarshalJSON decodes a record written by MarshalJSON.
+func (r *TraceRecord) UnmarshalJSON(b []byte) error {
+	var t traceJSON
+	if err := json.Unmarshal(b, &t); err != nil {
+		return err
+	}
+	raw, err := hex.DecodeString(t.Bytes)
+	if err != nil {
+		return err
+	}
+	*r = TraceRecord{
+		PC:          t.PC,
+		Bytes:       raw,
+		Disassembly: t.Disassembly,
+		A:           t.A,
+		X:           t.X,
+		Y:           t.Y,
+		P:           t.P,
+		SP:          t.SP,
+		Cycles:      t.Cycles,
+		Symbol:      t.Symbol,
+	}
+	return nil
+}
+
+// String returns the record in nestest.log format, with the registers from
+// column 48 on.  The symbol, if any, follows as a comment.
+func (r TraceRecord) String() string {
+	raw := make([]string, 0, len(r.Bytes))
+	for _, b := range r.Bytes {
+		raw = append(raw, fmt.Sprintf("%02X", b))
+	}
+	s := fmt.Sprintf("%04X  %-8s  %-31s A:%02X X:%02X Y:%02X P:%02X "+
+		"SP:%02X CYC:%d", r.PC, strings.Join(raw, " "), r.Disassembly,
+		r.A, r.X, r.Y, r.P, r.SP, r.Cycles)
+	if r.Symbol != "" {
+		s += " ; " + r.Symbol
+	}
+	return s
+}
+
+// traceRecord returns the trace record for the instruction at pc.
+func (c *CPU) traceRecord() TraceRecord {
+	o := opcodes[c.memory[c.pc]]
+	n := o.noBytes
+	if n == 0 {
+		n = 1 // invalid opcode
+	}
+	raw := make([]byte, n)
+	for i := range raw {
+		raw[i] = c.memory[c.pc+uint16(i)]
+	}
+	r := TraceRecord{
+		PC:          c.pc,
+		Bytes:       raw,
+		Disassembly: c.traceDisassemble(c.pc),
+		A:           c.a,
+		X:           c.x,
+		Y:           c.y,
+		P:           c.sr,
+		SP:          c.sp,
+		Cycles:      c.cycles,
+	}
+	if c.symbols.Len() > 0 {
+		r.Symbol = c.symbols.addressName(c.pc)
+	}
+	return r
+}
+
+// traceDisassemble disassembles the instruction at address in nestest.log
+// style, which annotates effective addresses and the values found there.
+func (c *CPU) traceDisassemble(address uint16) string {
+	m := c.memory
+	opcode := m[address]
+	o := opcodes[opcode]
+	zp := m[address+1]
+	abs := uint16(m[address+1]) | uint16(m[address+2])<<8
+
+	switch o.mode {
+	case implied:
+		return o.mnemonic
+	case accumulator:
+		return o.mnemonic + " A"
+	case immediate:
+		return fmt.Sprintf("%v #$%02X", o.mnemonic, zp)
+	case relative:
+		return fmt.Sprintf("%v $%04X", o.mnemonic, c.relative(address))
+	case zeroPage:
+		return fmt.Sprintf("%v $%02X = %02X", o.mnemonic, zp, m[zp])
+	case zeroPageX:
+		a := zp + c.x
+		return fmt.Sprintf("%v $%02X,X @ %02X = %02X", o.mnemonic, zp,
+			a, m[a])
+	case zeroPageY:
+		a := zp + c.y
+		return fmt.Sprintf("%v $%02X,Y @ %02X = %02X", o.mnemonic, zp,
+			a, m[a])
+	case absolute:
+		if opcode == 0x20 || opcode == 0x4c { // JSR, JMP
+			return fmt.Sprintf("%v $%04X", o.mnemonic, abs)
+		}
+		return fmt.Sprintf("%v $%04X = %02X", o.mnemonic, abs, m[abs])
+	case absoluteX:
+		a := abs + uint16(c.x)
+		return fmt.Sprintf("%v $%04X,X @ %04X = %02X", o.mnemonic, abs,
+			a, m[a])
+	case absoluteY:
+		a := abs + uint16(c.y)
+		return fmt.Sprintf("%v $%04X,Y @ %04X = %02X", o.mnemonic, abs,
+			a, m[a])
+	case indirect:
+		return fmt.Sprintf("%v ($%04X) = %04X", o.mnemonic, abs,
+			c.indirect(address))
+	case zeroPageIndirectX:
+		p := zp + c.x
+		a := uint16(m[p]) | uint16(m[p+1])<<8
+		return fmt.Sprintf("%v ($%02X,X) @ %02X = %04X = %02X",
+			o.mnemonic, zp, p, a, m[a])
+	case zeroPageIndirectY:
+		base := uint16(m[zp]) | uint16(m[zp+1])<<8
+		a := base + uint16(c.y)
+		return fmt.Sprintf("%v ($%02X),Y = %04X @ %04X = %02X",
+			o.mnemonic, zp, base, a, m[a])
+	}
+	return fmt.Sprintf(".db $%02X", opcode)
+}
+
+// Tracer is an Observer that writes a TraceRecord for every executed
+// instruction.  Output is buffered; call Flush when done.
+type Tracer struct {
+	Ranges    []AddressRange // trace only these PCs, all when empty
+	FromCycle uint64         // do not trace before this cycle
+	ToCycle   uint64         // do not trace from this cycle on, 0 for all
+
+	format TraceFormat
+	w      *bufio.Writer
+	header bool // binary header was written
+	err    error
+}
+
+// NewTracer returns a tracer that writes records to w.
+func NewTracer(w io.Writer, format TraceFormat) *Tracer {
+	return &Tracer{
+		format: format,
+		w:      bufio.NewWriter(w),
+	}
+}
+
+// traced returns true if the instruction at pc at cycle must be recorded.
+func (t *Tracer) traced(pc uint16, cycle uint64) bool {
+	if cycle < t.FromCycle || (t.ToCycle != 0 && cycle >= t.ToCycle) {
+		return false
+	}
+	if len(t.Ranges) == 0 {
+		return true
+	}
+	for _, r := range t.Ranges {
+		if r.Contains(pc) {
+			return true
+		}
+	}
+	return false
+}
+
+// Before records the instruction that is about to execute.
+func (t *Tracer) Before(c *CPU) {
+	if t.err != nil || !t.traced(c.pc, c.cycles) {
+		return
+	}
+	r := c.traceRecord()
+	t.err = t.Write(&r)
+}
+
+// After is a no-op; records are written before the instruction executes.
+func (t *Tracer) After(c *CPU) {}
+
+// Write writes a single record.
+func (t *Tracer) Write(r *TraceRecord) error {
+	switch t.format {
+	case TraceNestest:
+		_, err := fmt.Fprintln(t.w, r.String())
+		return err
+	case TraceJSON:
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = t.w.Write(append(b, '\n'))
+		return err
+	case TraceBinary:
+		if !t.header {
+			if _, err := t.w.Write(traceMagic); err != nil {
+				return err
+			}
+			t.header = true
+		}
+		var b [traceBinarySize]byte
+		binary.LittleEndian.PutUint16(b[0:], r.PC)
+		b[2] = byte(len(r.Bytes))
+		copy(b[3:6], r.Bytes)
+		b[6] = r.A
+		b[7] = r.X
+		b[8] = r.Y
+		b[9] = r.P
+		b[10] = r.SP
+		binary.LittleEndian.PutUint64(b[11:], r.Cycles)
+		_, err := t.w.Write(b[:])
+		return err
+	}
+	return fmt.Errorf("invalid trace format: %v", t.format)
+}
+
+// Flush writes buffered records and returns the first error encountered.
+func (t *Tracer) Flush() error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.w.Flush()
+}
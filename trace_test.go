@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// traceProgram returns a CPU running a small program that exercises a few
+// addressing modes.
+func traceProgram() *CPU {
+	c := New()
+	c.pc = 0x0400
+	copy(c.memory[0x0400:], []byte{
+		0xa2, 0x02, // ldx #$02
+		0xb5, 0x10, // lda $10,x
+		0x8d, 0x00, 0x02, // sta $0200
+		0xa1, 0x20, // lda ($20,x)
+		0x4c, 0x00, 0x05, // jmp $0500
+	})
+	c.memory[0x12] = 0x77
+	c.memory[0x22] = 0x34
+	c.memory[0x23] = 0x12
+	c.memory[0x1234] = 0x99
+	return c
+}
+
+func TestTraceNestest(t *testing.T) {
+	c := traceProgram()
+	var b bytes.Buffer
+	tracer := NewTracer(&b, TraceNestest)
+	c.Attach(tracer)
+	for i := 0; i < 5; i++ {
+		c.executeInstruction()
+	}
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"0400  A2 02     LDX #$02                        " +
+			"A:00 X:00 Y:00 P:34 SP:FF CYC:0",
+		"0402  B5 10     LDA $10,X @ 12 = 77             " +
+			"A:00 X:02 Y:00 P:34 SP:FF CYC:2",
+		"0404  8D 00 02  STA $0200 = 00                  " +
+			"A:77 X:02 Y:00 P:34 SP:FF CYC:6",
+		"0407  A1 20     LDA ($20,X) @ 22 = 1234 = 99    " +
+			"A:77 X:02 Y:00 P:34 SP:FF CYC:10",
+		"0409  4C 00 05  JMP $0500                       " +
+			"A:99 X:02 Y:00 P:B4 SP:FF CYC:16",
+	}
+	got := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(got) != len(expected) {
+		t.Fatalf("unexpected trace:\n%v", b.String())
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("unexpected line %v:\n%q\nexpected\n%q", i,
+				got[i], expected[i])
+		}
+	}
+}
+
+func TestTraceFilters(t *testing.T) {
+	c := traceProgram()
+	var b bytes.Buffer
+	tracer := NewTracer(&b, TraceJSON)
+	tracer.Ranges = []AddressRange{{Start: 0x0402, End: 0x0407}}
+	tracer.ToCycle = 10
+	c.Attach(tracer)
+	for i := 0; i < 5; i++ {
+		c.executeInstruction()
+	}
+	c.Detach(tracer)
+	c.executeInstruction() // not traced
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var pcs []uint16
+	s := bufio.NewScanner(&b)
+	for s.Scan() {
+		var r TraceRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		pcs = append(pcs, r.PC)
+	}
+	// 0x0407 is in range but starts at cycle 10
+	if len(pcs) != 2 || pcs[0] != 0x0402 || pcs[1] != 0x0404 {
+		t.Fatalf("unexpected pcs %04x", pcs)
+	}
+}
+
+func TestTraceBinary(t *testing.T) {
+	c := traceProgram()
+	var b bytes.Buffer
+	tracer := NewTracer(&b, TraceBinary)
+	c.Attach(tracer)
+	c.executeInstruction()
+	c.executeInstruction()
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Len() != len(traceMagic)+2*traceBinarySize {
+		t.Fatalf("unexpected size %v", b.Len())
+	}
+	if !bytes.Equal(b.Bytes()[:len(traceMagic)], traceMagic) {
+		t.Fatalf("invalid magic")
+	}
+	r := b.Bytes()[len(traceMagic)+traceBinarySize:]
+	if binary.LittleEndian.Uint16(r) != 0x0402 || r[2] != 2 ||
+		r[3] != 0xb5 || r[4] != 0x10 || r[7] != 0x02 ||
+		binary.LittleEndian.Uint64(r[11:]) != 2 {
+		t.Fatalf("unexpected record %x", r)
+	}
+}
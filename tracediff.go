@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// TraceReader reads trace records written by a Tracer or by other emulators
+// in nestest.log format.  The format is detected from the first bytes.
+type TraceReader struct {
+	r      *bufio.Reader
+	format TraceFormat
+	line   int
+}
+
+// NewTraceReader returns a reader for the trace in r.
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	tr := TraceReader{r: bufio.NewReader(r), format: TraceNestest}
+	b, err := tr.r.Peek(len(traceMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(b, traceMagic):
+		tr.format = TraceBinary
+		tr.r.Discard(len(traceMagic))
+	case len(b) > 0 && b[0] == '{':
+		tr.format = TraceJSON
+	}
+	return &tr, nil
+}
+
+// Next returns the next record or io.EOF at the end of the trace.
+func (tr *TraceReader) Next() (*TraceRecord, error) {
+	if tr.format == TraceBinary {
+		var b [traceBinarySize]byte
+		if _, err := io.ReadFull(tr.r, b[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("truncated binary trace")
+			}
+			return nil, err
+		}
+		n := b[2]
+		if n > 3 {
+			return nil, fmt.Errorf("invalid instruction length: %v", n)
+		}
+		return &TraceRecord{
+			PC:     binary.LittleEndian.Uint16(b[0:]),
+			Bytes:  append([]byte(nil), b[3:3+n]...),
+			A:      b[6],
+			X:      b[7],
+			Y:      b[8],
+			P:      b[9],
+			SP:     b[10],
+			Cycles: binary.LittleEndian.Uint64(b[11:]),
+		}, nil
+	}
+
+	for {
+		line, err := tr.r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, err
+		}
+		tr.line++
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var r TraceRecord
+		if tr.format == TraceJSON {
+			err = json.Unmarshal([]byte(line), &r)
+		} else {
+			r, err = parseNestestLine(line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", tr.line, err)
+		}
+		return &r, nil
+	}
+}
+
+// parseNestestLine parses a nestest.log style line.  Fields other than the
+// CPU registers and cycle count, e.g. PPU, are ignored.
+func parseNestestLine(line string) (TraceRecord, error) {
+	var r TraceRecord
+	if len(line) < 4 {
+		return r, fmt.Errorf("line too short")
+	}
+	pc, err := strconv.ParseUint(line[0:4], 16, 16)
+	if err != nil {
+		return r, fmt.Errorf("invalid pc: %v", err)
+	}
+	r.PC = uint16(pc)
+
+	regs := strings.Index(line, "A:")
+	if regs < 0 {
+		return r, fmt.Errorf("no registers")
+	}
+
+	// raw bytes followed by the disassembly
+	head := line[4:regs]
+	fields := strings.Fields(head)
+	for len(fields) > 0 && len(r.Bytes) < 3 && len(fields[0]) == 2 {
+		b, err := hex.DecodeString(fields[0])
+		if err != nil {
+			break
+		}
+		r.Bytes = append(r.Bytes, b[0])
+		fields = fields[1:]
+	}
+	r.Disassembly = strings.TrimPrefix(strings.Join(fields, " "), "*")
+
+	found := 0
+	for _, f := range strings.Fields(line[regs:]) {
+		k, v, ok := strings.Cut(f, ":")
+		if !ok {
+			continue
+		}
+		if k == "CYC" {
+			r.Cycles, err = strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return r, fmt.Errorf("invalid cycles: %v", err)
+			}
+			continue
+		}
+		var reg *byte
+		switch k {
+		case "A":
+			reg = &r.A
+		case "X":
+			reg = &r.X
+		case "Y":
+			reg = &r.Y
+		case "P":
+			reg = &r.P
+		case "SP":
+			reg = &r.SP
+		default:
+			continue
+		}
+		b, err := strconv.ParseUint(v, 16, 8)
+		if err != nil {
+			return r, fmt.Errorf("invalid %v: %v", k, err)
+		}
+		*reg = byte(b)
+		found++
+	}
+	if found != 5 {
+		return r, fmt.Errorf("missing registers")
+	}
+	return r, nil
+}
+
+// TraceDiff compares execution against a reference trace in lockstep.
+type TraceDiff struct {
+	Context      int  // records shown around a divergence
+	IgnoreCycles bool // do not compare cycle counts
+	IgnoreFlags  byte // status register bits not compared besides B
+	CompareBreak bool // compare the B bit, which is ignored by default
+	Sync         bool // load registers and cycles from the first record
+}
+
+// TraceDivergence describes the first record where execution and the
+// reference trace disagree.
+type TraceDivergence struct {
+	Index     uint64        // 0 based record number
+	Fields    []string      // fields that differ
+	Reference TraceRecord   // expected state
+	Actual    TraceRecord   // state of the CPU
+	Before    []TraceRecord // matching records before the divergence
+	After     []TraceRecord // reference records after the divergence
+}
+
+// mismatch returns the fields in which actual differs from the reference.
+func (d *TraceDiff) mismatch(ref, actual *TraceRecord) []string {
+	var fields []string
+	if ref.PC != actual.PC {
+		fields = append(fields, "PC")
+	}
+	if ref.A != actual.A {
+		fields = append(fields, "A")
+	}
+	if ref.X != actual.X {
+		fields = append(fields, "X")
+	}
+	if ref.Y != actual.Y {
+		fields = append(fields, "Y")
+	}
+	mask := ^d.IgnoreFlags
+	if !d.CompareBreak {
+		mask &^= Break
+	}
+	if ref.P&mask != actual.P&mask {
+		fields = append(fields, "P")
+	}
+	if ref.SP != actual.SP {
+		fields = append(fields, "SP")
+	}
+	if !d.IgnoreCycles && ref.Cycles != actual.Cycles {
+		fields = append(fields, "CYC")
+	}
+	return fields
+}
+
+// Run executes one instruction per reference record and returns the first
+// divergence, or nil when the whole reference matched.  The number of
+// records compared is returned as well.
+func (d *TraceDiff) Run(c *CPU, tr *TraceReader) (*TraceDivergence, uint64,
+	error) {
+
+	var (
+		before []TraceRecord
+		index  uint64
+	)
+	for ; ; index++ {
+		ref, err := tr.Next()
+		if err == io.EOF {
+			return nil, index, nil
+		}
+		if err != nil {
+			return nil, index, err
+		}
+
+		if index == 0 && d.Sync {
+			c.pc = ref.PC
+			c.a = ref.A
+			c.x = ref.X
+			c.y = ref.Y
+			c.sr = ref.P
+			c.sp = ref.SP
+			c.cycles = ref.Cycles
+		}
+
+		actual := c.traceRecord()
+		fields := d.mismatch(ref, &actual)
+		if opcodes[c.memory[c.pc]] == invalidOpcode && len(fields) == 0 {
+			fields = []string{"opcode"}
+		}
+		if len(fields) != 0 {
+			dv := TraceDivergence{
+				Index:     index,
+				Fields:    fields,
+				Reference: *ref,
+				Actual:    actual,
+				Before:    before,
+			}
+			for i := 0; i < d.Context; i++ {
+				r, err := tr.Next()
+				if err != nil {
+					break
+				}
+				dv.After = append(dv.After, *r)
+			}
+			return &dv, index, nil
+		}
+
+		if d.Context > 0 {
+			if len(before) == d.Context {
+				before = before[1:]
+			}
+			before = append(before, actual)
+		}
+		c.executeInstruction()
+	}
+}
+
+// Write prints the divergence with its context.
+func (dv *TraceDivergence) Write(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "divergence at record %v: %v\n", dv.Index,
+		strings.Join(dv.Fields, " "))
+	for _, r := range dv.Before {
+		fmt.Fprintf(&b, "  %v\n", r)
+	}
+	fmt.Fprintf(&b, "- %v\n", dv.Reference)
+	fmt.Fprintf(&b, "+ %v\n", dv.Actual)
+	for _, r := range dv.After {
+		fmt.Fprintf(&b, "  %v\n", r)
+	}
+	for _, f := range dv.Fields {
+		var expected, got string
+		switch f {
+		case "PC":
+			expected = fmt.Sprintf("$%04X", dv.Reference.PC)
+			got = fmt.Sprintf("$%04X", dv.Actual.PC)
+		case "A":
+			expected = fmt.Sprintf("$%02X", dv.Reference.A)
+			got = fmt.Sprintf("$%02X", dv.Actual.A)
+		case "X":
+			expected = fmt.Sprintf("$%02X", dv.Reference.X)
+			got = fmt.Sprintf("$%02X", dv.Actual.X)
+		case "Y":
+			expected = fmt.Sprintf("$%02X", dv.Reference.Y)
+			got = fmt.Sprintf("$%02X", dv.Actual.Y)
+		case "P":
+			expected = flagString(dv.Reference.P)
+			got = flagString(dv.Actual.P)
+		case "SP":
+			expected = fmt.Sprintf("$%02X", dv.Reference.SP)
+			got = fmt.Sprintf("$%02X", dv.Actual.SP)
+		case "CYC":
+			expected = strconv.FormatUint(dv.Reference.Cycles, 10)
+			got = strconv.FormatUint(dv.Actual.Cycles, 10)
+		case "opcode":
+			expected = "valid opcode"
+			got = fmt.Sprintf("$%02X", dv.Actual.Bytes[0])
+		}
+		fmt.Fprintf(&b, "%v: expected %v got %v\n", f, expected, got)
+	}
+	fmt.Fprintf(&b, "disassembly: %v\n", dv.Actual.Disassembly)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// flagString returns the status register as NV-BDIZC letters, lower case
+// when clear.
+func flagString(p byte) string {
+	const letters = "NV-BDIZC"
+	b := []byte("nv-bdizc")
+	for i := 0; i < 8; i++ {
+		if p&(0x80>>i) != 0 {
+			b[i] = letters[i]
+		}
+	}
+	return fmt.Sprintf("$%02X %s", p, b)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseNestestLine(t *testing.T) {
+	r, err := parseNestestLine("C72D  B0 04    *BCS $C733                       " +
+		"A:00 X:00 Y:00 P:27 SP:FB PPU: 30, 12 CYC:51")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.PC != 0xc72d || !bytes.Equal(r.Bytes, []byte{0xb0, 0x04}) ||
+		r.Disassembly != "BCS $C733" || r.P != 0x27 || r.SP != 0xfb ||
+		r.Cycles != 51 {
+		t.Fatalf("unexpected record %+v", r)
+	}
+
+	if _, err := parseNestestLine("C72D  B0 04  BCS $C733  A:00"); err == nil {
+		t.Fatalf("expected missing registers")
+	}
+}
+
+// referenceTrace traces n instructions of the trace test program.
+func referenceTrace(t *testing.T, format TraceFormat, n int) []byte {
+	c := traceProgram()
+	var b bytes.Buffer
+	tracer := NewTracer(&b, format)
+	c.Attach(tracer)
+	for i := 0; i < n; i++ {
+		c.executeInstruction()
+	}
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestTraceDiffMatch(t *testing.T) {
+	for _, format := range []TraceFormat{TraceNestest, TraceBinary,
+		TraceJSON} {
+		tr, err := NewTraceReader(bytes.NewReader(referenceTrace(t,
+			format, 4)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := TraceDiff{Context: 2}
+		dv, n, err := d.Run(traceProgram(), tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dv != nil || n != 4 {
+			t.Fatalf("format %v: unexpected divergence %+v after %v",
+				format, dv, n)
+		}
+	}
+}
+
+func TestTraceDiffDivergence(t *testing.T) {
+	lines := strings.Split(string(referenceTrace(t, TraceNestest, 5)),
+		"\n")
+	// pretend the reference loaded $78 from $12
+	lines[2] = strings.Replace(lines[2], "A:77", "A:78", 1)
+	ref := strings.Join(lines, "\n")
+
+	tr, err := NewTraceReader(strings.NewReader(ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := TraceDiff{Context: 1}
+	dv, _, err := d.Run(traceProgram(), tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dv == nil || dv.Index != 2 || len(dv.Fields) != 1 ||
+		dv.Fields[0] != "A" {
+		t.Fatalf("unexpected divergence %+v", dv)
+	}
+	if len(dv.Before) != 1 || dv.Before[0].PC != 0x0402 ||
+		len(dv.After) != 1 || dv.After[0].PC != 0x0407 {
+		t.Fatalf("unexpected context %+v", dv)
+	}
+
+	var b bytes.Buffer
+	if err := dv.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "A: expected $78 got $77") ||
+		!strings.Contains(b.String(), "disassembly: STA $0200 = 00") {
+		t.Fatalf("unexpected report:\n%v", b.String())
+	}
+}
+
+func TestTraceDiffSync(t *testing.T) {
+	// a nestest style reference that starts with different registers
+	ref := "0400  A2 02     LDX #$02                         " +
+		"A:11 X:00 Y:22 P:24 SP:FD CYC:7\n" +
+		"0402  B5 10     LDA $10,X @ 12 = 77              " +
+		"A:11 X:02 Y:22 P:24 SP:FD CYC:9\n"
+	tr, err := NewTraceReader(strings.NewReader(ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := TraceDiff{Sync: true}
+	dv, n, err := d.Run(traceProgram(), tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dv != nil || n != 2 {
+		t.Fatalf("unexpected divergence %+v", dv)
+	}
+}
+
+func TestTraceDiffFlags(t *testing.T) {
+	// the reference has B and carry set
+	ref := "0400  A2 02     LDX #$02                         " +
+		"A:00 X:00 Y:00 P:35 SP:FD CYC:7\n"
+	for _, tc := range []struct {
+		d      TraceDiff
+		differ bool
+	}{
+		{TraceDiff{}, true},
+		{TraceDiff{IgnoreFlags: Carry}, false},
+		{TraceDiff{IgnoreFlags: Carry, CompareBreak: true}, true},
+	} {
+		tr, err := NewTraceReader(strings.NewReader(ref))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := traceProgram()
+		c.a, c.x, c.y, c.sr, c.sp, c.cycles = 0, 0, 0, 0x24, 0xfd, 7
+		dv, _, err := tc.d.Run(c, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (dv != nil) != tc.differ {
+			t.Fatalf("%+v: unexpected divergence %+v", tc.d, dv)
+		}
+		if dv != nil && (len(dv.Fields) != 1 || dv.Fields[0] != "P") {
+			t.Fatalf("%+v: unexpected fields %v", tc.d, dv.Fields)
+		}
+	}
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// VICE binary remote monitor protocol server.  See "The binary remote
+// monitor" chapter of the VICE manual.
+
+const (
+	viceSTX        = 0x02
+	viceAPIVersion = 0x02
+	viceEventID    = 0xffffffff
+
+	// commands
+	viceMemoryGet          = 0x01
+	viceMemorySet          = 0x02
+	viceCheckpointGet      = 0x11
+	viceCheckpointSet      = 0x12
+	viceCheckpointDelete   = 0x13
+	viceCheckpointList     = 0x14
+	viceCheckpointToggle   = 0x15
+	viceRegistersGet       = 0x31
+	viceRegistersSet       = 0x32
+	viceAdvanceInstruction = 0x71
+	vicePing               = 0x81
+	viceRegistersAvailable = 0x83
+	viceExit               = 0xaa
+	viceQuit               = 0xbb
+	viceReset              = 0xcc
+
+	// events
+	viceJAM     = 0x61
+	viceStopped = 0x62
+	viceResumed = 0x63
+
+	// errors
+	viceOK            = 0x00
+	viceErrNotFound   = 0x01
+	viceErrMemspace   = 0x02
+	viceErrLength     = 0x80
+	viceErrParameter  = 0x81
+	viceErrAPIVersion = 0x82
+	viceErrCommand    = 0x83
+	viceErrGeneral    = 0x8f
+
+	viceMainMemory       = 0x00 // memspace
+	viceCheckpointExec   = 0x04 // checkpoint operation
+	viceCheckpointLength = 8    // checkpoint set body without memspace
+
+	// register ids
+	viceRegA  = 0x00
+	viceRegX  = 0x01
+	viceRegY  = 0x02
+	viceRegPC = 0x03
+	viceRegSP = 0x04
+	viceRegFL = 0x05
+
+	viceBatch = 4096 // instructions executed per lock
+)
+
+var viceRegisters = []struct {
+	id   byte
+	bits byte
+	name string
+}{
+	{viceRegA, 8, "A"},
+	{viceRegX, 8, "X"},
+	{viceRegY, 8, "Y"},
+	{viceRegPC, 16, "PC"},
+	{viceRegSP, 8, "SP"},
+	{viceRegFL, 8, "FL"},
+}
+
+// viceError is returned by command handlers to send an error response.
+type viceError byte
+
+func (e viceError) Error() string {
+	return fmt.Sprintf("vice error $%02x", byte(e))
+}
+
+type viceCheckpoint struct {
+	number    uint32
+	start     uint16
+	end       uint16
+	stop      bool
+	enabled   bool
+	operation byte
+	temporary bool
+	hits      uint32
+}
+
+type viceServer struct {
+	wmtx sync.Mutex // protects w
+	w    io.Writer
+
+	pause atomic.Bool
+
+	mtx         sync.Mutex // protects everything below
+	cpu         *CPU
+	start       uint16 // pc after reset
+	checkpoints map[uint32]*viceCheckpoint
+	number      uint32 // last checkpoint number
+	done        chan struct{}
+	quit        bool
+}
+
+func newVICEServer(c *CPU, start uint16) *viceServer {
+	return &viceServer{
+		cpu:         c,
+		start:       start,
+		checkpoints: make(map[uint32]*viceCheckpoint),
+	}
+}
+
+// readVICERequest reads a single request and returns its id, command and
+// body.
+func readVICERequest(r io.Reader) (uint32, byte, []byte, error) {
+	var h [11]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	if h[0] != viceSTX {
+		return 0, 0, nil, fmt.Errorf("invalid start byte $%02x", h[0])
+	}
+	length := binary.LittleEndian.Uint32(h[2:6])
+	if length > 0x10000+16 {
+		return 0, 0, nil, fmt.Errorf("request too large: %v", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	id := binary.LittleEndian.Uint32(h[6:10])
+	if h[1] != viceAPIVersion {
+		return id, h[10], nil, viceError(viceErrAPIVersion)
+	}
+	return id, h[10], body, nil
+}
+
+// writeVICEResponse writes a single response or event.
+func writeVICEResponse(w io.Writer, id uint32, kind, code byte,
+	body []byte) error {
+
+	b := make([]byte, 12, 12+len(body))
+	b[0] = viceSTX
+	b[1] = viceAPIVersion
+	binary.LittleEndian.PutUint32(b[2:6], uint32(len(body)))
+	b[6] = kind
+	b[7] = code
+	binary.LittleEndian.PutUint32(b[8:12], id)
+	_, err := w.Write(append(b, body...))
+	return err
+}
+
+func (s *viceServer) send(id uint32, kind, code byte, body []byte) {
+	s.wmtx.Lock()
+	defer s.wmtx.Unlock()
+
+	if s.w == nil {
+		return
+	}
+	// A failed write shows up as a read error on the next request.
+	_ = writeVICEResponse(s.w, id, kind, code, body)
+}
+
+// serve handles requests on a single connection until it is closed or a
+// quit command is received.
+func (s *viceServer) serve(r io.Reader, w io.Writer) error {
+	s.wmtx.Lock()
+	s.w = w
+	s.wmtx.Unlock()
+	defer func() {
+		s.wmtx.Lock()
+		s.w = nil
+		s.wmtx.Unlock()
+	}()
+
+	br := bufio.NewReader(r)
+	for {
+		id, command, body, err := readVICERequest(br)
+		if e, ok := err.(viceError); ok {
+			s.send(id, command, byte(e), nil)
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		// Like VICE the machine stops while the monitor is in use.
+		s.halt()
+
+		reply, err := s.handle(id, command, body)
+		code := byte(viceOK)
+		if e, ok := err.(viceError); ok {
+			code = byte(e)
+			reply = nil
+		} else if err != nil {
+			return err
+		}
+		s.send(id, command, code, reply)
+
+		if code != viceOK {
+			continue
+		}
+		switch command {
+		case viceAdvanceInstruction:
+			count := binary.LittleEndian.Uint16(body[1:3])
+			if count == 0 {
+				count = 1
+			}
+			s.resume(body[0] != 0, count)
+		case viceExit:
+			s.resume(false, 0)
+		case viceQuit:
+			return nil
+		}
+	}
+}
+
+// handle executes a single command and returns the response body.
+func (s *viceServer) handle(id uint32, command byte,
+	body []byte) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c := s.cpu
+	switch command {
+	case viceMemoryGet:
+		if len(body) != 8 {
+			return nil, viceError(viceErrLength)
+		}
+		if body[5] != viceMainMemory {
+			return nil, viceError(viceErrMemspace)
+		}
+		start := binary.LittleEndian.Uint16(body[1:3])
+		end := binary.LittleEndian.Uint16(body[3:5])
+		if end < start {
+			return nil, viceError(viceErrParameter)
+		}
+		data := c.memory[start : int(end)+1]
+		reply := make([]byte, 2, 2+len(data))
+		binary.LittleEndian.PutUint16(reply, uint16(len(data)))
+		return append(reply, data...), nil
+
+	case viceMemorySet:
+		if len(body) < 8 {
+			return nil, viceError(viceErrLength)
+		}
+		if body[5] != viceMainMemory {
+			return nil, viceError(viceErrMemspace)
+		}
+		start := binary.LittleEndian.Uint16(body[1:3])
+		end := binary.LittleEndian.Uint16(body[3:5])
+		if end < start {
+			return nil, viceError(viceErrParameter)
+		}
+		if len(body)-8 != int(end-start)+1 {
+			return nil, viceError(viceErrLength)
+		}
+		copy(c.memory[start:], body[8:])
+		return nil, nil
+
+	case viceCheckpointGet, viceCheckpointDelete:
+		if len(body) != 4 {
+			return nil, viceError(viceErrLength)
+		}
+		cp, ok := s.checkpoints[binary.LittleEndian.Uint32(body)]
+		if !ok {
+			return nil, viceError(viceErrNotFound)
+		}
+		if command == viceCheckpointDelete {
+			delete(s.checkpoints, cp.number)
+			return nil, nil
+		}
+		return cp.marshal(c.pc), nil
+
+	case viceCheckpointSet:
+		if len(body) != viceCheckpointLength &&
+			len(body) != viceCheckpointLength+1 {
+			return nil, viceError(viceErrLength)
+		}
+		if len(body) > viceCheckpointLength &&
+			body[8] != viceMainMemory {
+			return nil, viceError(viceErrMemspace)
+		}
+		if body[6] != viceCheckpointExec {
+			// memory accesses are not observable
+			return nil, viceError(viceErrParameter)
+		}
+		s.number++
+		cp := viceCheckpoint{
+			number:    s.number,
+			start:     binary.LittleEndian.Uint16(body[0:2]),
+			end:       binary.LittleEndian.Uint16(body[2:4]),
+			stop:      body[4] != 0,
+			enabled:   body[5] != 0,
+			operation: body[6],
+			temporary: body[7] != 0,
+		}
+		if cp.end < cp.start {
+			return nil, viceError(viceErrParameter)
+		}
+		s.checkpoints[cp.number] = &cp
+		return cp.marshal(c.pc), nil
+
+	case viceCheckpointToggle:
+		if len(body) != 5 {
+			return nil, viceError(viceErrLength)
+		}
+		cp, ok := s.checkpoints[binary.LittleEndian.Uint32(body)]
+		if !ok {
+			return nil, viceError(viceErrNotFound)
+		}
+		cp.enabled = body[4] != 0
+		return nil, nil
+
+	case viceCheckpointList:
+		for n := uint32(1); n <= s.number; n++ {
+			if cp, ok := s.checkpoints[n]; ok {
+				s.send(id, viceCheckpointGet, viceOK,
+					cp.marshal(c.pc))
+			}
+		}
+		reply := make([]byte, 4)
+		binary.LittleEndian.PutUint32(reply,
+			uint32(len(s.checkpoints)))
+		return reply, nil
+
+	case viceRegistersGet:
+		if len(body) != 1 {
+			return nil, viceError(viceErrLength)
+		}
+		if body[0] != viceMainMemory {
+			return nil, viceError(viceErrMemspace)
+		}
+		return s.registers(), nil
+
+	case viceRegistersSet:
+		if len(body) < 3 {
+			return nil, viceError(viceErrLength)
+		}
+		if body[0] != viceMainMemory {
+			return nil, viceError(viceErrMemspace)
+		}
+		count := int(binary.LittleEndian.Uint16(body[1:3]))
+		items := body[3:]
+		for i := 0; i < count; i++ {
+			if len(items) < 4 || items[0] < 3 ||
+				len(items) < int(items[0])+1 {
+				return nil, viceError(viceErrLength)
+			}
+			v := binary.LittleEndian.Uint16(items[2:4])
+			switch items[1] {
+			case viceRegA:
+				c.a = byte(v)
+			case viceRegX:
+				c.x = byte(v)
+			case viceRegY:
+				c.y = byte(v)
+			case viceRegPC:
+				c.pc = v
+			case viceRegSP:
+				c.sp = byte(v)
+			case viceRegFL:
+				c.sr = byte(v) | Unused
+			default:
+				return nil, viceError(viceErrParameter)
+			}
+			items = items[items[0]+1:]
+		}
+		return s.registers(), nil
+
+	case viceAdvanceInstruction:
+		if len(body) != 3 {
+			return nil, viceError(viceErrLength)
+		}
+		return nil, nil
+
+	case viceRegistersAvailable:
+		if len(body) != 1 {
+			return nil, viceError(viceErrLength)
+		}
+		reply := make([]byte, 2)
+		binary.LittleEndian.PutUint16(reply, uint16(len(viceRegisters)))
+		for _, r := range viceRegisters {
+			reply = append(reply, byte(3+len(r.name)), r.id, r.bits,
+				byte(len(r.name)))
+			reply = append(reply, r.name...)
+		}
+		return reply, nil
+
+	case vicePing, viceExit:
+		return nil, nil
+
+	case viceQuit:
+		s.quit = true
+		return nil, nil
+
+	case viceReset:
+		if len(body) != 1 {
+			return nil, viceError(viceErrLength)
+		}
+		c.a = 0
+		c.x = 0
+		c.y = 0
+		c.sp = 0xfd
+		c.sr = Unused | Interrupts
+		c.pc = s.start
+		return nil, nil
+	}
+
+	return nil, viceError(viceErrCommand)
+}
+
+// marshal returns the checkpoint info response body.
+func (cp *viceCheckpoint) marshal(pc uint16) []byte {
+	b := make([]byte, 0, 22)
+	b = binary.LittleEndian.AppendUint32(b, cp.number)
+	b = append(b, viceBool(cp.enabled && pc >= cp.start && pc <= cp.end))
+	b = binary.LittleEndian.AppendUint16(b, cp.start)
+	b = binary.LittleEndian.AppendUint16(b, cp.end)
+	b = append(b, viceBool(cp.stop), viceBool(cp.enabled), cp.operation,
+		viceBool(cp.temporary))
+	b = binary.LittleEndian.AppendUint32(b, cp.hits)
+	b = binary.LittleEndian.AppendUint32(b, 0) // ignore count
+	b = append(b, 0, viceMainMemory)           // no condition
+	return b
+}
+
+func viceBool(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// registers returns the register response body.  It must be called with the
+// mutex held.
+func (s *viceServer) registers() []byte {
+	c := s.cpu
+	b := binary.LittleEndian.AppendUint16(nil, uint16(len(viceRegisters)))
+	for _, r := range viceRegisters {
+		var v uint16
+		switch r.id {
+		case viceRegA:
+			v = uint16(c.a)
+		case viceRegX:
+			v = uint16(c.x)
+		case viceRegY:
+			v = uint16(c.y)
+		case viceRegPC:
+			v = c.pc
+		case viceRegSP:
+			v = uint16(c.sp)
+		case viceRegFL:
+			v = uint16(c.sr)
+		}
+		b = append(b, 3, r.id)
+		b = binary.LittleEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+// halt stops the run goroutine, if any, and waits for it to exit.
+func (s *viceServer) halt() {
+	s.mtx.Lock()
+	done := s.done
+	s.mtx.Unlock()
+
+	if done == nil {
+		return
+	}
+	s.pause.Store(true)
+	<-done
+}
+
+// resume runs the CPU in the background.  When count is not zero only count
+// instructions are executed, stepping over subroutines when over is set.
+func (s *viceServer) resume(over bool, count uint16) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.pause.Store(false)
+	done := make(chan struct{})
+	s.done = done
+
+	pc := make([]byte, 2)
+	binary.LittleEndian.PutUint16(pc, s.cpu.pc)
+	s.send(viceEventID, viceResumed, viceOK, pc)
+
+	go func() {
+		defer close(done)
+
+		event := s.execute(over, count)
+
+		s.mtx.Lock()
+		s.done = nil
+		regs := s.registers()
+		binary.LittleEndian.PutUint16(pc, s.cpu.pc)
+		s.mtx.Unlock()
+
+		s.send(viceEventID, viceRegistersGet, viceOK, regs)
+		s.send(viceEventID, event, viceOK, pc)
+	}()
+}
+
+// checkpoint returns the enabled execution checkpoint at pc, if any.  It must
+// be called with the mutex held.
+func (s *viceServer) checkpoint(pc uint16) *viceCheckpoint {
+	for n := uint32(1); n <= s.number; n++ {
+		cp, ok := s.checkpoints[n]
+		if ok && cp.enabled && pc >= cp.start && pc <= cp.end {
+			return cp
+		}
+	}
+	return nil
+}
+
+// execute runs instructions and returns the event that stopped execution.
+func (s *viceServer) execute(over bool, count uint16) byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c := s.cpu
+	var returnSP byte
+	stepping := false // stepping over a subroutine
+	for n := 0; ; n++ {
+		if n > 0 && n%viceBatch == 0 {
+			// let monitor commands in
+			s.mtx.Unlock()
+			s.mtx.Lock()
+		}
+		if s.pause.Load() {
+			return viceStopped
+		}
+		if cp := s.checkpoint(c.pc); cp != nil && n > 0 {
+			cp.hits++
+			s.send(viceEventID, viceCheckpointGet, viceOK,
+				cp.marshal(c.pc))
+			if cp.temporary {
+				delete(s.checkpoints, cp.number)
+			}
+			if cp.stop {
+				return viceStopped
+			}
+		}
+		if opcodes[c.memory[c.pc]] == invalidOpcode {
+			return viceJAM
+		}
+
+		opcode := c.memory[c.pc]
+		if over && !stepping && opcode == 0x20 {
+			stepping = true
+			returnSP = c.sp
+		}
+		c.executeInstruction()
+		if stepping {
+			if c.sp < returnSP {
+				continue
+			}
+			stepping = false
+		}
+		if count != 0 {
+			count--
+			if count == 0 {
+				return viceStopped
+			}
+		}
+	}
+}
+
+// listenVICE serves the binary monitor protocol, one connection at a time, on
+// a TCP address.
+func listenVICE(address string, c *CPU, start uint16) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	s := newVICEServer(c, start)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		err = s.serve(conn, conn)
+		conn.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "vice: %v\n", err)
+		}
+		if s.quit {
+			return nil
+		}
+	}
+}
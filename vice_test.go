@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type viceResponse struct {
+	kind byte
+	code byte
+	id   uint32
+	body []byte
+}
+
+// viceClient drives a viceServer over a pipe.
+type viceClient struct {
+	t         *testing.T
+	conn      net.Conn
+	id        uint32
+	responses chan viceResponse
+}
+
+func newVICEClient(t *testing.T, c *CPU) *viceClient {
+	client, server := net.Pipe()
+	vc := &viceClient{
+		t:         t,
+		conn:      client,
+		responses: make(chan viceResponse, 100),
+	}
+
+	s := newVICEServer(c, c.pc)
+	go s.serve(server, server)
+	go func() {
+		for {
+			var h [12]byte
+			if _, err := io.ReadFull(client, h[:]); err != nil {
+				close(vc.responses)
+				return
+			}
+			r := viceResponse{
+				kind: h[6],
+				code: h[7],
+				id:   binary.LittleEndian.Uint32(h[8:12]),
+				body: make([]byte, binary.LittleEndian.Uint32(h[2:6])),
+			}
+			if _, err := io.ReadFull(client, r.body); err != nil {
+				close(vc.responses)
+				return
+			}
+			vc.responses <- r
+		}
+	}()
+	t.Cleanup(func() { client.Close() })
+
+	return vc
+}
+
+func (vc *viceClient) next() viceResponse {
+	select {
+	case r, ok := <-vc.responses:
+		if !ok {
+			vc.t.Fatalf("connection closed")
+		}
+		return r
+	case <-time.After(10 * time.Second):
+		vc.t.Fatalf("timeout")
+	}
+	return viceResponse{}
+}
+
+// command sends a command and returns its response.
+func (vc *viceClient) command(command byte, body []byte) viceResponse {
+	vc.id++
+	b := []byte{viceSTX, viceAPIVersion}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(body)))
+	b = binary.LittleEndian.AppendUint32(b, vc.id)
+	b = append(b, command)
+	if _, err := vc.conn.Write(append(b, body...)); err != nil {
+		vc.t.Fatal(err)
+	}
+	for {
+		r := vc.next()
+		if r.id == vc.id && r.kind == command {
+			return r
+		}
+	}
+}
+
+// event waits for the event of the provided kind.
+func (vc *viceClient) event(kind byte) viceResponse {
+	for {
+		r := vc.next()
+		if r.id == viceEventID && r.kind == kind {
+			return r
+		}
+	}
+}
+
+func (vc *viceClient) register(regs []byte, id byte) uint16 {
+	count := int(binary.LittleEndian.Uint16(regs))
+	regs = regs[2:]
+	for i := 0; i < count; i++ {
+		if regs[1] == id {
+			return binary.LittleEndian.Uint16(regs[2:4])
+		}
+		regs = regs[regs[0]+1:]
+	}
+	vc.t.Fatalf("register %v not found", id)
+	return 0
+}
+
+func TestVICEMemoryAndRegisters(t *testing.T) {
+	c := New()
+	vc := newVICEClient(t, c)
+
+	set := []byte{0, 0x00, 0x10, 0x02, 0x10, viceMainMemory, 0, 0}
+	set = append(set, 0xa9, 0x55, 0xea)
+	if r := vc.command(viceMemorySet, set); r.code != viceOK {
+		t.Fatalf("memory set failed: %02x", r.code)
+	}
+	r := vc.command(viceMemoryGet,
+		[]byte{0, 0x00, 0x10, 0x02, 0x10, viceMainMemory, 0, 0})
+	if r.code != viceOK {
+		t.Fatalf("memory get failed: %02x", r.code)
+	}
+	if !bytes.Equal(r.body, []byte{3, 0, 0xa9, 0x55, 0xea}) {
+		t.Fatalf("unexpected memory %x", r.body)
+	}
+
+	r = vc.command(viceRegistersSet, []byte{viceMainMemory, 2, 0,
+		3, viceRegPC, 0x00, 0x10,
+		3, viceRegX, 0x42, 0x00})
+	if r.code != viceOK {
+		t.Fatalf("registers set failed: %02x", r.code)
+	}
+	if vc.register(r.body, viceRegPC) != 0x1000 ||
+		vc.register(r.body, viceRegX) != 0x42 {
+		t.Fatalf("unexpected registers %x", r.body)
+	}
+
+	r = vc.command(viceRegistersSet, []byte{viceMainMemory, 1, 0,
+		3, 0x77, 0x00, 0x10})
+	if r.code != viceErrParameter {
+		t.Fatalf("expected invalid parameter, got %02x", r.code)
+	}
+
+	r = vc.command(viceRegistersGet, []byte{0x07})
+	if r.code != viceErrMemspace {
+		t.Fatalf("expected invalid memspace, got %02x", r.code)
+	}
+}
+
+func TestVICEExecution(t *testing.T) {
+	c := New()
+	c.pc = 0x0400
+	copy(c.memory[0x0400:], []byte{
+		0x20, 0x10, 0x04, // jsr $0410
+		0xe8,             // inx
+		0x4c, 0x03, 0x04, // jmp $0403
+	})
+	copy(c.memory[0x0410:], []byte{
+		0xa9, 0x42, // lda #$42
+		0x60, // rts
+	})
+	vc := newVICEClient(t, c)
+
+	// step over the subroutine
+	r := vc.command(viceAdvanceInstruction, []byte{1, 1, 0})
+	if r.code != viceOK {
+		t.Fatalf("advance failed: %02x", r.code)
+	}
+	regs := vc.event(viceRegistersGet)
+	e := vc.event(viceStopped)
+	if binary.LittleEndian.Uint16(e.body) != 0x0403 {
+		t.Fatalf("unexpected pc %x", e.body)
+	}
+	if vc.register(regs.body, viceRegA) != 0x42 {
+		t.Fatalf("unexpected registers %x", regs.body)
+	}
+
+	// checkpoint on inx
+	r = vc.command(viceCheckpointSet, []byte{0x03, 0x04, 0x03, 0x04,
+		1, 1, viceCheckpointExec, 0})
+	if r.code != viceOK {
+		t.Fatalf("checkpoint set failed: %02x", r.code)
+	}
+	number := binary.LittleEndian.Uint32(r.body)
+
+	vc.command(viceExit, nil)
+	e = vc.event(viceCheckpointGet)
+	if binary.LittleEndian.Uint32(e.body) != number {
+		t.Fatalf("unexpected checkpoint %x", e.body)
+	}
+	vc.event(viceStopped)
+
+	r = vc.command(viceCheckpointList, nil)
+	if binary.LittleEndian.Uint32(r.body) != 1 {
+		t.Fatalf("unexpected checkpoint count %x", r.body)
+	}
+
+	// the monitor stops the machine
+	vc.command(viceCheckpointDelete,
+		binary.LittleEndian.AppendUint32(nil, number))
+	vc.command(viceExit, nil)
+	vc.event(viceResumed)
+	r = vc.command(viceRegistersGet, []byte{viceMainMemory})
+	if r.code != viceOK {
+		t.Fatalf("registers get failed: %02x", r.code)
+	}
+
+	r = vc.command(viceReset, []byte{0})
+	if r.code != viceOK {
+		t.Fatalf("reset failed: %02x", r.code)
+	}
+	r = vc.command(viceRegistersGet, []byte{viceMainMemory})
+	if vc.register(r.body, viceRegPC) != 0x0400 {
+		t.Fatalf("unexpected registers %x", r.body)
+	}
+
+	r = vc.command(0x42, nil)
+	if r.code != viceErrCommand {
+		t.Fatalf("expected invalid command, got %02x", r.code)
+	}
+}